@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"skabillium/memo/cmd/db"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAnalyzeCount     = 100 // Keys analyzed while holding the database lock
+	DefaultAnalyzeTop       = 10  // Keys and prefixes reported in every ranking
+	DefaultAnalyzeSeparator = ":"
+)
+
+// Upper bounds of the TTL distribution buckets, keys that expire later fall in the last one
+var ttlBuckets = []struct {
+	name string
+	ttl  time.Duration
+}{
+	{"0-1m", time.Minute},
+	{"1m-1h", time.Hour},
+	{"1h-1d", 24 * time.Hour},
+	{"1d-7d", 7 * 24 * time.Hour},
+	{"7d+", 0},
+}
+
+// Report of ANALYZE, it is serialized to JSON so it can be consumed by dashboards
+type analyzeReport struct {
+	Keys     int                    `json:"keys"`
+	Bytes    int                    `json:"bytes"`
+	Types    map[string]*typeReport `json:"types"`
+	Prefixes []*prefixReport        `json:"prefixes"`
+	TTL      []*ttlReport           `json:"ttl"`
+	Hottest  []keyReport            `json:"hottest"`
+}
+
+type typeReport struct {
+	Keys     int         `json:"keys"`
+	Bytes    int         `json:"bytes"`
+	Elements int         `json:"elements"`
+	Biggest  []keyReport `json:"biggest"`
+}
+
+type prefixReport struct {
+	Prefix string `json:"prefix"` // Empty for keys without the separator
+	Keys   int    `json:"keys"`
+	Bytes  int    `json:"bytes"`
+}
+
+type ttlReport struct {
+	Bucket string `json:"bucket"`
+	Keys   int    `json:"keys"`
+	Bytes  int    `json:"bytes"`
+}
+
+type keyReport struct {
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Bytes    int    `json:"bytes"`
+	Elements int    `json:"elements"`
+	TTL      int64  `json:"ttl"`      // Milliseconds, -1 if the key never expires
+	IdleTime int64  `json:"idletime"` // Seconds
+	Freq     int    `json:"freq"`
+}
+
+// Collects the statistics of the keys it is given one batch at a time, so that the walk over
+// the keyspace can be interleaved with other commands
+type keyAnalyzer struct {
+	pattern   string
+	count     int
+	top       int
+	separator string
+
+	report   analyzeReport
+	biggest  map[string]*topKeys
+	hottest  *topKeys
+	prefixes map[string]*prefixReport
+}
+
+func newKeyAnalyzer(cmd *Command) *keyAnalyzer {
+	a := &keyAnalyzer{
+		pattern:   cmd.Pattern,
+		count:     cmd.Count,
+		top:       cmd.Limit,
+		separator: cmd.Separator,
+		report:    analyzeReport{Types: map[string]*typeReport{}},
+		biggest:   map[string]*topKeys{},
+		hottest:   &topKeys{n: cmd.Limit, before: hotterKey},
+		prefixes:  map[string]*prefixReport{},
+	}
+	for _, bucket := range ttlBuckets {
+		a.report.TTL = append(a.report.TTL, &ttlReport{Bucket: bucket.name})
+	}
+	a.report.TTL = append(a.report.TTL, &ttlReport{Bucket: "none"})
+
+	return a
+}
+
+// Analyze the keys in the buckets starting from the cursor, returns the cursor to continue
+// from like SCAN, 0 when every key was visited
+func (a *keyAnalyzer) scan(d *db.Database, cursor uint64) uint64 {
+	keys, cursor := d.Scan(cursor, a.count, a.pattern, "")
+	now := time.Now().UnixMilli()
+	for _, key := range keys {
+		if info, found := d.KeyInfo(key); found {
+			a.add(key, info, now)
+		}
+	}
+
+	return cursor
+}
+
+// Analyze the whole keyspace at once
+func (a *keyAnalyzer) scanAll(d *db.Database) {
+	for cursor := a.scan(d, 0); cursor != 0; {
+		cursor = a.scan(d, cursor)
+	}
+}
+
+func (a *keyAnalyzer) add(key string, info db.KeyInfo, now int64) {
+	k := keyReport{
+		Key:      key,
+		Type:     info.Type,
+		Bytes:    info.Bytes,
+		Elements: info.Elements,
+		TTL:      -1,
+		IdleTime: info.IdleTime / 1000,
+		Freq:     info.Freq,
+	}
+	if info.ExpiresAt != 0 {
+		k.TTL = max(info.ExpiresAt-now, 0)
+	}
+
+	a.report.Keys++
+	a.report.Bytes += k.Bytes
+
+	t, found := a.report.Types[k.Type]
+	if !found {
+		t = &typeReport{}
+		a.report.Types[k.Type] = t
+		a.biggest[k.Type] = &topKeys{n: a.top, before: biggerKey}
+	}
+	t.Keys++
+	t.Bytes += k.Bytes
+	t.Elements += k.Elements
+	a.biggest[k.Type].add(k)
+	a.hottest.add(k)
+
+	prefix := ""
+	if idx := strings.Index(key, a.separator); idx != -1 {
+		prefix = key[:idx+len(a.separator)] + "*"
+	}
+	p, found := a.prefixes[prefix]
+	if !found {
+		p = &prefixReport{Prefix: prefix}
+		a.prefixes[prefix] = p
+	}
+	p.Keys++
+	p.Bytes += k.Bytes
+
+	bucket := a.report.TTL[len(a.report.TTL)-1]
+	if k.TTL != -1 {
+		for i, b := range ttlBuckets {
+			if b.ttl == 0 || k.TTL < b.ttl.Milliseconds() {
+				bucket = a.report.TTL[i]
+				break
+			}
+		}
+	}
+	bucket.Keys++
+	bucket.Bytes += k.Bytes
+}
+
+// Get the report of the keys analyzed so far, only the top prefixes by size are included
+func (a *keyAnalyzer) result() *analyzeReport {
+	for kind, top := range a.biggest {
+		a.report.Types[kind].Biggest = append([]keyReport{}, top.keys...)
+	}
+	a.report.Hottest = append([]keyReport{}, a.hottest.keys...)
+
+	a.report.Prefixes = make([]*prefixReport, 0, len(a.prefixes))
+	for _, p := range a.prefixes {
+		a.report.Prefixes = append(a.report.Prefixes, p)
+	}
+	sort.Slice(a.report.Prefixes, func(i, j int) bool {
+		pi, pj := a.report.Prefixes[i], a.report.Prefixes[j]
+		if pi.Bytes != pj.Bytes {
+			return pi.Bytes > pj.Bytes
+		}
+		return pi.Prefix < pj.Prefix
+	})
+	a.report.Prefixes = a.report.Prefixes[:min(len(a.report.Prefixes), a.top)]
+
+	return &a.report
+}
+
+func (a *keyAnalyzer) reply() any {
+	report, err := json.Marshal(a.result())
+	if err != nil {
+		return err
+	}
+	return string(report)
+}
+
+// The first n keys in the order given by before
+type topKeys struct {
+	n      int
+	keys   []keyReport
+	before func(keyReport, keyReport) bool
+}
+
+func (t *topKeys) add(k keyReport) {
+	idx := sort.Search(len(t.keys), func(i int) bool { return t.before(k, t.keys[i]) })
+	if idx >= t.n {
+		return
+	}
+
+	t.keys = append(t.keys, keyReport{})
+	copy(t.keys[idx+1:], t.keys[idx:])
+	t.keys[idx] = k
+	if len(t.keys) > t.n {
+		t.keys = t.keys[:t.n]
+	}
+}
+
+func biggerKey(k keyReport, other keyReport) bool {
+	if k.Bytes != other.Bytes {
+		return k.Bytes > other.Bytes
+	}
+	return k.Elements > other.Elements
+}
+
+func hotterKey(k keyReport, other keyReport) bool {
+	if k.Freq != other.Freq {
+		return k.Freq > other.Freq
+	}
+	return k.IdleTime < other.IdleTime
+}
+
+// Walk the keyspace like SCAN, analyzing COUNT keys at a time. The database lock is only held
+// while a batch is analyzed, so writes are not blocked until the walk is over.
+func (s *Server) analyze(cmd *Command) any {
+	a := newKeyAnalyzer(cmd)
+	for cursor := uint64(0); ; {
+		s.dbmu.RLock()
+		cursor = a.scan(s.db, cursor)
+		s.dbmu.RUnlock()
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return a.reply()
+}
+
+// Analyze a snapshot offline and print the report, this is the "analyze" subcommand:
+//
+//	memo analyze [options] [snapshot]
+func runAnalyze(args []string) error {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	cmd := &Command{Kind: CmdAnalyze}
+	flags.StringVar(&cmd.Pattern, "match", "*", "Only analyze the keys that match a glob-style pattern")
+	flags.IntVar(&cmd.Limit, "top", DefaultAnalyzeTop, "Number of keys and prefixes reported in every ranking")
+	flags.StringVar(&cmd.Separator, "separator", DefaultAnalyzeSeparator, "Separator of the key prefixes that are aggregated")
+	flags.Usage = func() {
+		fmt.Println("Usage: memo analyze [options] [snapshot]")
+		fmt.Println("Analyze the keys of a snapshot, by default", SnapshotName)
+		fmt.Println("Available options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if err := db.ValidatePattern(cmd.Pattern); err != nil {
+		return err
+	}
+	if cmd.Limit < 1 || cmd.Separator == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	name := SnapshotName
+	if flags.NArg() > 0 {
+		name = flags.Arg(0)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	d, _, err := db.ReadSnapshot(file)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %s: %w", name, err)
+	}
+
+	cmd.Count = DefaultAnalyzeCount
+	a := newKeyAnalyzer(cmd)
+	a.scanAll(d)
+
+	report, err := json.MarshalIndent(a.result(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(report))
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyze(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+	for i := 0; i < 50; i++ {
+		s.Execute(&Command{Kind: CmdSet, Key: "session:" + strconv.Itoa(i), Value: "v", ExpireAt: time.Now().Add(time.Hour * 2).UnixMilli()})
+	}
+	s.Execute(&Command{Kind: CmdSet, Key: "big", Value: strings.Repeat("x", 10000)})
+	s.Execute(&Command{Kind: CmdRPush, Key: "user:1:events", Values: []string{"a", "b", "c"}})
+	s.Execute(&Command{Kind: CmdSetAdd, Key: "user:2:tags", Values: []string{"a", "b"}})
+	for i := 0; i < 100; i++ {
+		s.Execute(&Command{Kind: CmdGet, Key: "user:1:events"})
+	}
+
+	analyze, _ := ParseCommand("analyze count 7 top 2")
+	var report analyzeReport
+	if err := json.Unmarshal([]byte(s.analyze(analyze).(string)), &report); err != nil {
+		t.Fatal("Expected a JSON report, got", err)
+	}
+
+	if report.Keys != 53 || report.Types["string"].Keys != 51 || report.Types["list"].Elements != 3 {
+		t.Error("Expected keys to be counted by type, got", report.Keys, report.Types)
+	}
+	if biggest := report.Types["string"].Biggest; len(biggest) != 2 || biggest[0].Key != "big" || biggest[0].Elements != 10000 {
+		t.Error("Expected the 2 biggest strings starting with 'big', got", biggest)
+	}
+	if len(report.Hottest) != 2 || report.Hottest[0].Key != "user:1:events" {
+		t.Error("Expected 'user:1:events' to be the hottest key, got", report.Hottest)
+	}
+	if p := report.Prefixes; len(p) != 2 || p[0].Prefix != "" || p[1].Prefix != "session:*" || p[1].Keys != 50 {
+		t.Error("Expected the keys without prefix and 'session:*' to be the biggest prefixes, got", p)
+	}
+	for _, bucket := range report.TTL {
+		if (bucket.Bucket == "1h-1d" && bucket.Keys != 50) || (bucket.Bucket == "none" && bucket.Keys != 3) {
+			t.Error("Expected sessions to expire in 1h-1d, got", bucket)
+		}
+	}
+
+	// Transactions analyze the keyspace at once with the same result
+	analyze, _ = ParseCommand("analyze match user:* separator :1:")
+	var tx analyzeReport
+	if err := json.Unmarshal([]byte(s.Execute(analyze).(string)), &tx); err != nil {
+		t.Fatal("Expected a JSON report, got", err)
+	}
+	if tx.Keys != 2 || len(tx.Types) != 2 || len(tx.Prefixes) != 2 {
+		t.Error("Expected only 'user:*' keys to be analyzed, got", tx.Keys, tx.Types)
+	}
+	for _, p := range tx.Prefixes {
+		if p.Keys != 1 || (p.Prefix != "user:1:*" && p.Prefix != "") {
+			t.Error("Expected 'user:1:*' and keys without prefix, got", p)
+		}
+	}
+}
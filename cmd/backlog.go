@@ -0,0 +1,60 @@
+package main
+
+// Default size of the replication backlog in bytes
+const DefaultBacklogSize = 1 << 20
+
+// Ring buffer with the most recent part of the replication stream. Followers that lost their
+// connection for a short time can continue from the offset they had reached, as long as it
+// has not been overwritten yet.
+type backlog struct {
+	buf    []byte
+	pos    int   // Where the next byte is written
+	length int   // Number of valid bytes in the buffer
+	offset int64 // Replication offset of the end of the buffer
+}
+
+// Create a backlog of the given size in bytes, DefaultBacklogSize is used if it is not positive
+func newBacklog(size int) *backlog {
+	if size <= 0 {
+		size = DefaultBacklogSize
+	}
+	return &backlog{buf: make([]byte, size)}
+}
+
+// Clear the backlog and start counting from the given offset
+func (b *backlog) reset(offset int64) {
+	b.pos = 0
+	b.length = 0
+	b.offset = offset
+}
+
+func (b *backlog) write(data string) {
+	b.offset += int64(len(data))
+
+	// Only the tail of writes larger than the buffer can be kept
+	if len(data) > len(b.buf) {
+		data = data[len(data)-len(b.buf):]
+	}
+
+	n := copy(b.buf[b.pos:], data)
+	copy(b.buf, data[n:])
+
+	b.pos = (b.pos + len(data)) % len(b.buf)
+	b.length = min(b.length+len(data), len(b.buf))
+}
+
+// Get everything written after the given offset, the second value is false if the offset is
+// not in the backlog anymore
+func (b *backlog) readFrom(offset int64) ([]byte, bool) {
+	if offset > b.offset || b.offset-offset > int64(b.length) {
+		return nil, false
+	}
+
+	n := int(b.offset - offset)
+	out := make([]byte, n)
+	start := (b.pos - n + len(b.buf)) % len(b.buf)
+	copied := copy(out, b.buf[start:min(start+n, len(b.buf))])
+	copy(out[copied:], b.buf[:n-copied])
+
+	return out, true
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestBacklog(t *testing.T) {
+	b := newBacklog(8)
+	b.reset(100)
+
+	b.write("abc")
+	if data, ok := b.readFrom(100); !ok || string(data) != "abc" {
+		t.Error("Expected readFrom(100) to return 'abc', got", string(data))
+	}
+	if data, ok := b.readFrom(103); !ok || len(data) != 0 {
+		t.Error("Expected readFrom(103) to return nothing")
+	}
+	if _, ok := b.readFrom(104); ok {
+		t.Error("Expected readFrom(104) to fail")
+	}
+
+	b.write("defgh")
+	b.write("ij")
+	if data, ok := b.readFrom(102); !ok || string(data) != "cdefghij" {
+		t.Error("Expected readFrom(102) to return 'cdefghij', got", string(data))
+	}
+	if _, ok := b.readFrom(101); ok {
+		t.Error("Expected readFrom(101) to fail after being overwritten")
+	}
+
+	b.write("0123456789")
+	if data, ok := b.readFrom(112); !ok || string(data) != "23456789" {
+		t.Error("Expected readFrom(112) to return '23456789', got", string(data))
+	}
+}
+
+func TestBacklogDefaultSize(t *testing.T) {
+	b := newBacklog(0)
+	if len(b.buf) != DefaultBacklogSize {
+		t.Error("Expected a backlog of", DefaultBacklogSize, "bytes, got", len(b.buf))
+	}
+
+	b.write("abc")
+	if data, ok := b.readFrom(0); !ok || string(data) != "abc" {
+		t.Error("Expected readFrom(0) to return 'abc', got", string(data))
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// A connection waiting for data with BLPOP, BRPOP or BQPOP
+type blockedClient struct {
+	cmd *Command
+	ch  chan blockedResult // Receives the popped value, see: serveBlocked()
+}
+
+type blockedResult struct {
+	reply  any
+	offset int64 // WAL offset of the pop
+}
+
+// Commands that wait for data when all of their keys are empty
+func isBlockingCommand(kind CommandType) bool {
+	switch kind {
+	case CmdBLPop, CmdBRPop, CmdBQPop:
+		return true
+	}
+
+	return false
+}
+
+// Whether a command adds data that can be popped by a blocking command of the given kind
+func canServe(push CommandType, pop CommandType) bool {
+	switch push {
+	case CmdLPush, CmdRPush:
+		return pop == CmdBLPop || pop == CmdBRPop
+	case CmdQueueAdd, CmdQueueNack, CmdQueueRestore, CmdQueuePromote:
+		return pop == CmdBQPop
+	}
+
+	return false
+}
+
+// Pop from the first key with data or wait until data is added to one of the keys. The
+// connection waits without holding the database lock and clients waiting for the same key
+// are served in the order they were blocked.
+func (s *Server) blockingPop(ctx *MemoContext, cmd *Command) any {
+	s.dbmu.Lock()
+	if s.repl.isFollower() {
+		s.dbmu.Unlock()
+		return ErrReadOnly
+	}
+
+	s.promoteDue(cmd)
+	key, err := s.readyKey(cmd)
+	if err != nil {
+		s.dbmu.Unlock()
+		return err
+	}
+	if key != "" {
+		res, offset := s.popKey(cmd.Kind, key)
+		s.dbmu.Unlock()
+		return s.waitSync(res, offset)
+	}
+
+	client := s.block(cmd)
+	s.dbmu.Unlock()
+
+	var timeout <-chan time.Time
+	if cmd.Timeout > 0 {
+		timer := time.NewTimer(cmd.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	closed, stopWatching := ctx.watchClose()
+	defer stopWatching()
+
+	select {
+	case res := <-client.ch:
+		return s.waitSync(res.reply, res.offset)
+	case <-timeout:
+	case <-closed:
+	}
+
+	s.dbmu.Lock()
+	s.unblock(client)
+	s.dbmu.Unlock()
+
+	// The client could have been served right before it was unblocked
+	select {
+	case res := <-client.ch:
+		return s.waitSync(res.reply, res.offset)
+	default:
+		return nil
+	}
+}
+
+// Get the first key of a blocking command that has data. The database lock must be held by
+// the caller.
+func (s *Server) readyKey(cmd *Command) (string, error) {
+	for _, key := range cmd.Keys {
+		var length int
+		var err error
+		if cmd.Kind == CmdBQPop {
+			length, _, err = s.db.PQLen(key)
+		} else {
+			length, err = s.db.LLen(key)
+		}
+
+		if err != nil {
+			return "", err
+		}
+		if length > 0 {
+			return key, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Pop from a key on behalf of a blocking command, the pop is written to the WAL and sent to
+// the followers as a non blocking command. The database lock must be held by the caller.
+func (s *Server) popKey(kind CommandType, key string) (any, int64) {
+	pop := &Command{Kind: CmdLPop, Key: key}
+	name := "lpop"
+	switch kind {
+	case CmdBRPop:
+		pop.Kind, name = CmdRPop, "rpop"
+	case CmdBQPop:
+		pop.Kind, name = CmdQueuePop, "qpop"
+	}
+
+	res, offset := s.executeWrite(pop, StringifyArgs([]string{name, key}))
+	if _, failed := res.(error); failed {
+		return res, offset
+	}
+
+	return []any{key, res}, offset
+}
+
+// Pop from the first key with data without blocking, used when blocking commands run in a
+// transaction, a script or are replayed from the WAL. The database lock must be held by the
+// caller.
+func (s *Server) popFirst(cmd *Command) any {
+	for _, key := range cmd.Keys {
+		var value string
+		var found bool
+		var err error
+		switch cmd.Kind {
+		case CmdBLPop:
+			value, found, err = s.db.LPop(key)
+		case CmdBRPop:
+			value, found, err = s.db.RPop(key)
+		case CmdBQPop:
+			value, found, err = s.db.PQPop(key)
+		}
+
+		if err != nil {
+			return err
+		}
+		if found {
+			return []any{key, value}
+		}
+	}
+
+	return nil
+}
+
+// The database lock must be held by the caller
+func (s *Server) block(cmd *Command) *blockedClient {
+	client := &blockedClient{cmd: cmd, ch: make(chan blockedResult, 1)}
+	for _, key := range cmd.Keys {
+		s.blocked[key] = append(s.blocked[key], client)
+	}
+
+	return client
+}
+
+// The database lock must be held by the caller
+func (s *Server) unblock(client *blockedClient) {
+	for _, key := range client.cmd.Keys {
+		clients := s.blocked[key][:0]
+		for _, c := range s.blocked[key] {
+			if c != client {
+				clients = append(clients, c)
+			}
+		}
+
+		if len(clients) == 0 {
+			delete(s.blocked, key)
+		} else {
+			s.blocked[key] = clients
+		}
+	}
+}
+
+// Pop data added to a key by a command for the clients blocked on it, in the order they were
+// blocked. The database lock must be held by the caller.
+func (s *Server) serveBlocked(push *Command) {
+	// Followers only apply the pops sent by the leader
+	if s.repl.isFollower() {
+		return
+	}
+
+	key := push.Key
+	for i := 0; i < len(s.blocked[key]); {
+		client := s.blocked[key][i]
+		if !canServe(push.Kind, client.cmd.Kind) {
+			i++
+			continue
+		}
+
+		if ready, _ := s.readyKey(&Command{Kind: client.cmd.Kind, Keys: []string{key}}); ready == "" {
+			return
+		}
+
+		res, offset := s.popKey(client.cmd.Kind, key)
+		s.unblock(client)
+		if s.batch != nil {
+			s.batch.served = append(s.batch.served, blockedServe{client: client, reply: res})
+		} else {
+			client.ch <- blockedResult{reply: res, offset: offset}
+		}
+	}
+}
+
+// Detect the client closing the connection while no commands are read from it. The returned
+// function must be called before reading from the connection again.
+func (c *MemoContext) watchClose() (<-chan struct{}, func()) {
+	closed := make(chan struct{})
+	if c.conn == nil {
+		return closed, func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Pipelined commands are left in the buffer to be read after the wait
+		if _, err := c.rw.Reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(closed)
+		}
+	}()
+
+	return closed, func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
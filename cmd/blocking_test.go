@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Wait until the given number of clients is blocked on a key
+func waitBlocked(s *Server, key string, count int) {
+	for {
+		s.dbmu.Lock()
+		blocked := len(s.blocked[key])
+		s.dbmu.Unlock()
+		if blocked == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+
+	results := make([]chan any, 3)
+	for i := range results {
+		results[i] = make(chan any, 1)
+		go func(ch chan any) {
+			ch <- s.blockingPop(NewMemoContext(nil), &Command{Kind: CmdBLPop, Keys: []string{"a", "b"}})
+		}(results[i])
+		waitBlocked(s, "b", i+1)
+	}
+
+	s.dbmu.Lock()
+	s.executeWrite(&Command{Kind: CmdRPush, Key: "b", Values: []string{"1", "2"}}, "rpush b 1 2")
+	s.dbmu.Unlock()
+
+	// Clients are served in the order they were blocked
+	for i, expected := range []any{[]any{"b", "1"}, []any{"b", "2"}} {
+		if res := <-results[i]; !reflect.DeepEqual(res, expected) {
+			t.Error("Expected client", i, "to receive", expected, "got", res)
+		}
+	}
+	if len(s.blocked["a"]) != 1 || len(s.blocked["b"]) != 1 {
+		t.Error("Expected only the last client to be blocked")
+	}
+
+	s.dbmu.Lock()
+	s.executeWrite(&Command{Kind: CmdQueueAdd, Key: "a", Values: []string{"x"}, Priority: 1}, "qadd a x")
+	s.dbmu.Unlock()
+	if len(s.blocked["a"]) != 1 {
+		t.Error("Expected BLPOP to not be served by a priority queue")
+	}
+
+	s.dbmu.Lock()
+	s.executeWrite(&Command{Kind: CmdDel, Keys: []string{"a"}}, "del a")
+	s.executeWrite(&Command{Kind: CmdLPush, Key: "a", Values: []string{"3"}}, "lpush a 3")
+	s.dbmu.Unlock()
+	if res := <-results[2]; !reflect.DeepEqual(res, []any{"a", "3"}) {
+		t.Error("Expected last client to receive [a 3], got", res)
+	}
+	if len(s.blocked) != 0 {
+		t.Error("Expected no blocked clients, got", s.blocked)
+	}
+}
+
+func TestBlockingPopTimeout(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+
+	res := s.blockingPop(NewMemoContext(nil), &Command{Kind: CmdBQPop, Keys: []string{"q"}, Timeout: 10 * time.Millisecond})
+	if res != nil {
+		t.Error("Expected BQPOP to time out, got", res)
+	}
+	if len(s.blocked) != 0 {
+		t.Error("Expected client to be unblocked after timing out")
+	}
+
+	s.Execute(&Command{Kind: CmdQueueAdd, Key: "q", Values: []string{"x"}, Priority: 1})
+	res = s.blockingPop(NewMemoContext(nil), &Command{Kind: CmdBQPop, Keys: []string{"q"}})
+	if !reflect.DeepEqual(res, []any{"q", "x"}) {
+		t.Error("Expected BQPOP to return [q x] without blocking, got", res)
+	}
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
+	"net"
+	"skabillium/memo/cmd/db"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
@@ -18,6 +22,30 @@ func ErrInvalidNArg(cmd string) error {
 
 var ErrNotInt = errors.New("ERR value is not an integer or out of range")
 var ErrUnbalancedQuotes = errors.New("ERR unbalanced quotes")
+var ErrSyntax = errors.New("ERR syntax error")
+var ErrNotFloat = errors.New("ERR value is not a valid float")
+var ErrInvalidCursor = errors.New("ERR invalid cursor")
+var ErrZAddNXAndXX = errors.New("ERR XX and NX options at the same time are not compatible")
+var ErrZAddGTLTAndNX = errors.New("ERR GT, LT, and/or NX options at the same time are not compatible")
+var ErrZAddIncrPair = errors.New("ERR INCR option supports a single increment-element pair")
+var ErrZRangeLimit = errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+var ErrZRangeWithScores = errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+var ErrTimeoutNotFloat = errors.New("ERR timeout is not a float or out of range")
+var ErrNegativeTimeout = errors.New("ERR timeout is negative")
+var ErrLeaseTimeout = errors.New("ERR timeout must be positive")
+var ErrNotPositive = errors.New("ERR value is out of range, must be positive")
+var ErrNegativeNumKeys = errors.New("ERR Number of keys can't be negative")
+var ErrTooManyNumKeys = errors.New("ERR Number of keys can't be greater than number of args")
+var ErrExpireNXAndOthers = errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+var ErrExpireGTAndLT = errors.New("ERR GT and LT options at the same time are not compatible")
+
+func ErrInvalidExpire(cmd string) error {
+	return fmt.Errorf("ERR invalid expire time in '%s' command", cmd)
+}
+
+func ErrUnsupportedOption(option string) error {
+	return fmt.Errorf("ERR Unsupported option %s", option)
+}
 
 type CommandType = byte
 
@@ -26,6 +54,7 @@ const (
 	CmdVersion CommandType = iota
 	CmdPing
 	CmdKeys
+	CmdScan
 	CmdAuth
 	CmdHello
 	CmdInfo
@@ -33,7 +62,26 @@ const (
 	CmdFlushAll
 	CmdCleanup
 	CmdExpire
+	CmdPExpireAt
+	CmdPersist
+	CmdTTL
+	CmdPTTL
+	CmdExpireTime
+	CmdPExpireTime
+	CmdMemoryUsage
+	CmdMemoryStats
+	CmdObjectEncoding
+	CmdObjectIdleTime
+	CmdObjectFreq
+	CmdAnalyze
 	CmdQuit
+	CmdSave
+	CmdBgSave
+	CmdRewriteWal
+	CmdReplicaOf
+	CmdSync
+	CmdPSync
+	CmdReplConf
 	// KV
 	CmdSet
 	CmdGet
@@ -43,12 +91,27 @@ const (
 	CmdQueueAdd
 	CmdQueuePop
 	CmdQueueLen
+	CmdBQPop
+	CmdQueueReserve
+	CmdQueueAck
+	CmdQueueNack
+	CmdQueueConfig
+	CmdQueueRestore
+	CmdQueuePromote
+	CmdQueueScheduled
+	CmdQueuePeek
+	CmdQueueRange
+	CmdQueueRem
+	CmdQueueUpdate
+	CmdQueueCreate
 	// Lists
 	CmdLPush
 	CmdLPop
 	CmdRPush
 	CmdRPop
 	CmdLLen
+	CmdBLPop
+	CmdBRPop
 	// Sets
 	CmdSetAdd
 	CmdSetMembers
@@ -56,8 +119,154 @@ const (
 	CmdSetIsMember
 	CmdSetInter
 	CmdSetCard
+	CmdSetScan
+	// Hashes
+	CmdHSet
+	CmdHSetNX
+	CmdHGet
+	CmdHMGet
+	CmdHDel
+	CmdHExists
+	CmdHLen
+	CmdHKeys
+	CmdHVals
+	CmdHGetAll
+	CmdHIncrBy
+	CmdHIncrByFloat
+	CmdHScan
+	// Sorted sets
+	CmdZAdd
+	CmdZScore
+	CmdZRank
+	CmdZRevRank
+	CmdZRange
+	CmdZRem
+	CmdZRemRangeByScore
+	CmdZCard
+	CmdZCount
+	CmdZIncrBy
+	// Pub/Sub
+	CmdSubscribe
+	CmdUnsubscribe
+	CmdPSubscribe
+	CmdPUnsubscribe
+	CmdPublish
+	CmdPubSubChannels
+	CmdPubSubNumSub
+	CmdPubSubNumPat
+	// Transactions
+	CmdMulti
+	CmdExec
+	CmdDiscard
+	CmdWatch
+	CmdUnwatch
+	// Scripting
+	CmdEval
+	CmdEvalSha
+	CmdScriptLoad
+	CmdScriptExists
+	CmdScriptFlush
+	CmdScriptKill
 )
 
+// Commands that modify the database, only these are written to the WAL
+var writeCommands = map[CommandType]bool{
+	CmdFlushAll:         true,
+	CmdExpire:           true,
+	CmdPExpireAt:        true,
+	CmdPersist:          true,
+	CmdSet:              true,
+	CmdDel:              true,
+	CmdQueueAdd:         true,
+	CmdQueuePop:         true,
+	CmdQueueReserve:     true,
+	CmdQueueAck:         true,
+	CmdQueueNack:        true,
+	CmdQueueConfig:      true,
+	CmdQueueRestore:     true,
+	CmdQueuePromote:     true,
+	CmdQueueRem:         true,
+	CmdQueueUpdate:      true,
+	CmdQueueCreate:      true,
+	CmdLPush:            true,
+	CmdLPop:             true,
+	CmdRPush:            true,
+	CmdRPop:             true,
+	CmdBLPop:            true,
+	CmdBRPop:            true,
+	CmdBQPop:            true,
+	CmdSetAdd:           true,
+	CmdSetRem:           true,
+	CmdHSet:             true,
+	CmdHSetNX:           true,
+	CmdHDel:             true,
+	CmdHIncrBy:          true,
+	CmdHIncrByFloat:     true,
+	CmdZAdd:             true,
+	CmdZRem:             true,
+	CmdZRemRangeByScore: true,
+	CmdZIncrBy:          true,
+}
+
+// Commands that only read the database, they run concurrently with each other while writes
+// and commands that have side effects wait for exclusive access. Reading a key that expired
+// does not remove it and queue commands are left out since they promote delayed items.
+var readOnlyCommands = map[CommandType]bool{
+	CmdVersion:        true,
+	CmdPing:           true,
+	CmdKeys:           true,
+	CmdScan:           true,
+	CmdDbSize:         true,
+	CmdTTL:            true,
+	CmdPTTL:           true,
+	CmdExpireTime:     true,
+	CmdPExpireTime:    true,
+	CmdMemoryUsage:    true,
+	CmdObjectEncoding: true,
+	CmdObjectIdleTime: true,
+	CmdObjectFreq:     true,
+	CmdGet:            true,
+	CmdLLen:           true,
+	CmdSetMembers:     true,
+	CmdSetIsMember:    true,
+	CmdSetInter:       true,
+	CmdSetCard:        true,
+	CmdSetScan:        true,
+	CmdHGet:           true,
+	CmdHMGet:          true,
+	CmdHExists:        true,
+	CmdHLen:           true,
+	CmdHKeys:          true,
+	CmdHVals:          true,
+	CmdHGetAll:        true,
+	CmdHScan:          true,
+	CmdZScore:         true,
+	CmdZRank:          true,
+	CmdZRevRank:       true,
+	CmdZRange:         true,
+	CmdZCard:          true,
+	CmdZCount:         true,
+}
+
+// Write commands that can add data, they are rejected when the memory limit is reached and
+// no keys can be evicted
+var denyOOMCommands = map[CommandType]bool{
+	CmdSet:          true,
+	CmdQueueAdd:     true,
+	CmdQueueConfig:  true,
+	CmdQueueRestore: true,
+	CmdQueueCreate:  true,
+	CmdLPush:        true,
+	CmdRPush:        true,
+	CmdSetAdd:       true,
+	CmdHSet:         true,
+	CmdHSetNX:       true,
+	CmdHIncrBy:      true,
+	CmdHIncrByFloat: true,
+	CmdZAdd:         true,
+	CmdZIncrBy:      true,
+}
+
 type AuthOptions struct {
 	User     string
 	Password string
@@ -70,12 +279,50 @@ type Command struct {
 	Value  string
 	Values []string
 
-	Pattern     string      // keys
-	ExpireIn    int         // expire
-	Priority    int         // pqadd
-	Auth        AuthOptions // hello
-	RespVersion string      // hello
-	Limit       int
+	Pattern     string           // keys
+	ExpireIn    int64            // expire, pexpire, set ex and px, milliseconds
+	ExpireAt    int64            // expireat, pexpireat, set exat and pxat, unix time in milliseconds
+	Expire      db.ExpireOptions // expire, pexpire, expireat, pexpireat
+	KeepTTL     bool             // set
+	Priority    float64          // qadd, qupdate, qrestore
+	Auth        AuthOptions      // hello
+	RespVersion string           // hello
+	Section     string           // info
+	Addr        string           // replicaof, empty for "no one"
+	Offset      int64            // replconf ack, psync
+	ReplId      string           // psync
+	Limit       int              // cleanup, analyze top keys
+	Incr        int              // hincrby
+	IncrFloat   float64          // hincrbyfloat
+	Cursor      uint64           // scan, sscan, hscan
+	Count       int              // scan, sscan, hscan, qpop, memory usage samples, analyze
+	ObjType     string           // scan
+	Start       int              // qrange
+	Stop        int              // qrange
+	Members     []db.ZItem       // zadd
+	ZAdd        db.ZAddOptions   // zadd
+	ZRange      db.ZRangeOptions // zrange
+	WithScores  bool             // zrange
+	Min         db.ScoreBound    // zcount, zremrangebyscore
+	Max         db.ScoreBound    // zcount, zremrangebyscore
+	Timeout     time.Duration    // blpop, brpop, bqpop, 0 blocks forever, qreserve, qadd delay
+	NotBefore   int64            // qadd at, qpromote, unix time in milliseconds
+	LeaseId     string           // qreserve, qack, qnack, qrestore
+	Deliveries  int              // qconfig max deliveries, qrestore
+	Order       db.QueueOrder    // qcreate
+	Separator   string           // analyze
+}
+
+func (c *Command) IsWrite() bool {
+	return writeCommands[c.Kind]
+}
+
+func (c *Command) IsReadOnly() bool {
+	return readOnlyCommands[c.Kind]
+}
+
+func (c *Command) DeniedOnOOM() bool {
+	return denyOOMCommands[c.Kind]
 }
 
 // Parse command from string input
@@ -111,14 +358,27 @@ func ParseCommand(message string) (*Command, error) {
 
 		keys := &Command{Kind: CmdKeys, Pattern: "*"}
 		if argc == 2 {
+			if err := db.ValidatePattern(split[1]); err != nil {
+				return nil, err
+			}
 			keys.Pattern = split[1]
 		}
 		return keys, nil
+	case "scan":
+		if argc < 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return parseScan(CmdScan, split[1:])
 	case "info":
-		if argc != 1 {
+		if argc > 2 {
 			return nil, ErrInvalidNArg(cmd)
 		}
-		return &Command{Kind: CmdInfo}, nil
+
+		info := &Command{Kind: CmdInfo}
+		if argc == 2 {
+			info.Section = strings.ToLower(split[1])
+		}
+		return info, nil
 	case "dbsize":
 		if argc != 1 {
 			return nil, ErrInvalidNArg(cmd)
@@ -141,15 +401,80 @@ func ParseCommand(message string) (*Command, error) {
 		}
 
 		return cleanup, nil
-	case "expire":
+	case "save":
+		if argc != 1 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdSave}, nil
+	case "bgsave":
+		if argc != 1 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdBgSave}, nil
+	case "bgrewriteaof":
+		if argc != 1 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdRewriteWal}, nil
+	case "replicaof":
 		if argc != 3 {
 			return nil, ErrInvalidNArg(cmd)
 		}
-		seconds, err := strconv.Atoi(split[2])
+
+		if strings.ToLower(split[1]) == "no" && strings.ToLower(split[2]) == "one" {
+			return &Command{Kind: CmdReplicaOf}, nil
+		}
+		if _, err := strconv.Atoi(split[2]); err != nil {
+			return nil, errors.New("ERR Invalid master port")
+		}
+		return &Command{Kind: CmdReplicaOf, Addr: net.JoinHostPort(split[1], split[2])}, nil
+	case "sync":
+		if argc != 1 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdSync}, nil
+	case "psync":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		offset, err := strconv.ParseInt(split[2], 10, 64)
 		if err != nil {
-			return nil, err
+			return nil, ErrNotInt
 		}
-		return &Command{Kind: CmdExpire, Key: split[1], ExpireIn: seconds}, nil
+		return &Command{Kind: CmdPSync, ReplId: split[1], Offset: offset}, nil
+	case "replconf":
+		if argc != 3 || strings.ToLower(split[1]) != "ack" {
+			return nil, ErrSyntax
+		}
+		offset, err := strconv.ParseInt(split[2], 10, 64)
+		if err != nil {
+			return nil, ErrNotInt
+		}
+		return &Command{Kind: CmdReplConf, Offset: offset}, nil
+	case "expire", "pexpire", "expireat", "pexpireat":
+		if argc < 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return parseExpire(cmd, split)
+	case "persist":
+		if argc != 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdPersist, Key: split[1]}, nil
+	case "ttl", "pttl", "expiretime", "pexpiretime":
+		if argc != 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		kind := CmdTTL
+		switch cmd {
+		case "pttl":
+			kind = CmdPTTL
+		case "expiretime":
+			kind = CmdExpireTime
+		case "pexpiretime":
+			kind = CmdPExpireTime
+		}
+		return &Command{Kind: kind, Key: split[1]}, nil
 	case "auth":
 		if argc != 3 {
 			return nil, ErrInvalidNArg(cmd)
@@ -173,19 +498,7 @@ func ParseCommand(message string) (*Command, error) {
 		if argc < 3 {
 			return nil, ErrInvalidNArg(cmd)
 		}
-		set := &Command{Kind: CmdSet, Key: split[1], Value: split[2]}
-		if argc > 3 && strings.ToLower(split[3]) == "ex" {
-			// Parse expiration option
-			if argc != 5 {
-				return nil, errors.New("invalid number of arguments for expiration option")
-			}
-			seconds, err := strconv.Atoi(split[4])
-			if err != nil {
-				return nil, ErrNotInt
-			}
-			set.ExpireIn = seconds
-		}
-		return set, nil
+		return parseSet(split)
 	case "get":
 		if argc != 2 {
 			return nil, ErrInvalidNArg(cmd)
@@ -203,29 +516,213 @@ func ParseCommand(message string) (*Command, error) {
 		qadd := &Command{Kind: CmdQueueAdd, Key: split[1], Priority: 1}
 
 		for i := 2; i < argc; i++ {
-			if i+1 < argc && strings.ToLower(split[i]) == "pr" {
-				priority, err := strconv.Atoi(split[i+1])
-				if err != nil {
-					return nil, ErrNotInt
-				}
+			if i+1 < argc {
+				switch strings.ToLower(split[i]) {
+				case "pr":
+					priority, err := db.ParseScore(split[i+1])
+					if err != nil {
+						return nil, ErrNotFloat
+					}
+
+					qadd.Priority = priority
+					i++
+					continue
+				case "delay":
+					delay, err := parseTimeout(split[i+1])
+					if err != nil {
+						return nil, err
+					}
 
-				qadd.Priority = priority
-				i++
-				continue
+					qadd.Timeout = delay
+					i++
+					continue
+				case "at":
+					at, err := strconv.ParseInt(split[i+1], 10, 64)
+					if err != nil || at <= 0 {
+						return nil, ErrNotInt
+					}
+
+					qadd.NotBefore = at
+					i++
+					continue
+				}
 			}
 			qadd.Values = append(qadd.Values, split[i])
 		}
+		if len(qadd.Values) == 0 {
+			return nil, ErrInvalidNArg(cmd)
+		}
 		return qadd, nil
 	case "qpop":
+		if argc != 2 && argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+
+		qpop := &Command{Kind: CmdQueuePop, Key: split[1]}
+		if argc == 3 {
+			count, err := strconv.Atoi(split[2])
+			if err != nil {
+				return nil, ErrNotInt
+			}
+			if count < 1 {
+				return nil, ErrNotPositive
+			}
+			qpop.Count = count
+		}
+		return qpop, nil
+	case "qcreate":
+		if argc != 2 && argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+
+		qcreate := &Command{Kind: CmdQueueCreate, Key: split[1], Order: db.OrderMin}
+		if argc == 3 {
+			switch strings.ToLower(split[2]) {
+			case "min":
+			case "max":
+				qcreate.Order = db.OrderMax
+			default:
+				return nil, ErrSyntax
+			}
+		}
+		return qcreate, nil
+	case "qpeek":
 		if argc != 2 {
 			return nil, ErrInvalidNArg(cmd)
 		}
-		return &Command{Kind: CmdQueuePop, Key: split[1]}, nil
+		return &Command{Kind: CmdQueuePeek, Key: split[1]}, nil
+	case "qrange":
+		if argc != 4 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		start, err := strconv.Atoi(split[2])
+		if err != nil {
+			return nil, ErrNotInt
+		}
+		stop, err := strconv.Atoi(split[3])
+		if err != nil {
+			return nil, ErrNotInt
+		}
+		return &Command{Kind: CmdQueueRange, Key: split[1], Start: start, Stop: stop}, nil
+	case "qrem":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdQueueRem, Key: split[1], Value: split[2]}, nil
+	case "qupdate":
+		if argc != 4 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		priority, err := db.ParseScore(split[3])
+		if err != nil {
+			return nil, ErrNotFloat
+		}
+		return &Command{Kind: CmdQueueUpdate, Key: split[1], Value: split[2], Priority: priority}, nil
 	case "qlen":
 		if argc != 2 {
 			return nil, ErrInvalidNArg(cmd)
 		}
 		return &Command{Kind: CmdQueueLen, Key: split[1]}, nil
+	case "blpop", "brpop", "bqpop":
+		if argc < 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		timeout, err := parseTimeout(split[argc-1])
+		if err != nil {
+			return nil, err
+		}
+
+		kinds := map[string]CommandType{"blpop": CmdBLPop, "brpop": CmdBRPop, "bqpop": CmdBQPop}
+		return &Command{Kind: kinds[cmd], Keys: split[1 : argc-1], Timeout: timeout}, nil
+	case "qreserve":
+		// Form written to the WAL, see: withAbsoluteExpiry()
+		if argc == 6 && strings.ToLower(split[2]) == "pxat" && strings.ToLower(split[4]) == "id" {
+			at, err := strconv.ParseInt(split[3], 10, 64)
+			if err != nil {
+				return nil, ErrNotInt
+			}
+			return &Command{Kind: CmdQueueReserve, Key: split[1], ExpireAt: at, LeaseId: split[5]}, nil
+		}
+
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		timeout, err := parseTimeout(split[2])
+		if err != nil {
+			return nil, err
+		}
+		if timeout == 0 {
+			return nil, ErrLeaseTimeout
+		}
+		return &Command{Kind: CmdQueueReserve, Key: split[1], Timeout: timeout}, nil
+	case "qack", "qnack":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+
+		kind := CmdQueueAck
+		if cmd == "qnack" {
+			kind = CmdQueueNack
+		}
+		return &Command{Kind: kind, Key: split[1], LeaseId: split[2]}, nil
+	case "qconfig":
+		if (argc != 4 && argc != 6) || strings.ToLower(split[2]) != "maxdeliveries" {
+			return nil, ErrSyntax
+		}
+		maxDeliveries, err := strconv.Atoi(split[3])
+		if err != nil || maxDeliveries < 0 {
+			return nil, ErrNotInt
+		}
+
+		// Dead letter queues are named after their queue by default
+		qconfig := &Command{Kind: CmdQueueConfig, Key: split[1], Deliveries: maxDeliveries, Value: split[1] + ":dead"}
+		if argc == 6 {
+			if strings.ToLower(split[4]) != "deadletter" {
+				return nil, ErrSyntax
+			}
+			qconfig.Value = split[5]
+		}
+		return qconfig, nil
+	case "qrestore":
+		if argc != 5 && argc != 9 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		priority, err := db.ParseScore(split[2])
+		if err != nil {
+			return nil, ErrNotFloat
+		}
+		deliveries, err := strconv.Atoi(split[3])
+		if err != nil {
+			return nil, ErrNotInt
+		}
+
+		qrestore := &Command{Kind: CmdQueueRestore, Key: split[1], Priority: priority, Deliveries: deliveries, Value: split[4]}
+		if argc == 9 {
+			if strings.ToLower(split[5]) != "lease" || strings.ToLower(split[7]) != "pxat" {
+				return nil, ErrSyntax
+			}
+			at, err := strconv.ParseInt(split[8], 10, 64)
+			if err != nil {
+				return nil, ErrNotInt
+			}
+			qrestore.LeaseId, qrestore.ExpireAt = split[6], at
+		}
+		return qrestore, nil
+	case "qpromote":
+		// Written to the WAL when delayed items become visible, see: promoteDue()
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		at, err := strconv.ParseInt(split[2], 10, 64)
+		if err != nil {
+			return nil, ErrNotInt
+		}
+		return &Command{Kind: CmdQueuePromote, Key: split[1], NotBefore: at}, nil
+	case "qscheduled":
+		if argc != 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdQueueScheduled, Key: split[1]}, nil
 	case "lpush":
 		if argc < 3 {
 			return nil, ErrInvalidNArg(cmd)
@@ -280,21 +777,692 @@ func ParseCommand(message string) (*Command, error) {
 			return nil, ErrInvalidNArg(cmd)
 		}
 		return &Command{Kind: CmdSetCard, Key: split[1]}, nil
+	case "sscan":
+		if argc < 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return parseScan(CmdSetScan, split[1:])
 	case "sinter":
 		if argc != 3 {
 			return nil, ErrInvalidNArg(cmd)
 		}
 		return &Command{Kind: CmdSetInter, Keys: []string{split[1], split[2]}}, nil
+	case "hset":
+		if argc < 4 || argc%2 != 0 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHSet, Key: split[1], Values: split[2:]}, nil
+	case "hsetnx":
+		if argc != 4 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHSetNX, Key: split[1], Values: split[2:]}, nil
+	case "hget":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHGet, Key: split[1], Value: split[2]}, nil
+	case "hmget":
+		if argc < 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHMGet, Key: split[1], Values: split[2:]}, nil
+	case "hdel":
+		if argc < 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHDel, Key: split[1], Values: split[2:]}, nil
+	case "hexists":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHExists, Key: split[1], Value: split[2]}, nil
+	case "hlen":
+		if argc != 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHLen, Key: split[1]}, nil
+	case "hkeys":
+		if argc != 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHKeys, Key: split[1]}, nil
+	case "hvals":
+		if argc != 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHVals, Key: split[1]}, nil
+	case "hgetall":
+		if argc != 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdHGetAll, Key: split[1]}, nil
+	case "hincrby":
+		if argc != 4 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		incr, err := strconv.Atoi(split[3])
+		if err != nil {
+			return nil, ErrNotInt
+		}
+		return &Command{Kind: CmdHIncrBy, Key: split[1], Value: split[2], Incr: incr}, nil
+	case "hincrbyfloat":
+		if argc != 4 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		incr, err := strconv.ParseFloat(split[3], 64)
+		if err != nil {
+			return nil, ErrNotFloat
+		}
+		return &Command{Kind: CmdHIncrByFloat, Key: split[1], Value: split[2], IncrFloat: incr}, nil
+	case "hscan":
+		if argc < 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return parseScan(CmdHScan, split[1:])
+	case "zadd":
+		if argc < 4 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return parseZAdd(split)
+	case "zscore":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdZScore, Key: split[1], Value: split[2]}, nil
+	case "zrank":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdZRank, Key: split[1], Value: split[2]}, nil
+	case "zrevrank":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdZRevRank, Key: split[1], Value: split[2]}, nil
+	case "zrange":
+		if argc < 4 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return parseZRange(split)
+	case "zrem":
+		if argc < 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdZRem, Key: split[1], Values: split[2:]}, nil
+	case "zremrangebyscore", "zcount":
+		if argc != 4 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		min, err := db.ParseScoreBound(split[2])
+		if err != nil {
+			return nil, err
+		}
+		max, err := db.ParseScoreBound(split[3])
+		if err != nil {
+			return nil, err
+		}
+
+		kind := CmdZCount
+		if cmd == "zremrangebyscore" {
+			kind = CmdZRemRangeByScore
+		}
+		return &Command{Kind: kind, Key: split[1], Min: min, Max: max}, nil
+	case "zcard":
+		if argc != 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdZCard, Key: split[1]}, nil
+	case "zincrby":
+		if argc != 4 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		incr, err := db.ParseScore(split[2])
+		if err != nil {
+			return nil, ErrNotFloat
+		}
+		return &Command{Kind: CmdZIncrBy, Key: split[1], Value: split[3], IncrFloat: incr}, nil
+	case "subscribe":
+		if argc < 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdSubscribe, Keys: split[1:]}, nil
+	case "psubscribe":
+		if argc < 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		for _, pattern := range split[1:] {
+			if err := db.ValidatePattern(pattern); err != nil {
+				return nil, err
+			}
+		}
+		return &Command{Kind: CmdPSubscribe, Keys: split[1:]}, nil
+	case "unsubscribe":
+		return &Command{Kind: CmdUnsubscribe, Keys: split[1:]}, nil
+	case "punsubscribe":
+		return &Command{Kind: CmdPUnsubscribe, Keys: split[1:]}, nil
+	case "publish":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdPublish, Key: split[1], Value: split[2]}, nil
+	case "pubsub":
+		if argc < 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+
+		switch strings.ToLower(split[1]) {
+		case "channels":
+			if argc > 3 {
+				return nil, ErrInvalidNArg(cmd)
+			}
+			channels := &Command{Kind: CmdPubSubChannels}
+			if argc == 3 {
+				if err := db.ValidatePattern(split[2]); err != nil {
+					return nil, err
+				}
+				channels.Pattern = split[2]
+			}
+			return channels, nil
+		case "numsub":
+			return &Command{Kind: CmdPubSubNumSub, Keys: split[2:]}, nil
+		case "numpat":
+			if argc != 2 {
+				return nil, ErrInvalidNArg(cmd)
+			}
+			return &Command{Kind: CmdPubSubNumPat}, nil
+		}
+		return nil, ErrSyntax
+	case "multi":
+		if argc != 1 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdMulti}, nil
+	case "exec":
+		if argc != 1 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdExec}, nil
+	case "discard":
+		if argc != 1 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdDiscard}, nil
+	case "watch":
+		if argc < 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdWatch, Keys: split[1:]}, nil
+	case "unwatch":
+		if argc != 1 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		return &Command{Kind: CmdUnwatch}, nil
+	case "eval", "evalsha":
+		if argc < 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+		numKeys, err := strconv.Atoi(split[2])
+		if err != nil {
+			return nil, ErrNotInt
+		}
+		if numKeys < 0 {
+			return nil, ErrNegativeNumKeys
+		}
+		if numKeys > argc-3 {
+			return nil, ErrTooManyNumKeys
+		}
+
+		eval := &Command{Kind: CmdEval, Value: split[1], Keys: split[3 : 3+numKeys], Values: split[3+numKeys:]}
+		if cmd == "evalsha" {
+			eval.Kind = CmdEvalSha
+			eval.Value = strings.ToLower(split[1])
+		}
+		return eval, nil
+	case "memory":
+		if argc < 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+
+		switch strings.ToLower(split[1]) {
+		case "usage":
+			if argc != 3 && argc != 5 {
+				return nil, ErrInvalidNArg(cmd)
+			}
+			usage := &Command{Kind: CmdMemoryUsage, Key: split[2], Count: db.DefaultMemorySamples}
+			if argc == 5 {
+				if strings.ToLower(split[3]) != "samples" {
+					return nil, ErrSyntax
+				}
+				samples, err := strconv.Atoi(split[4])
+				if err != nil || samples < 0 {
+					return nil, ErrNotInt
+				}
+				usage.Count = samples
+			}
+			return usage, nil
+		case "stats":
+			if argc != 2 {
+				return nil, ErrInvalidNArg(cmd)
+			}
+			return &Command{Kind: CmdMemoryStats}, nil
+		}
+		return nil, ErrSyntax
+	case "object":
+		if argc != 3 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+
+		switch strings.ToLower(split[1]) {
+		case "encoding":
+			return &Command{Kind: CmdObjectEncoding, Key: split[2]}, nil
+		case "idletime":
+			return &Command{Kind: CmdObjectIdleTime, Key: split[2]}, nil
+		case "freq":
+			return &Command{Kind: CmdObjectFreq, Key: split[2]}, nil
+		}
+		return nil, ErrSyntax
+	case "analyze":
+		return parseAnalyze(split[1:])
+	case "script":
+		if argc < 2 {
+			return nil, ErrInvalidNArg(cmd)
+		}
+
+		switch strings.ToLower(split[1]) {
+		case "load":
+			if argc != 3 {
+				return nil, ErrInvalidNArg(cmd)
+			}
+			return &Command{Kind: CmdScriptLoad, Value: split[2]}, nil
+		case "exists":
+			if argc < 3 {
+				return nil, ErrInvalidNArg(cmd)
+			}
+			shas := make([]string, argc-2)
+			for i, sha := range split[2:] {
+				shas[i] = strings.ToLower(sha)
+			}
+			return &Command{Kind: CmdScriptExists, Keys: shas}, nil
+		case "flush":
+			// The cache is always flushed synchronously, ASYNC is accepted for compatibility
+			if argc == 3 {
+				mode := strings.ToLower(split[2])
+				if mode != "async" && mode != "sync" {
+					return nil, ErrSyntax
+				}
+			} else if argc != 2 {
+				return nil, ErrInvalidNArg(cmd)
+			}
+			return &Command{Kind: CmdScriptFlush}, nil
+		case "kill":
+			if argc != 2 {
+				return nil, ErrInvalidNArg(cmd)
+			}
+			return &Command{Kind: CmdScriptKill}, nil
+		}
+		return nil, ErrSyntax
 	}
 
 	return nil, ErrUnknownCmd(cmd)
 }
 
+// Parse a timeout in seconds, fractions of a second are allowed
+func parseTimeout(arg string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || seconds > math.MaxInt64/float64(time.Second) {
+		return 0, ErrTimeoutNotFloat
+	}
+	if seconds < 0 {
+		return 0, ErrNegativeTimeout
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Parse ZADD key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...]
+func parseZAdd(split []string) (*Command, error) {
+	zadd := &Command{Kind: CmdZAdd, Key: split[1]}
+
+	// The first argument that is not an option is the first score
+	i := 2
+	for i < len(split) && parseZAddOption(&zadd.ZAdd, split[i]) {
+		i++
+	}
+
+	pairs := split[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, ErrSyntax
+	}
+	if zadd.ZAdd.NX && zadd.ZAdd.XX {
+		return nil, ErrZAddNXAndXX
+	}
+	if (zadd.ZAdd.GT && zadd.ZAdd.LT) || ((zadd.ZAdd.GT || zadd.ZAdd.LT) && zadd.ZAdd.NX) {
+		return nil, ErrZAddGTLTAndNX
+	}
+	if zadd.ZAdd.Incr && len(pairs) != 2 {
+		return nil, ErrZAddIncrPair
+	}
+
+	for j := 0; j < len(pairs); j += 2 {
+		score, err := db.ParseScore(pairs[j])
+		if err != nil {
+			return nil, ErrNotFloat
+		}
+		zadd.Members = append(zadd.Members, db.ZItem{Member: pairs[j+1], Score: score})
+	}
+
+	return zadd, nil
+}
+
+func parseZAddOption(opts *db.ZAddOptions, arg string) bool {
+	switch strings.ToLower(arg) {
+	case "nx":
+		opts.NX = true
+	case "xx":
+		opts.XX = true
+	case "gt":
+		opts.GT = true
+	case "lt":
+		opts.LT = true
+	case "ch":
+		opts.CH = true
+	case "incr":
+		opts.Incr = true
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Number of elements visited by a call of SCAN and SSCAN when COUNT is not given
+const DefaultScanCount = 10
+
+func scanCount(cmd *Command) int {
+	if cmd.Count == 0 {
+		return DefaultScanCount
+	}
+	return cmd.Count
+}
+
+// Parse SCAN and the commands that scan a single key, which is given before the cursor. Only
+// SCAN supports the TYPE option.
+func parseScan(kind CommandType, args []string) (*Command, error) {
+	scan := &Command{Kind: kind, Pattern: "*"}
+	if kind != CmdScan {
+		scan.Key, args = args[0], args[1:]
+	}
+
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	scan.Cursor = cursor
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, ErrSyntax
+		}
+
+		switch strings.ToLower(args[i]) {
+		case "match":
+			if err := db.ValidatePattern(args[i+1]); err != nil {
+				return nil, err
+			}
+			scan.Pattern = args[i+1]
+		case "count":
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return nil, ErrNotInt
+			}
+			if count < 1 {
+				return nil, ErrSyntax
+			}
+			scan.Count = count
+		case "type":
+			if kind != CmdScan {
+				return nil, ErrSyntax
+			}
+			scan.ObjType = strings.ToLower(args[i+1])
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	return scan, nil
+}
+
+// Parse the options of ANALYZE, COUNT is the number of keys analyzed at a time and TOP the
+// number of keys and prefixes reported
+func parseAnalyze(args []string) (*Command, error) {
+	analyze := &Command{Kind: CmdAnalyze, Pattern: "*", Count: DefaultAnalyzeCount, Limit: DefaultAnalyzeTop, Separator: DefaultAnalyzeSeparator}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, ErrSyntax
+		}
+
+		switch strings.ToLower(args[i]) {
+		case "match":
+			if err := db.ValidatePattern(args[i+1]); err != nil {
+				return nil, err
+			}
+			analyze.Pattern = args[i+1]
+		case "count", "top":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return nil, ErrNotInt
+			}
+			if n < 1 {
+				return nil, ErrNotPositive
+			}
+			if strings.ToLower(args[i]) == "count" {
+				analyze.Count = n
+			} else {
+				analyze.Limit = n
+			}
+		case "separator":
+			if args[i+1] == "" {
+				return nil, ErrSyntax
+			}
+			analyze.Separator = args[i+1]
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	return analyze, nil
+}
+
+// Parse EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT, the time is converted to milliseconds.
+// EXPIRE and PEXPIRE are relative to now and EXPIREAT and PEXPIREAT are unix times.
+func parseExpire(cmd string, split []string) (*Command, error) {
+	expire := &Command{Kind: CmdExpire, Key: split[1]}
+	if cmd == "expireat" || cmd == "pexpireat" {
+		expire.Kind = CmdPExpireAt
+	}
+
+	n, err := strconv.ParseInt(split[2], 10, 64)
+	if err != nil {
+		return nil, ErrNotInt
+	}
+	ms, ok := expireMillis(n, cmd == "expire" || cmd == "expireat", expire.Kind == CmdExpire)
+	if !ok {
+		return nil, ErrInvalidExpire(cmd)
+	}
+	if expire.Kind == CmdExpire {
+		expire.ExpireIn = ms
+	} else {
+		expire.ExpireAt = ms
+	}
+
+	for _, arg := range split[3:] {
+		switch strings.ToLower(arg) {
+		case "nx":
+			expire.Expire.NX = true
+		case "xx":
+			expire.Expire.XX = true
+		case "gt":
+			expire.Expire.GT = true
+		case "lt":
+			expire.Expire.LT = true
+		default:
+			return nil, ErrUnsupportedOption(arg)
+		}
+	}
+	if expire.Expire.NX && (expire.Expire.XX || expire.Expire.GT || expire.Expire.LT) {
+		return nil, ErrExpireNXAndOthers
+	}
+	if expire.Expire.GT && expire.Expire.LT {
+		return nil, ErrExpireGTAndLT
+	}
+
+	return expire, nil
+}
+
+// Convert an expiration to milliseconds, fails if it does not fit in an int64. Relative
+// expirations must also not overflow when added to the current time.
+func expireMillis(n int64, seconds bool, relative bool) (int64, bool) {
+	if seconds {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return 0, false
+		}
+		n *= 1000
+	}
+	if relative && n > math.MaxInt64-time.Now().UnixMilli() {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// Parse SET key value [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | KEEPTTL]
+func parseSet(split []string) (*Command, error) {
+	set := &Command{Kind: CmdSet, Key: split[1], Value: split[2]}
+	for i := 3; i < len(split); i++ {
+		opt := strings.ToLower(split[i])
+		if set.ExpireIn != 0 || set.ExpireAt != 0 || set.KeepTTL {
+			// Only one of the expiration options can be given
+			return nil, ErrSyntax
+		}
+
+		switch opt {
+		case "keepttl":
+			set.KeepTTL = true
+		case "ex", "px", "exat", "pxat":
+			if i+1 >= len(split) {
+				return nil, ErrSyntax
+			}
+			i++
+
+			n, err := strconv.ParseInt(split[i], 10, 64)
+			if err != nil {
+				return nil, ErrNotInt
+			}
+			relative := opt == "ex" || opt == "px"
+			ms, ok := expireMillis(n, opt == "ex" || opt == "exat", relative)
+			if !ok || n <= 0 {
+				return nil, ErrInvalidExpire("set")
+			}
+
+			if relative {
+				set.ExpireIn = ms
+			} else {
+				set.ExpireAt = ms
+			}
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	return set, nil
+}
+
+// Parse ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func parseZRange(split []string) (*Command, error) {
+	zrange := &Command{Kind: CmdZRange, Key: split[1], ZRange: db.ZRangeOptions{Count: -1}}
+
+	hasLimit := false
+	for i := 4; i < len(split); i++ {
+		switch strings.ToLower(split[i]) {
+		case "byscore":
+			zrange.ZRange.By = db.ZByScore
+		case "bylex":
+			zrange.ZRange.By = db.ZByLex
+		case "rev":
+			zrange.ZRange.Rev = true
+		case "withscores":
+			zrange.WithScores = true
+		case "limit":
+			if i+2 >= len(split) {
+				return nil, ErrSyntax
+			}
+			offset, err := strconv.Atoi(split[i+1])
+			if err != nil {
+				return nil, ErrNotInt
+			}
+			count, err := strconv.Atoi(split[i+2])
+			if err != nil {
+				return nil, ErrNotInt
+			}
+
+			zrange.ZRange.Offset = offset
+			zrange.ZRange.Count = count
+			hasLimit = true
+			i += 2
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	if hasLimit && zrange.ZRange.By == db.ZByRank {
+		return nil, ErrZRangeLimit
+	}
+	if zrange.WithScores && zrange.ZRange.By == db.ZByLex {
+		return nil, ErrZRangeWithScores
+	}
+
+	// Score and lexicographical ranges are given from max to min when reversed
+	start, stop := split[2], split[3]
+	if zrange.ZRange.Rev && zrange.ZRange.By != db.ZByRank {
+		start, stop = stop, start
+	}
+
+	var err error
+	switch zrange.ZRange.By {
+	case db.ZByRank:
+		if zrange.ZRange.Start, err = strconv.Atoi(start); err != nil {
+			return nil, ErrNotInt
+		}
+		if zrange.ZRange.Stop, err = strconv.Atoi(stop); err != nil {
+			return nil, ErrNotInt
+		}
+	case db.ZByScore:
+		if zrange.ZRange.Min, err = db.ParseScoreBound(start); err != nil {
+			return nil, err
+		}
+		if zrange.ZRange.Max, err = db.ParseScoreBound(stop); err != nil {
+			return nil, err
+		}
+	case db.ZByLex:
+		if zrange.ZRange.LexMin, err = db.ParseLexBound(start); err != nil {
+			return nil, err
+		}
+		if zrange.ZRange.LexMax, err = db.ParseLexBound(stop); err != nil {
+			return nil, err
+		}
+	}
+
+	return zrange, nil
+}
+
 func isWhitespace(b byte) bool {
 	return unicode.IsSpace(rune(b))
 }
 
-// Split input string to distinct tokens, for example "this is a single token"
+// Split input string to distinct tokens, for example "this is a single token". Inside double
+// quotes \" and \\ can be used for literal quotes and backslashes, see: quoteToken()
 func splitTokens(message string) ([]string, error) {
 	out := []string{}
 	i := 0
@@ -308,36 +1476,44 @@ func splitTokens(message string) ([]string, error) {
 
 		if c == '"' || c == '\'' {
 			term := c
-			i++
-			start := i
-			c := message[i]
-			for i < len(message) && c != term {
-				c = message[i]
-				i++
+			var token strings.Builder
+			for i++; i < len(message) && message[i] != term; i++ {
+				if term == '"' && message[i] == '\\' && i+1 < len(message) && (message[i+1] == '"' || message[i+1] == '\\') {
+					i++
+				}
+				token.WriteByte(message[i])
 			}
 
-			if c != term {
+			if i == len(message) {
 				return nil, ErrUnbalancedQuotes
 			}
 
-			out = append(out, message[start:i-1])
+			out = append(out, token.String())
 			i++
 			continue
 		}
 
-		// TODO: Refactor this
 		start := i
-		for i < len(message) && !isWhitespace(c) {
-			c = message[i]
+		for i < len(message) && !isWhitespace(message[i]) {
 			i++
 		}
+		out = append(out, message[start:i])
+	}
 
-		if i == len(message) && !isWhitespace(c) {
-			i++
-		}
+	return out, nil
+}
 
-		out = append(out, message[start:i-1])
+// Quote a token if needed so that splitTokens() returns it unchanged
+func quoteToken(token string) string {
+	needsQuotes := token == ""
+	for i := 0; i < len(token) && !needsQuotes; i++ {
+		needsQuotes = isWhitespace(token[i]) || token[i] == '"' || token[i] == '\''
+	}
+	if !needsQuotes {
+		return token
 	}
 
-	return out, nil
+	token = strings.ReplaceAll(token, "\\", "\\\\")
+	token = strings.ReplaceAll(token, "\"", "\\\"")
+	return "\"" + token + "\""
 }
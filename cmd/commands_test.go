@@ -1,8 +1,11 @@
 package main
 
 import (
+	"math"
 	"reflect"
+	"skabillium/memo/cmd/db"
 	"testing"
+	"time"
 )
 
 func TestSplitTokens(t *testing.T) {
@@ -24,10 +27,19 @@ func TestSplitTokens(t *testing.T) {
 		t.Error("Expected other result for string input")
 	}
 
+	if res, err := splitTokens(`set msg "say \"hi\" \\o/" ''`); err != nil || !reflect.DeepEqual(res, []string{
+		"set", "msg", `say "hi" \o/`, "",
+	}) {
+		t.Error("Expected other result for escaped string input, got", res)
+	}
+
 	_, err := splitTokens("set \"error")
 	if err == nil {
 		t.Error("Expected unterminated string error")
 	}
+	if _, err := splitTokens("set name \""); err == nil {
+		t.Error("Expected unterminated string error")
+	}
 }
 
 func TestParse(t *testing.T) {
@@ -39,6 +51,138 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParseExpireCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "expire name 10"
+	cmd = &Command{Kind: CmdExpire, Key: "name", ExpireIn: 10000}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "pexpire name 1500 xx gt"
+	cmd = &Command{Kind: CmdExpire, Key: "name", ExpireIn: 1500, Expire: db.ExpireOptions{XX: true, GT: true}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "expireat name 1700000000 nx"
+	cmd = &Command{Kind: CmdPExpireAt, Key: "name", ExpireAt: 1700000000000, Expire: db.ExpireOptions{NX: true}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "pexpireat name 1700000000000"
+	cmd = &Command{Kind: CmdPExpireAt, Key: "name", ExpireAt: 1700000000000}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "set name bill ex 10"
+	cmd = &Command{Kind: CmdSet, Key: "name", Value: "bill", ExpireIn: 10000}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "set name bill pxat 1700000000000"
+	cmd = &Command{Kind: CmdSet, Key: "name", Value: "bill", ExpireAt: 1700000000000}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "set name bill exat 1700000000"
+	cmd = &Command{Kind: CmdSet, Key: "name", Value: "bill", ExpireAt: 1700000000000}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "set name bill keepttl"
+	cmd = &Command{Kind: CmdSet, Key: "name", Value: "bill", KeepTTL: true}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "pttl name"
+	cmd = &Command{Kind: CmdPTTL, Key: "name"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("set name bill foo 10"); err == nil {
+		t.Error("Expected 'set name bill foo 10' to return parsing error")
+	}
+	if _, err := ParseCommand("set name bill ex 10 keepttl"); err != ErrSyntax {
+		t.Error("Expected 'set name bill ex 10 keepttl' to return syntax error, got", err)
+	}
+	if _, err := ParseCommand("set name bill px 0"); err == nil {
+		t.Error("Expected 'set name bill px 0' to return parsing error")
+	}
+	if _, err := ParseCommand("expire name 10 nx gt"); err != ErrExpireNXAndOthers {
+		t.Error("Expected 'expire name 10 nx gt' to return", ErrExpireNXAndOthers, "got", err)
+	}
+	if _, err := ParseCommand("expire name 10 gt lt"); err != ErrExpireGTAndLT {
+		t.Error("Expected 'expire name 10 gt lt' to return", ErrExpireGTAndLT, "got", err)
+	}
+	if _, err := ParseCommand("expireat name 9223372036854775807"); err == nil {
+		t.Error("Expected overflowing expireat to return parsing error")
+	}
+}
+
+func TestParseMemoryCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "memory usage name"
+	cmd = &Command{Kind: CmdMemoryUsage, Key: "name", Count: db.DefaultMemorySamples}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "memory usage name samples 0"
+	cmd = &Command{Kind: CmdMemoryUsage, Key: "name", Count: 0}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "object idletime name"
+	cmd = &Command{Kind: CmdObjectIdleTime, Key: "name"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("memory usage name count 1"); err != ErrSyntax {
+		t.Error("Expected 'memory usage name count 1' to return syntax error, got", err)
+	}
+	if _, err := ParseCommand("object refcount name"); err != ErrSyntax {
+		t.Error("Expected 'object refcount name' to return syntax error, got", err)
+	}
+}
+
+func TestParseAnalyze(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "analyze"
+	cmd = &Command{Kind: CmdAnalyze, Pattern: "*", Count: DefaultAnalyzeCount, Limit: DefaultAnalyzeTop, Separator: ":"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "analyze match session* count 1000 top 3 separator /"
+	cmd = &Command{Kind: CmdAnalyze, Pattern: "session*", Count: 1000, Limit: 3, Separator: "/"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("analyze top 0"); err != ErrNotPositive {
+		t.Error("Expected 'analyze top 0' to return", ErrNotPositive, "got", err)
+	}
+	if _, err := ParseCommand("analyze count"); err != ErrSyntax {
+		t.Error("Expected 'analyze count' to return syntax error, got", err)
+	}
+}
+
 func TestParseServerCommands(t *testing.T) {
 	var str string
 	var cmd, res *Command
@@ -67,12 +211,36 @@ func TestParseServerCommands(t *testing.T) {
 		t.Error("Expected result to be:", cmd, "got", res)
 	}
 
+	for _, str := range []string{"keys user:[", "scan 0 match [a", "psubscribe news.* [", "pubsub channels [^"} {
+		if _, err := ParseCommand(str); err != db.ErrBadPattern {
+			t.Error("Expected", str, "to return", db.ErrBadPattern, "got", err)
+		}
+	}
+
 	str = "info"
 	cmd = &Command{Kind: CmdInfo}
 	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
 		t.Error("Expected result to be:", cmd, "got", res)
 	}
 
+	str = "save"
+	cmd = &Command{Kind: CmdSave}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "bgsave"
+	cmd = &Command{Kind: CmdBgSave}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "bgrewriteaof"
+	cmd = &Command{Kind: CmdRewriteWal}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
 	str = "quit"
 	cmd = &Command{Kind: CmdQuit}
 	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
@@ -145,6 +313,41 @@ func TestParseQueueCommands(t *testing.T) {
 	if !reflect.DeepEqual(cmd, res) {
 		t.Error("Expected result to be:", cmd, "got", res)
 	}
+	str = "qadd queue pr 1.5 a"
+	cmd = &Command{Kind: CmdQueueAdd, Key: "queue", Values: []string{"a"}, Priority: 1.5}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+	str = "qcreate queue MAX"
+	cmd = &Command{Kind: CmdQueueCreate, Key: "queue", Order: db.OrderMax}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+	str = "qpop queue 3"
+	cmd = &Command{Kind: CmdQueuePop, Key: "queue", Count: 3}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+	str = "qrange queue 0 -1"
+	cmd = &Command{Kind: CmdQueueRange, Key: "queue", Start: 0, Stop: -1}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+	str = "qupdate queue job 0"
+	cmd = &Command{Kind: CmdQueueUpdate, Key: "queue", Value: "job", Priority: 0}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("qadd queue pr nan a"); err != ErrNotFloat {
+		t.Error("Expected 'qadd' with an invalid priority to return", ErrNotFloat, "got", err)
+	}
+	if _, err := ParseCommand("qcreate queue lifo"); err != ErrSyntax {
+		t.Error("Expected 'qcreate' with an unknown order to return", ErrSyntax, "got", err)
+	}
+	if _, err := ParseCommand("qpop queue 0"); err != ErrNotPositive {
+		t.Error("Expected 'qpop queue 0' to return", ErrNotPositive, "got", err)
+	}
 }
 
 func TestParseListCommands(t *testing.T) {
@@ -218,3 +421,382 @@ func TestParseSetCommands(t *testing.T) {
 		t.Error("Expected result to be:", cmd, "got", res)
 	}
 }
+
+func TestParseReplicationCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "replicaof localhost 5678"
+	cmd = &Command{Kind: CmdReplicaOf, Addr: "localhost:5678"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "replicaof no one"
+	cmd = &Command{Kind: CmdReplicaOf}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("replicaof localhost port"); err == nil {
+		t.Error("Expected 'replicaof localhost port' to return parsing error")
+	}
+
+	str = "psync 8b4ec0c78ddf 120"
+	cmd = &Command{Kind: CmdPSync, ReplId: "8b4ec0c78ddf", Offset: 120}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "replconf ack 120"
+	cmd = &Command{Kind: CmdReplConf, Offset: 120}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "info Replication"
+	cmd = &Command{Kind: CmdInfo, Section: "replication"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+}
+
+func TestParseHashCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "hset user name bill age 22"
+	cmd = &Command{Kind: CmdHSet, Key: "user", Values: []string{"name", "bill", "age", "22"}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("hset user name bill age"); err == nil {
+		t.Error("Expected 'hset user name bill age' to return parsing error")
+	}
+
+	str = "hsetnx user name bill"
+	cmd = &Command{Kind: CmdHSetNX, Key: "user", Values: []string{"name", "bill"}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "hget user name"
+	cmd = &Command{Kind: CmdHGet, Key: "user", Value: "name"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "hmget user name age"
+	cmd = &Command{Kind: CmdHMGet, Key: "user", Values: []string{"name", "age"}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "hincrby user age -2"
+	cmd = &Command{Kind: CmdHIncrBy, Key: "user", Value: "age", Incr: -2}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "hincrbyfloat user balance 1.5"
+	cmd = &Command{Kind: CmdHIncrByFloat, Key: "user", Value: "balance", IncrFloat: 1.5}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "hscan user 0 match n* count 10"
+	cmd = &Command{Kind: CmdHScan, Key: "user", Cursor: 0, Pattern: "n*", Count: 10}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "scan 42 type set match user:* count 100"
+	cmd = &Command{Kind: CmdScan, Cursor: 42, Pattern: "user:*", Count: 100, ObjType: "set"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "sscan tags 18446744073709551615"
+	cmd = &Command{Kind: CmdSetScan, Key: "tags", Cursor: 18446744073709551615, Pattern: "*"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("sscan tags 0 type set"); err != ErrSyntax {
+		t.Error("Expected 'sscan' with TYPE to return", ErrSyntax, "got", err)
+	}
+	if _, err := ParseCommand("scan -1"); err != ErrInvalidCursor {
+		t.Error("Expected 'scan -1' to return", ErrInvalidCursor, "got", err)
+	}
+	if _, err := ParseCommand("hscan user 0 match"); err == nil {
+		t.Error("Expected 'hscan user 0 match' to return parsing error")
+	}
+}
+
+func TestParseZSetCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "zadd board nx ch 1.5 bill -inf susan"
+	cmd = &Command{
+		Kind:    CmdZAdd,
+		Key:     "board",
+		ZAdd:    db.ZAddOptions{NX: true, CH: true},
+		Members: []db.ZItem{{Member: "bill", Score: 1.5}, {Member: "susan", Score: math.Inf(-1)}},
+	}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("zadd board nx xx 1 bill"); err != ErrZAddNXAndXX {
+		t.Error("Expected 'zadd board nx xx 1 bill' to return", ErrZAddNXAndXX)
+	}
+	if _, err := ParseCommand("zadd board gt nx 1 bill"); err != ErrZAddGTLTAndNX {
+		t.Error("Expected 'zadd board gt nx 1 bill' to return", ErrZAddGTLTAndNX)
+	}
+	if _, err := ParseCommand("zadd board incr 1 bill 2 susan"); err != ErrZAddIncrPair {
+		t.Error("Expected 'zadd board incr 1 bill 2 susan' to return", ErrZAddIncrPair)
+	}
+	if _, err := ParseCommand("zadd board 1 bill 2"); err == nil {
+		t.Error("Expected 'zadd board 1 bill 2' to return parsing error")
+	}
+
+	str = "zrange board 0 -1 withscores"
+	cmd = &Command{Kind: CmdZRange, Key: "board", ZRange: db.ZRangeOptions{Start: 0, Stop: -1, Count: -1}, WithScores: true}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "zrange board +inf (10 byscore rev limit 0 5"
+	cmd = &Command{Kind: CmdZRange, Key: "board", ZRange: db.ZRangeOptions{
+		By:    db.ZByScore,
+		Min:   db.ScoreBound{Value: 10, Exclusive: true},
+		Max:   db.ScoreBound{Value: math.Inf(1)},
+		Rev:   true,
+		Count: 5,
+	}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "zrange board [a (c bylex"
+	cmd = &Command{Kind: CmdZRange, Key: "board", ZRange: db.ZRangeOptions{
+		By:     db.ZByLex,
+		LexMin: db.LexBound{Value: "a"},
+		LexMax: db.LexBound{Value: "c", Exclusive: true},
+		Count:  -1,
+	}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("zrange board 0 1 limit 0 1"); err != ErrZRangeLimit {
+		t.Error("Expected 'zrange board 0 1 limit 0 1' to return", ErrZRangeLimit)
+	}
+	if _, err := ParseCommand("zrange board a c bylex"); err != db.ErrLexRange {
+		t.Error("Expected 'zrange board a c bylex' to return", db.ErrLexRange)
+	}
+
+	str = "zcount board (1 5"
+	cmd = &Command{Kind: CmdZCount, Key: "board", Min: db.ScoreBound{Value: 1, Exclusive: true}, Max: db.ScoreBound{Value: 5}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("zremrangebyscore board a 5"); err != db.ErrScoreNotFloat {
+		t.Error("Expected 'zremrangebyscore board a 5' to return", db.ErrScoreNotFloat)
+	}
+
+	str = "zincrby board -2.5 bill"
+	cmd = &Command{Kind: CmdZIncrBy, Key: "board", Value: "bill", IncrFloat: -2.5}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+}
+
+func TestParsePubSubCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "subscribe news sport"
+	cmd = &Command{Kind: CmdSubscribe, Keys: []string{"news", "sport"}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "punsubscribe"
+	cmd = &Command{Kind: CmdPUnsubscribe, Keys: []string{}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "publish news hello"
+	cmd = &Command{Kind: CmdPublish, Key: "news", Value: "hello"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "pubsub channels n*"
+	cmd = &Command{Kind: CmdPubSubChannels, Pattern: "n*"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "pubsub numsub news"
+	cmd = &Command{Kind: CmdPubSubNumSub, Keys: []string{"news"}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("pubsub help"); err == nil {
+		t.Error("Expected 'pubsub help' to return parsing error")
+	}
+}
+
+func TestParseTransactionCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "multi"
+	cmd = &Command{Kind: CmdMulti}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "watch a b"
+	cmd = &Command{Kind: CmdWatch, Keys: []string{"a", "b"}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("watch"); err == nil {
+		t.Error("Expected 'watch' to return parsing error")
+	}
+	if _, err := ParseCommand("exec now"); err == nil {
+		t.Error("Expected 'exec now' to return parsing error")
+	}
+}
+
+func TestParseScriptCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "eval \"return memo.call('get', KEYS[1])\" 1 a b c"
+	cmd = &Command{Kind: CmdEval, Value: "return memo.call('get', KEYS[1])", Keys: []string{"a"}, Values: []string{"b", "c"}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "evalsha ABC123 0"
+	cmd = &Command{Kind: CmdEvalSha, Value: "abc123", Keys: []string{}, Values: []string{}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "script exists ABC def"
+	cmd = &Command{Kind: CmdScriptExists, Keys: []string{"abc", "def"}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "script flush async"
+	cmd = &Command{Kind: CmdScriptFlush}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("eval 'return 1' 2 a"); err != ErrTooManyNumKeys {
+		t.Error("Expected 'eval' with too many keys to return", ErrTooManyNumKeys, "got", err)
+	}
+	if _, err := ParseCommand("eval 'return 1' -1"); err != ErrNegativeNumKeys {
+		t.Error("Expected 'eval' with negative keys to return", ErrNegativeNumKeys, "got", err)
+	}
+	if _, err := ParseCommand("script flush later"); err == nil {
+		t.Error("Expected 'script flush later' to return parsing error")
+	}
+}
+
+func TestParseBlockingCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "blpop a b 1.5"
+	cmd = &Command{Kind: CmdBLPop, Keys: []string{"a", "b"}, Timeout: 1500 * time.Millisecond}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "bqpop queue 0"
+	cmd = &Command{Kind: CmdBQPop, Keys: []string{"queue"}}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("brpop a"); err == nil {
+		t.Error("Expected 'brpop a' to return parsing error")
+	}
+	if _, err := ParseCommand("brpop a -1"); err != ErrNegativeTimeout {
+		t.Error("Expected 'brpop a -1' to return", ErrNegativeTimeout, "got", err)
+	}
+	if _, err := ParseCommand("brpop a soon"); err != ErrTimeoutNotFloat {
+		t.Error("Expected 'brpop a soon' to return", ErrTimeoutNotFloat, "got", err)
+	}
+}
+
+func TestParseReliableQueueCommands(t *testing.T) {
+	var str string
+	var cmd, res *Command
+
+	str = "qreserve jobs 30"
+	cmd = &Command{Kind: CmdQueueReserve, Key: "jobs", Timeout: 30 * time.Second}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "qnack jobs abc"
+	cmd = &Command{Kind: CmdQueueNack, Key: "jobs", LeaseId: "abc"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "qconfig jobs maxdeliveries 3"
+	cmd = &Command{Kind: CmdQueueConfig, Key: "jobs", Deliveries: 3, Value: "jobs:dead"}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "qrestore jobs 1 2 data lease abc pxat 1700000000000"
+	cmd = &Command{Kind: CmdQueueRestore, Key: "jobs", Priority: 1, Deliveries: 2, Value: "data", LeaseId: "abc", ExpireAt: 1700000000000}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "qadd jobs at 1700000000000 a"
+	cmd = &Command{Kind: CmdQueueAdd, Key: "jobs", Values: []string{"a"}, Priority: 1, NotBefore: 1700000000000}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "qadd jobs delay 1.5 a"
+	cmd = &Command{Kind: CmdQueueAdd, Key: "jobs", Values: []string{"a"}, Priority: 1, Timeout: 1500 * time.Millisecond}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	str = "qpromote jobs 1700000000000"
+	cmd = &Command{Kind: CmdQueuePromote, Key: "jobs", NotBefore: 1700000000000}
+	if res, _ = ParseCommand(str); !reflect.DeepEqual(cmd, res) {
+		t.Error("Expected result to be:", cmd, "got", res)
+	}
+
+	if _, err := ParseCommand("qadd jobs delay -1 a"); err != ErrNegativeTimeout {
+		t.Error("Expected 'qadd' with a negative delay to return", ErrNegativeTimeout, "got", err)
+	}
+	if _, err := ParseCommand("qreserve jobs 0"); err != ErrLeaseTimeout {
+		t.Error("Expected 'qreserve jobs 0' to return", ErrLeaseTimeout, "got", err)
+	}
+	if _, err := ParseCommand("qconfig jobs maxdeliveries 3 dlq dead"); err != ErrSyntax {
+		t.Error("Expected 'qconfig' with unknown option to return", ErrSyntax, "got", err)
+	}
+}
@@ -2,17 +2,54 @@ package db
 
 import (
 	"errors"
-	"path/filepath"
+	"math"
+	"sort"
+	"strconv"
+	"time"
 )
 
 var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+var ErrHashNotInt = errors.New("ERR hash value is not an integer")
+var ErrHashNotFloat = errors.New("ERR hash value is not a float")
+var ErrIncrNaN = errors.New("ERR increment would produce NaN or Infinity")
+var ErrScoreNaN = errors.New("ERR resulting score is not a number (NaN)")
 
+// The database is not safe for concurrent use, except that the methods that only read it
+// can run concurrently with each other, see: readObj()
 type Database struct {
-	objs map[string]*MemoObj
+	objs    map[string]*MemoObj
+	keys    *scanTable      // Keys of objs, see: Scan()
+	expires *expireIndex    // Keys of objs that have an expiration, see: ExpireCycle()
+	timed   map[string]bool // Queues that had reserved or delayed items, see: ExpiredLeases() and DueQueues()
+	stats   Stats
+	used    int             // Estimated bytes used by the keys, see: UsedMemory()
+	dirty   map[string]bool // Keys accessed since their size was estimated
+}
+
+// Counters of the keys removed by the database itself, they are not reset by FlushAll()
+type Stats struct {
+	ExpiredKeys        int // Keys removed because their expiration passed
+	EvictedKeys        int // Keys removed to free memory
+	ExpireCyclesCapped int // Expire cycles that stopped because they ran out of time
 }
 
 func NewDatabase() *Database {
-	return &Database{objs: make(map[string]*MemoObj)}
+	return &Database{
+		objs:    make(map[string]*MemoObj),
+		keys:    newScanTable(),
+		expires: newExpireIndex(),
+		timed:   make(map[string]bool),
+		dirty:   make(map[string]bool),
+	}
+}
+
+func (d *Database) Stats() Stats {
+	return d.stats
+}
+
+// Number of keys that have an expiration
+func (d *Database) VolatileSize() int {
+	return d.expires.len()
 }
 
 func (d *Database) Size() int {
@@ -21,33 +58,58 @@ func (d *Database) Size() int {
 
 func (d *Database) FlushAll() {
 	d.objs = make(map[string]*MemoObj)
+	d.keys = newScanTable()
+	d.expires = newExpireIndex()
+	d.timed = make(map[string]bool)
+	d.used = 0
+	d.dirty = make(map[string]bool)
 }
 
+// Remove up to limit keys that have expired, or all of them if limit is 0. Only the keys that
+// are due are visited, see: expireIndex
 func (d *Database) CleanupExpired(limit int) int {
+	now := time.Now().UnixMilli()
 	deleted := 0
-	for k, obj := range d.objs {
-		if obj.hasExpired() {
-			delete(d.objs, k)
-			deleted++
-		}
-
-		if limit != 0 && deleted == limit {
+	for limit == 0 || deleted < limit {
+		entry, found := d.expires.peek()
+		if !found || entry.at >= now {
 			break
 		}
+
+		d.remove(entry.key)
+		deleted++
 	}
 
+	d.stats.ExpiredKeys += deleted
 	return deleted
 }
 
-func (d *Database) Keys(pattern string) []string {
-	keys := []string{}
-	for k := range d.objs {
-		match, err := filepath.Match(pattern, k)
-		if err != nil {
-			break
+// Remove expired keys in rounds of up to limit keys, like the active expire cycle of Redis.
+// A round that removes its whole limit means that there is a backlog of expired keys, so
+// another round runs until a round finds fewer keys or the time budget is used up. Returns
+// the number of removed keys and whether the cycle stopped because of the budget.
+// see: https://github.com/redis/redis/blob/unstable/src/expire.c
+func (d *Database) ExpireCycle(limit int, budget time.Duration) (int, bool) {
+	start := time.Now()
+	deleted := 0
+	for {
+		n := d.CleanupExpired(limit)
+		deleted += n
+		if limit == 0 || n < limit {
+			return deleted, false
+		}
+		if time.Since(start) >= budget {
+			d.stats.ExpireCyclesCapped++
+			return deleted, true
 		}
+	}
+}
 
-		if match {
+// Get the keys that match a pattern, see: Match()
+func (d *Database) Keys(pattern string) []string {
+	keys := []string{}
+	for k, obj := range d.objs {
+		if !obj.hasExpired() && Match(pattern, k) {
 			keys = append(keys, k)
 		}
 	}
@@ -55,22 +117,140 @@ func (d *Database) Keys(pattern string) []string {
 	return keys
 }
 
-func (d *Database) Expire(key string, seconds int) bool {
+// Get the keys in the buckets starting from the cursor that match the pattern and, if given,
+// the type. Returns the cursor to continue from, 0 when every key was visited.
+func (d *Database) Scan(cursor uint64, count int, pattern string, kind string) ([]string, uint64) {
+	visited := []string{}
+	cursor = d.keys.scan(cursor, count, func(key string) {
+		visited = append(visited, key)
+	})
+
+	// Expired keys are skipped but not removed, as that would modify the table while it is
+	// being scanned
+	keys := []string{}
+	for _, key := range visited {
+		obj := d.objs[key]
+		if obj.hasExpired() || (kind != "" && TypeName(obj.Kind) != kind) {
+			continue
+		}
+		if Match(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, cursor
+}
+
+// Options for EXPIRE and its variants, see: https://redis.io/docs/latest/commands/expire/
+type ExpireOptions struct {
+	NX bool // Only set an expiration if the key has none
+	XX bool // Only set an expiration if the key has one
+	GT bool // Only set an expiration later than the current one
+	LT bool // Only set an expiration earlier than the current one
+}
+
+// Check if the expiration of a key can be changed, keys without an expiration are treated as
+// if they expire at infinity
+func (opts ExpireOptions) canExpire(current int64, at int64) bool {
+	if current == 0 {
+		return !opts.XX && !opts.GT
+	}
+	return !opts.NX && !(opts.GT && at <= current) && !(opts.LT && at >= current)
+}
+
+// Set the expiration of a key to the given unix time in milliseconds, if that is in the
+// past the key is removed. Returns false if the key does not exist or the options prevent
+// the expiration from being set.
+func (d *Database) ExpireAt(key string, at int64, opts ExpireOptions) bool {
 	obj, found := d.getObj(key)
 	if !found {
 		return found
 	}
-	if seconds <= 0 {
+	if !opts.canExpire(obj.ExpiresAt, at) {
+		return false
+	}
+	if at <= time.Now().UnixMilli() {
 		d.remove(key)
 		return true
 	}
 
-	obj.ExpireIn(seconds)
+	obj.ExpiresAt = at
+	d.expires.set(key, at)
 	return true
 }
 
-func (d *Database) Get(key string) (string, bool, error) {
+// Get the unix time in milliseconds when a key expires, 0 if the key never expires. Like
+// OBJECT this only reads metadata, so the access is not recorded.
+func (d *Database) ExpireTime(key string) (int64, bool) {
+	obj, found := d.lookupObj(key)
+	if !found {
+		return 0, found
+	}
+
+	return obj.ExpiresAt, found
+}
+
+// Internals of a key reported by OBJECT, see: https://redis.io/docs/latest/commands/object/
+type ObjectInfo struct {
+	Encoding string
+	IdleTime int64 // Milliseconds since the key was last accessed
+	Freq     int   // Logarithmic access counter used by the LFU eviction policies
+}
+
+// Get the internals of a key without recording an access
+func (d *Database) Object(key string) (ObjectInfo, bool) {
+	obj, found := d.lookupObj(key)
+	if !found {
+		return ObjectInfo{}, found
+	}
+
+	return objectInfo(obj, time.Now().UnixMilli()), found
+}
+
+func objectInfo(obj *MemoObj, now int64) ObjectInfo {
+	return ObjectInfo{Encoding: obj.encoding(), IdleTime: now - obj.lastAccess(), Freq: int(obj.decayedFreq(now))}
+}
+
+// Size and usage of a key, used to find big and hot keys
+type KeyInfo struct {
+	Type      string
+	Bytes     int   // Estimated like MEMORY USAGE with the default samples
+	Elements  int   // Number of elements of collections, length of strings
+	ExpiresAt int64 // Unix time in milliseconds, 0 if the key never expires
+	ObjectInfo
+}
+
+// Get the size and usage of a key without recording an access
+func (d *Database) KeyInfo(key string) (KeyInfo, bool) {
+	obj, found := d.lookupObj(key)
+	if !found {
+		return KeyInfo{}, found
+	}
+
+	return KeyInfo{
+		Type:       TypeName(obj.Kind),
+		Bytes:      memoryUsage(key, obj, DefaultMemorySamples),
+		Elements:   obj.length(),
+		ExpiresAt:  obj.ExpiresAt,
+		ObjectInfo: objectInfo(obj, time.Now().UnixMilli()),
+	}, found
+}
+
+// Remove the expiration of a key, returns false if the key does not exist or has no
+// expiration
+func (d *Database) Persist(key string) bool {
 	obj, found := d.getObj(key)
+	if !found || obj.ExpiresAt == 0 {
+		return false
+	}
+
+	obj.ExpiresAt = 0
+	d.expires.remove(key)
+	return true
+}
+
+func (d *Database) Get(key string) (string, bool, error) {
+	obj, found := d.readObj(key)
 	if !found {
 		return "", found, nil
 	}
@@ -83,25 +263,34 @@ func (d *Database) Get(key string) (string, bool, error) {
 	return value, found, nil
 }
 
-func (d *Database) Set(key string, value string, expires int) {
+// Set a string value that expires at the given unix time in milliseconds, or never if that
+// is 0
+func (d *Database) Set(key string, value string, expiresAt int64) {
 	obj := newValueObj(value)
-	if expires != 0 {
-		obj.ExpireIn(expires)
+	obj.ExpiresAt = expiresAt
+	d.put(key, obj)
+}
+
+// Set a string value that keeps the expiration of the current value of the key
+func (d *Database) SetKeepTTL(key string, value string) {
+	var expiresAt int64
+	if obj, found := d.getObj(key); found {
+		expiresAt = obj.ExpiresAt
 	}
-	d.objs[key] = obj
+	d.Set(key, value, expiresAt)
 }
 
 func (d *Database) Del(keys []string) int {
 	var deleted int
 	for _, k := range keys {
-		delete(d.objs, k)
+		d.remove(k)
 		deleted++
 	}
 
 	return deleted
 }
 
-func (d *Database) PQAdd(qname string, values []string, priority int) error {
+func (d *Database) PQAdd(qname string, values []string, priority float64) error {
 	obj, found := d.getObj(qname)
 	if !found {
 		obj = newPQueueObj()
@@ -117,7 +306,7 @@ func (d *Database) PQAdd(qname string, values []string, priority int) error {
 	}
 
 	if !found {
-		d.objs[qname] = obj
+		d.put(qname, obj)
 	}
 
 	return nil
@@ -134,254 +323,1245 @@ func (d *Database) PQPop(qname string) (string, bool, error) {
 		return "", found, ErrWrongType
 	}
 
-	value := pqueue.Dequeue()
 	if pqueue.Length == 0 {
+		return "", false, nil
+	}
+
+	value := pqueue.Dequeue()
+	if pqueue.isEmpty() {
 		d.remove(qname)
 	}
 
 	return value, found, nil
 }
 
-func (d *Database) PQLen(qname string) (int, bool, error) {
+// Reserve the next item of a queue, the item is not removed until it is acknowledged
+func (d *Database) PQReserve(qname string, id string, expiresAt int64) (*Lease, bool, error) {
 	obj, found := d.getObj(qname)
 	if !found {
-		return -1, found, nil
+		return nil, false, nil
 	}
 
 	pqueue, ok := obj.asPQueue()
 	if !ok {
-		return -1, found, ErrWrongType
+		return nil, false, ErrWrongType
 	}
 
-	return pqueue.Length, found, nil
+	lease, reserved := pqueue.Reserve(id, expiresAt)
+	if reserved {
+		d.timed[qname] = true
+	}
+
+	return lease, reserved, nil
 }
 
-func (d *Database) LPush(lname string, values []string) error {
-	obj, found := d.getObj(lname)
+// Remove a reserved item for good, returns false if the lease does not exist
+func (d *Database) PQAck(qname string, id string) (bool, error) {
+	obj, found := d.getObj(qname)
 	if !found {
-		obj = newListObj()
+		return false, nil
 	}
 
-	list, ok := obj.asList()
+	pqueue, ok := obj.asPQueue()
 	if !ok {
-		return ErrWrongType
+		return false, ErrWrongType
 	}
 
-	for i := 0; i < len(values); i++ {
-		list.Prepend(values[i])
-	}
-	if !found {
-		d.objs[lname] = obj
+	_, released := pqueue.Release(id)
+	if pqueue.isEmpty() {
+		d.remove(qname)
 	}
 
-	return nil
+	return released, nil
 }
 
-func (d *Database) RPush(lname string, values []string) error {
-	obj, found := d.getObj(lname)
+// Put a reserved item back to its queue, or to the dead letter queue if it has been delivered
+// too many times. Returns the queue the item was put in, false if the lease does not exist.
+func (d *Database) PQNack(qname string, id string) (string, bool, error) {
+	obj, found := d.getObj(qname)
 	if !found {
-		obj = newListObj()
+		return "", false, nil
 	}
 
-	list, ok := obj.asList()
+	pqueue, ok := obj.asPQueue()
 	if !ok {
-		return ErrWrongType
+		return "", false, ErrWrongType
 	}
 
-	for i := 0; i < len(values); i++ {
-		list.Append(values[i])
+	lease, released := pqueue.Release(id)
+	if !released {
+		return "", false, nil
 	}
-	if !found {
-		d.objs[lname] = obj
+
+	if pqueue.MaxDeliveries > 0 && lease.Deliveries >= pqueue.MaxDeliveries {
+		// If the dead letter queue can't be used the item is kept in its queue
+		if d.PQAdd(pqueue.DeadLetter, []string{lease.Data}, lease.Priority) == nil {
+			return pqueue.DeadLetter, true, nil
+		}
 	}
+	pqueue.Requeue(lease)
 
-	return nil
+	return qname, true, nil
 }
 
-func (d *Database) LPop(lname string) (string, bool, error) {
-	obj, found := d.getObj(lname)
+// Set the maximum number of deliveries of the items of a queue and the queue they are moved
+// to after that, the queue is created if it does not exist. A limit of 0 removes the limit.
+func (d *Database) PQConfig(qname string, maxDeliveries int, deadLetter string) error {
+	obj, found := d.getObj(qname)
 	if !found {
-		return "", found, nil
+		obj = newPQueueObj()
 	}
 
-	list, ok := obj.asList()
+	pqueue, ok := obj.asPQueue()
 	if !ok {
-		return "", found, ErrWrongType
+		return ErrWrongType
 	}
 
-	value := list.PopHead()
-	if list.Length == 0 {
-		d.remove(lname)
+	pqueue.MaxDeliveries = maxDeliveries
+	pqueue.DeadLetter = deadLetter
+	if pqueue.isEmpty() {
+		d.remove(qname)
+	} else if !found {
+		d.put(qname, obj)
 	}
 
-	return value, found, nil
+	return nil
 }
 
-func (d *Database) RPop(lname string) (string, bool, error) {
-	obj, found := d.getObj(lname)
+// Add an item to a queue with its delivery count, and optionally as reserved. It is used to
+// recreate queues from the WAL.
+func (d *Database) PQRestore(qname string, data string, priority float64, deliveries int, lease *Lease) error {
+	obj, found := d.getObj(qname)
 	if !found {
-		return "", found, nil
+		obj = newPQueueObj()
+		d.put(qname, obj)
 	}
 
-	list, ok := obj.asList()
+	pqueue, ok := obj.asPQueue()
 	if !ok {
-		return "", found, ErrWrongType
+		return ErrWrongType
 	}
 
-	value := list.PopTail()
-	if obj.List.Length == 0 {
-		d.remove(lname)
+	item := pqueue.newItem(data, priority)
+	item.deliveries = deliveries
+	if lease == nil {
+		pqueue.enqueueItem(item)
+		return nil
 	}
 
-	return value, found, nil
+	pqueue.leases[lease.Id] = &Lease{
+		Id:         lease.Id,
+		Data:       data,
+		Priority:   priority,
+		Deliveries: deliveries,
+		ExpiresAt:  lease.ExpiresAt,
+		insertedAt: item.insertedAt,
+		seq:        item.seq,
+	}
+	d.timed[qname] = true
+
+	return nil
 }
 
-func (d *Database) LLen(lname string) (int, error) {
-	obj, found := d.getObj(lname)
+// Add items to a queue that are not visible until the given time, in unix milliseconds
+func (d *Database) PQSchedule(qname string, values []string, priority float64, notBefore int64) error {
+	obj, found := d.getObj(qname)
 	if !found {
-		return -1, nil
+		obj = newPQueueObj()
 	}
 
-	list, ok := obj.asList()
+	pqueue, ok := obj.asPQueue()
 	if !ok {
-		return -1, ErrWrongType
+		return ErrWrongType
 	}
 
-	return list.Length, nil
+	for _, value := range values {
+		pqueue.Schedule(value, priority, notBefore)
+	}
+
+	if !found {
+		d.put(qname, obj)
+	}
+	d.timed[qname] = true
+
+	return nil
 }
 
-func (d *Database) SetAdd(key string, values []string) (int, error) {
-	obj, found := d.getObj(key)
+// Make the delayed items of a queue that are due at the given time visible, returns the
+// number of items moved
+func (d *Database) PQPromote(qname string, now int64) (int, error) {
+	obj, found := d.getObj(qname)
 	if !found {
-		obj = newSetObj()
+		return 0, nil
 	}
 
-	set, ok := obj.asSet()
+	pqueue, ok := obj.asPQueue()
 	if !ok {
-		return -1, ErrWrongType
+		return 0, ErrWrongType
 	}
 
-	for i := 0; i < len(values); i++ {
-		set.Add(values[i])
-	}
+	return pqueue.Promote(now), nil
+}
 
-	if !found {
-		d.objs[key] = obj
+// Get the number of delayed items of a queue that are due at the given time
+func (d *Database) PQDue(qname string, now int64) int {
+	obj, found := d.getObj(qname)
+	if !found || obj.Kind != ObjPQueue {
+		return 0
 	}
 
-	return len(values), nil
+	return obj.PQueue.Due(now)
 }
 
-func (d *Database) SetMembers(key string) ([]string, error) {
-	obj, found := d.getObj(key)
+// Get the delayed items of a queue ordered by the time they become visible
+func (d *Database) PQScheduled(qname string) ([]QueueItem, error) {
+	obj, found := d.readObj(qname)
 	if !found {
-		obj = newSetObj()
+		return []QueueItem{}, nil
 	}
 
-	set, ok := obj.asSet()
+	pqueue, ok := obj.asPQueue()
 	if !ok {
 		return nil, ErrWrongType
 	}
 
-	return set.Items(), nil
+	return pqueue.Scheduled(), nil
 }
 
-func (d *Database) SetRemove(key string, values []string) (int, error) {
-	obj, found := d.getObj(key)
-	if !found {
-		return 0, nil
+// Get the queues with delayed items that are due at the given time
+func (d *Database) DueQueues(now int64) []string {
+	due := []string{}
+	for qname := range d.timed {
+		pqueue := d.timedQueue(qname)
+		if pqueue != nil && pqueue.Due(now) > 0 {
+			due = append(due, qname)
+		}
 	}
+	sort.Strings(due)
 
-	set, ok := obj.asSet()
-	if !ok {
-		return -1, ErrWrongType
+	return due
+}
+
+// Get a queue tracked for reserved or delayed items, it stops being tracked once it has none
+func (d *Database) timedQueue(qname string) *PriorityQueue {
+	obj, found := d.getObj(qname)
+	if !found || obj.Kind != ObjPQueue || (len(obj.PQueue.leases) == 0 && len(obj.PQueue.scheduled) == 0) {
+		delete(d.timed, qname)
+		return nil
 	}
 
-	var total int
-	for i := 0; i < len(values); i++ {
-		removed := set.Delete(values[i])
-		if removed {
-			total++
+	return obj.PQueue
+}
+
+type ExpiredLease struct {
+	Queue string
+	Id    string
+}
+
+// Get the reserved items whose lease expired before the given time
+func (d *Database) ExpiredLeases(now int64) []ExpiredLease {
+	expired := []ExpiredLease{}
+	for qname := range d.timed {
+		pqueue := d.timedQueue(qname)
+		if pqueue == nil {
+			continue
+		}
+
+		for _, lease := range pqueue.Leases() {
+			if lease.ExpiresAt > now {
+				break
+			}
+			expired = append(expired, ExpiredLease{Queue: qname, Id: lease.Id})
 		}
 	}
 
-	return total, nil
+	return expired
 }
 
-func (d *Database) SetIsMember(key string, value string) (bool, error) {
-	obj, found := d.getObj(key)
-	if !found {
+// Create an empty queue with the given order, it is kept even when it has no items. Returns
+// false if the key already exists.
+func (d *Database) PQCreate(qname string, order QueueOrder) (bool, error) {
+	obj, found := d.getObj(qname)
+	if found {
+		if _, ok := obj.asPQueue(); !ok {
+			return false, ErrWrongType
+		}
 		return false, nil
 	}
 
-	set, ok := obj.asSet()
-	if !ok {
-		return false, ErrWrongType
-	}
+	obj = newPQueueObj()
+	obj.PQueue.Order = order
+	obj.PQueue.created = true
+	d.put(qname, obj)
 
-	return set.Has(value), nil
+	return true, nil
 }
 
-func (d *Database) SetCard(key string) (int, error) {
-	obj, found := d.getObj(key)
+// Pop up to count items from a queue
+func (d *Database) PQPopCount(qname string, count int) ([]string, error) {
+	obj, found := d.getObj(qname)
 	if !found {
-		return 0, nil
+		return []string{}, nil
 	}
 
-	set, ok := obj.asSet()
+	pqueue, ok := obj.asPQueue()
 	if !ok {
-		return -1, ErrWrongType
+		return nil, ErrWrongType
 	}
 
-	return set.Size, nil
-}
-
-func (d *Database) SetInter(a string, b string) ([]string, error) {
-	first, found := d.getObj(a)
-	if !found {
-		return nil, nil
+	values := make([]string, 0, min(count, pqueue.Length))
+	for len(values) < count && pqueue.Length > 0 {
+		values = append(values, pqueue.Dequeue())
 	}
-
-	second, found := d.getObj(b)
-	if !found {
-		return nil, nil
+	if pqueue.isEmpty() {
+		d.remove(qname)
 	}
 
-	set1, ok := first.asSet()
-	if !ok {
-		return nil, ErrWrongType
+	return values, nil
+}
+
+// Get the next item of a queue without removing it
+func (d *Database) PQPeek(qname string) (string, bool, error) {
+	obj, found := d.getObj(qname)
+	if !found {
+		return "", false, nil
 	}
 
-	set2, ok := second.asSet()
+	pqueue, ok := obj.asPQueue()
 	if !ok {
-		return nil, ErrWrongType
+		return "", false, ErrWrongType
 	}
 
-	firstKeys := set1.Items()
-	inter := []string{}
-	for _, k := range firstKeys {
-		if set2.Has(k) {
-			inter = append(inter, k)
-		}
+	if pqueue.Length == 0 {
+		return "", false, nil
 	}
 
-	return inter, nil
+	return pqueue.Peek(), true, nil
 }
 
-func (d *Database) getObj(key string) (*MemoObj, bool) {
-	obj, found := d.objs[key]
+// Get the items of a queue from start to stop in the order they would be popped
+func (d *Database) PQRange(qname string, start int, stop int) ([]QueueItem, error) {
+	obj, found := d.getObj(qname)
 	if !found {
-		return nil, found
+		return []QueueItem{}, nil
 	}
 
-	if obj.hasExpired() {
-		d.remove(key)
-		return nil, false
+	pqueue, ok := obj.asPQueue()
+	if !ok {
+		return nil, ErrWrongType
 	}
 
-	return obj, true
+	return pqueue.Range(start, stop), nil
+}
+
+// Remove all the items of a queue with the given data, returns the number of items removed
+func (d *Database) PQRem(qname string, data string) (int, error) {
+	obj, found := d.getObj(qname)
+	if !found {
+		return 0, nil
+	}
+
+	pqueue, ok := obj.asPQueue()
+	if !ok {
+		return 0, ErrWrongType
+	}
+
+	removed := pqueue.Remove(data)
+	if pqueue.isEmpty() {
+		d.remove(qname)
+	}
+
+	return removed, nil
+}
+
+// Change the priority of all the items of a queue with the given data, returns the number
+// of items updated
+func (d *Database) PQUpdate(qname string, data string, priority float64) (int, error) {
+	obj, found := d.getObj(qname)
+	if !found {
+		return 0, nil
+	}
+
+	pqueue, ok := obj.asPQueue()
+	if !ok {
+		return 0, ErrWrongType
+	}
+
+	return pqueue.Update(data, priority), nil
+}
+
+func (d *Database) PQLen(qname string) (int, bool, error) {
+	obj, found := d.readObj(qname)
+	if !found {
+		return -1, found, nil
+	}
+
+	pqueue, ok := obj.asPQueue()
+	if !ok {
+		return -1, found, ErrWrongType
+	}
+
+	return pqueue.Length, found, nil
+}
+
+func (d *Database) LPush(lname string, values []string) error {
+	obj, found := d.getObj(lname)
+	if !found {
+		obj = newListObj()
+	}
+
+	list, ok := obj.asList()
+	if !ok {
+		return ErrWrongType
+	}
+
+	for i := 0; i < len(values); i++ {
+		list.Prepend(values[i])
+	}
+	if !found {
+		d.put(lname, obj)
+	}
+
+	return nil
+}
+
+func (d *Database) RPush(lname string, values []string) error {
+	obj, found := d.getObj(lname)
+	if !found {
+		obj = newListObj()
+	}
+
+	list, ok := obj.asList()
+	if !ok {
+		return ErrWrongType
+	}
+
+	for i := 0; i < len(values); i++ {
+		list.Append(values[i])
+	}
+	if !found {
+		d.put(lname, obj)
+	}
+
+	return nil
+}
+
+func (d *Database) LPop(lname string) (string, bool, error) {
+	obj, found := d.getObj(lname)
+	if !found {
+		return "", found, nil
+	}
+
+	list, ok := obj.asList()
+	if !ok {
+		return "", found, ErrWrongType
+	}
+
+	value := list.PopHead()
+	if list.Length == 0 {
+		d.remove(lname)
+	}
+
+	return value, found, nil
+}
+
+func (d *Database) RPop(lname string) (string, bool, error) {
+	obj, found := d.getObj(lname)
+	if !found {
+		return "", found, nil
+	}
+
+	list, ok := obj.asList()
+	if !ok {
+		return "", found, ErrWrongType
+	}
+
+	value := list.PopTail()
+	if obj.List.Length == 0 {
+		d.remove(lname)
+	}
+
+	return value, found, nil
+}
+
+func (d *Database) LLen(lname string) (int, error) {
+	obj, found := d.readObj(lname)
+	if !found {
+		return -1, nil
+	}
+
+	list, ok := obj.asList()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	return list.Length, nil
+}
+
+func (d *Database) SetAdd(key string, values []string) (int, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		obj = newSetObj()
+	}
+
+	set, ok := obj.asSet()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	for i := 0; i < len(values); i++ {
+		set.Add(values[i])
+	}
+
+	if !found {
+		d.put(key, obj)
+	}
+
+	return len(values), nil
+}
+
+func (d *Database) SetMembers(key string) ([]string, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		obj = newSetObj()
+	}
+
+	set, ok := obj.asSet()
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	return set.Items(), nil
+}
+
+// Get the members of a set in the buckets starting from the cursor that match the pattern,
+// returns the cursor to continue from or 0 when every member was visited
+func (d *Database) SScan(key string, cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return []string{}, 0, nil
+	}
+
+	set, ok := obj.asSet()
+	if !ok {
+		return nil, 0, ErrWrongType
+	}
+
+	visited, cursor := set.Scan(cursor, count)
+	members := []string{}
+	for _, member := range visited {
+		if Match(pattern, member) {
+			members = append(members, member)
+		}
+	}
+
+	return members, cursor, nil
+}
+
+func (d *Database) SetRemove(key string, values []string) (int, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		return 0, nil
+	}
+
+	set, ok := obj.asSet()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	var total int
+	for i := 0; i < len(values); i++ {
+		removed := set.Delete(values[i])
+		if removed {
+			total++
+		}
+	}
+
+	return total, nil
+}
+
+func (d *Database) SetIsMember(key string, value string) (bool, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return false, nil
+	}
+
+	set, ok := obj.asSet()
+	if !ok {
+		return false, ErrWrongType
+	}
+
+	return set.Has(value), nil
+}
+
+func (d *Database) SetCard(key string) (int, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return 0, nil
+	}
+
+	set, ok := obj.asSet()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	return set.Size, nil
+}
+
+func (d *Database) SetInter(a string, b string) ([]string, error) {
+	first, found := d.readObj(a)
+	if !found {
+		return nil, nil
+	}
+
+	second, found := d.readObj(b)
+	if !found {
+		return nil, nil
+	}
+
+	set1, ok := first.asSet()
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	set2, ok := second.asSet()
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	firstKeys := set1.Items()
+	inter := []string{}
+	for _, k := range firstKeys {
+		if set2.Has(k) {
+			inter = append(inter, k)
+		}
+	}
+
+	return inter, nil
+}
+
+// Set field-value pairs in a hash, returns the number of fields that were added
+func (d *Database) HSet(key string, items []string) (int, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		obj = newHashObj()
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	var added int
+	for i := 0; i+1 < len(items); i += 2 {
+		if hash.Set(items[i], items[i+1]) {
+			added++
+		}
+	}
+
+	if !found {
+		d.put(key, obj)
+	}
+
+	return added, nil
+}
+
+// Set a field only if it does not exist yet, returns true if the field was set
+func (d *Database) HSetNX(key string, field string, value string) (bool, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		obj = newHashObj()
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return false, ErrWrongType
+	}
+
+	if hash.Has(field) {
+		return false, nil
+	}
+
+	hash.Set(field, value)
+	if !found {
+		d.put(key, obj)
+	}
+
+	return true, nil
+}
+
+func (d *Database) HGet(key string, field string) (string, bool, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return "", found, nil
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return "", found, ErrWrongType
+	}
+
+	value, found := hash.Get(field)
+	return value, found, nil
+}
+
+func (d *Database) HDel(key string, fields []string) (int, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		return 0, nil
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	var deleted int
+	for _, f := range fields {
+		if hash.Delete(f) {
+			deleted++
+		}
+	}
+
+	if hash.Size == 0 {
+		d.remove(key)
+	}
+
+	return deleted, nil
+}
+
+func (d *Database) HExists(key string, field string) (bool, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return false, nil
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return false, ErrWrongType
+	}
+
+	return hash.Has(field), nil
+}
+
+func (d *Database) HLen(key string) (int, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return 0, nil
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	return hash.Size, nil
+}
+
+func (d *Database) HKeys(key string) ([]string, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return []string{}, nil
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	return hash.Fields(), nil
+}
+
+func (d *Database) HVals(key string) ([]string, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return []string{}, nil
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	return hash.Values(), nil
+}
+
+// Get all the fields and values of a hash as a flat list
+func (d *Database) HGetAll(key string) ([]string, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return []string{}, nil
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	return hash.Items(), nil
+}
+
+// Increment the integer value of a field, missing fields are treated as 0
+func (d *Database) HIncrBy(key string, field string, incr int) (int, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		obj = newHashObj()
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return 0, ErrWrongType
+	}
+
+	var current int
+	if value, found := hash.Get(field); found {
+		var err error
+		current, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, ErrHashNotInt
+		}
+	}
+
+	current += incr
+	hash.Set(field, strconv.Itoa(current))
+	if !found {
+		d.put(key, obj)
+	}
+
+	return current, nil
+}
+
+// Increment the float value of a field, missing fields are treated as 0
+func (d *Database) HIncrByFloat(key string, field string, incr float64) (float64, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		obj = newHashObj()
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return 0, ErrWrongType
+	}
+
+	var current float64
+	if value, found := hash.Get(field); found {
+		var err error
+		current, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, ErrHashNotFloat
+		}
+	}
+
+	current += incr
+	if math.IsInf(current, 0) || math.IsNaN(current) {
+		return 0, ErrIncrNaN
+	}
+
+	hash.Set(field, strconv.FormatFloat(current, 'f', -1, 64))
+	if !found {
+		d.put(key, obj)
+	}
+
+	return current, nil
+}
+
+// Get the fields of a hash in the buckets starting from the cursor that match the pattern,
+// along with their values. The count is a hint of the number of fields visited, returns the
+// cursor to continue from or 0 when every field was visited
+func (d *Database) HScan(key string, cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return []string{}, 0, nil
+	}
+
+	hash, ok := obj.asHash()
+	if !ok {
+		return nil, 0, ErrWrongType
+	}
+
+	visited, cursor := hash.Scan(cursor, count)
+	items := []string{}
+	for i := 0; i < len(visited); i += 2 {
+		if Match(pattern, visited[i]) {
+			items = append(items, visited[i], visited[i+1])
+		}
+	}
+
+	return items, cursor, nil
+}
+
+// Options for ZADD, see: https://redis.io/docs/latest/commands/zadd/
+type ZAddOptions struct {
+	NX   bool // Only add new members
+	XX   bool // Only update existing members
+	GT   bool // Only update a member if the new score is greater
+	LT   bool // Only update a member if the new score is less
+	CH   bool // Count changed members in addition to the added ones
+	Incr bool // Increment the score instead of setting it
+}
+
+// Check if the score of an existing member can be updated
+func (opts ZAddOptions) canUpdate(current float64, score float64) bool {
+	return !opts.NX && !(opts.GT && score <= current) && !(opts.LT && score >= current)
+}
+
+func (d *Database) ZAdd(key string, items []ZItem, opts ZAddOptions) (int, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		obj = newZSetObj()
+	}
+
+	zset, ok := obj.asZSet()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	var added, changed int
+	for _, item := range items {
+		current, exists := zset.Score(item.Member)
+		if exists {
+			if opts.canUpdate(current, item.Score) && current != item.Score {
+				zset.Add(item.Member, item.Score)
+				changed++
+			}
+			continue
+		}
+
+		if !opts.XX {
+			zset.Add(item.Member, item.Score)
+			added++
+		}
+	}
+
+	if !found && zset.Size > 0 {
+		d.put(key, obj)
+	}
+
+	if opts.CH {
+		return added + changed, nil
+	}
+	return added, nil
+}
+
+// Increment the score of a member, returns false if the options prevented the update
+func (d *Database) ZIncrBy(key string, member string, incr float64, opts ZAddOptions) (float64, bool, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		obj = newZSetObj()
+	}
+
+	zset, ok := obj.asZSet()
+	if !ok {
+		return 0, false, ErrWrongType
+	}
+
+	current, exists := zset.Score(member)
+	if !exists && opts.XX {
+		return 0, false, nil
+	}
+
+	score := current + incr
+	if math.IsNaN(score) {
+		return 0, false, ErrScoreNaN
+	}
+	if exists && !opts.canUpdate(current, score) {
+		return 0, false, nil
+	}
+
+	zset.Add(member, score)
+	if !found {
+		d.put(key, obj)
+	}
+
+	return score, true, nil
+}
+
+func (d *Database) ZScore(key string, member string) (float64, bool, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return 0, false, nil
+	}
+
+	zset, ok := obj.asZSet()
+	if !ok {
+		return 0, false, ErrWrongType
+	}
+
+	score, found := zset.Score(member)
+	return score, found, nil
+}
+
+func (d *Database) ZRank(key string, member string, rev bool) (int, bool, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return -1, false, nil
+	}
+
+	zset, ok := obj.asZSet()
+	if !ok {
+		return -1, false, ErrWrongType
+	}
+
+	rank, found := zset.Rank(member, rev)
+	return rank, found, nil
+}
+
+type ZRangeBy = byte
+
+const (
+	ZByRank ZRangeBy = iota
+	ZByScore
+	ZByLex
+)
+
+// Options for ZRANGE, see: https://redis.io/docs/latest/commands/zrange/
+type ZRangeOptions struct {
+	By     ZRangeBy
+	Start  int // ZByRank
+	Stop   int // ZByRank
+	Min    ScoreBound
+	Max    ScoreBound
+	LexMin LexBound
+	LexMax LexBound
+	Rev    bool
+	Offset int
+	Count  int // Negative to return all members in the range
+}
+
+func (d *Database) ZRange(key string, opts ZRangeOptions) ([]ZItem, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return []ZItem{}, nil
+	}
+
+	zset, ok := obj.asZSet()
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	if opts.Offset < 0 {
+		return []ZItem{}, nil
+	}
+
+	switch opts.By {
+	case ZByScore:
+		return zset.RangeByScore(opts.Min, opts.Max, opts.Rev, opts.Offset, opts.Count), nil
+	case ZByLex:
+		return zset.RangeByLex(opts.LexMin, opts.LexMax, opts.Rev, opts.Offset, opts.Count), nil
+	}
+
+	return zset.RangeByRank(opts.Start, opts.Stop, opts.Rev), nil
+}
+
+func (d *Database) ZRem(key string, members []string) (int, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		return 0, nil
+	}
+
+	zset, ok := obj.asZSet()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	var removed int
+	for _, m := range members {
+		if zset.Remove(m) {
+			removed++
+		}
+	}
+
+	if zset.Size == 0 {
+		d.remove(key)
+	}
+
+	return removed, nil
+}
+
+func (d *Database) ZRemRangeByScore(key string, min ScoreBound, max ScoreBound) (int, error) {
+	obj, found := d.getObj(key)
+	if !found {
+		return 0, nil
+	}
+
+	zset, ok := obj.asZSet()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	removed := zset.RemoveRangeByScore(min, max)
+	if zset.Size == 0 {
+		d.remove(key)
+	}
+
+	return removed, nil
+}
+
+func (d *Database) ZCard(key string) (int, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return 0, nil
+	}
+
+	zset, ok := obj.asZSet()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	return zset.Size, nil
+}
+
+func (d *Database) ZCount(key string, min ScoreBound, max ScoreBound) (int, error) {
+	obj, found := d.readObj(key)
+	if !found {
+		return 0, nil
+	}
+
+	zset, ok := obj.asZSet()
+	if !ok {
+		return -1, ErrWrongType
+	}
+
+	return zset.Count(min, max), nil
+}
+
+// Generate the minimal list of commands that recreate the current state of the database,
+// every command is returned as a list of arguments.
+func (d *Database) RewriteCommands() [][]string {
+	cmds := [][]string{}
+	for k, obj := range d.objs {
+		if obj.hasExpired() {
+			continue
+		}
+
+		switch obj.Kind {
+		case ObjValue:
+			cmds = append(cmds, []string{"set", k, obj.Value})
+		case ObjList:
+			cmds = append(cmds, append([]string{"rpush", k}, obj.List.Items()...))
+		case ObjSet:
+			// Sets are not removed when their last member is removed
+			if obj.Set.Size == 0 {
+				continue
+			}
+			cmds = append(cmds, append([]string{"sadd", k}, obj.Set.Items()...))
+		case ObjHash:
+			cmds = append(cmds, append([]string{"hset", k}, obj.Hash.Items()...))
+		case ObjZSet:
+			zadd := []string{"zadd", k}
+			for _, item := range obj.ZSet.Items() {
+				zadd = append(zadd, FormatScore(item.Score), item.Member)
+			}
+			cmds = append(cmds, zadd)
+		case ObjPQueue:
+			if obj.PQueue.created {
+				order := "min"
+				if obj.PQueue.Order == OrderMax {
+					order = "max"
+				}
+				cmds = append(cmds, []string{"qcreate", k, order})
+			}
+
+			// One command for every item in the order they would be popped. Items are not
+			// grouped, since values such as "at" or "pr" would be parsed as options of QADD.
+			// Items that were already delivered are restored with their delivery count.
+			for _, item := range obj.PQueue.sortedItems() {
+				if item.deliveries > 0 {
+					cmds = append(cmds, []string{"qrestore", k, FormatScore(item.priority), strconv.Itoa(item.deliveries), item.data})
+				} else {
+					cmds = append(cmds, []string{"qadd", k, "pr", FormatScore(item.priority), item.data})
+				}
+			}
+
+			for _, item := range obj.PQueue.scheduled {
+				cmds = append(cmds, []string{
+					"qadd", k, "pr", FormatScore(item.priority), "at", strconv.FormatInt(item.notBefore, 10), item.data,
+				})
+			}
+			for _, lease := range obj.PQueue.Leases() {
+				cmds = append(cmds, []string{
+					"qrestore", k, FormatScore(lease.Priority), strconv.Itoa(lease.Deliveries), lease.Data,
+					"lease", lease.Id, "pxat", strconv.FormatInt(lease.ExpiresAt, 10),
+				})
+			}
+			if obj.PQueue.MaxDeliveries > 0 {
+				cmds = append(cmds, []string{
+					"qconfig", k, "maxdeliveries", strconv.Itoa(obj.PQueue.MaxDeliveries), "deadletter", obj.PQueue.DeadLetter,
+				})
+			}
+		}
+
+		if obj.ExpiresAt != 0 {
+			cmds = append(cmds, []string{"pexpireat", k, strconv.FormatInt(obj.ExpiresAt, 10)})
+		}
+	}
+
+	return cmds
+}
+
+// Get an object for a command that can modify it, expired keys are removed
+func (d *Database) getObj(key string) (*MemoObj, bool) {
+	obj, found := d.objs[key]
+	if !found {
+		return nil, found
+	}
+
+	if obj.hasExpired() {
+		d.remove(key)
+		d.stats.ExpiredKeys++
+		return nil, false
+	}
+
+	// The object can be modified by the caller, so its size is estimated again
+	obj.touch(time.Now().UnixMilli())
+	d.dirty[key] = true
+	return obj, true
+}
+
+// Get an object for a command that only reads it. Unlike getObj() the database is not
+// modified, so readers can run concurrently: expired keys are left for the expire job or the
+// next write to remove and the access is recorded atomically.
+func (d *Database) readObj(key string) (*MemoObj, bool) {
+	obj, found := d.lookupObj(key)
+	if !found {
+		return nil, found
+	}
+
+	obj.touch(time.Now().UnixMilli())
+	return obj, true
+}
+
+// Same as readObj() but the access is not recorded, used by commands that inspect keys
+func (d *Database) lookupObj(key string) (*MemoObj, bool) {
+	obj, found := d.objs[key]
+	if !found || obj.hasExpired() {
+		return nil, false
+	}
+
+	return obj, true
+}
+
+func (d *Database) put(key string, obj *MemoObj) {
+	if prev, found := d.objs[key]; found {
+		d.used -= prev.size
+	} else {
+		d.keys.add(key)
+	}
+
+	obj.size = 0
+	obj.accessedAt = time.Now().UnixMilli()
+	obj.freq = lfuInitVal
+	d.objs[key] = obj
+	d.expires.set(key, obj.ExpiresAt)
+	d.dirty[key] = true
 }
 
 func (d *Database) remove(key string) {
-	delete(d.objs, key)
+	if obj, found := d.objs[key]; found {
+		d.used -= obj.size
+		delete(d.objs, key)
+		delete(d.dirty, key)
+		d.keys.remove(key)
+		d.expires.remove(key)
+	}
 }
@@ -0,0 +1,247 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRewriteCommands(t *testing.T) {
+	d := NewDatabase()
+	d.Set("name", "bill", 0)
+	d.SetAdd("empty", []string{"a"})
+	d.SetRemove("empty", []string{"a"})
+	d.PQAdd("queue", []string{"a", "b"}, 1)
+	d.PQAdd("queue", []string{"c"}, 2)
+	d.PQAdd("queue", []string{"d"}, 3)
+	d.PQReserve("queue", "lease", 1700000000000)
+	d.PQAdd("queue", []string{"e"}, 0)
+	d.PQReserve("queue", "requeued", 1700000000000)
+	d.PQNack("queue", "requeued")
+	d.PQConfig("queue", 5, "dead")
+	d.PQSchedule("queue", []string{"later"}, 1, 1700000000000)
+
+	d.Del([]string{"name"})
+	d.RPush("list", []string{"1", "2"})
+
+	cmds := d.RewriteCommands()
+	expected := map[string][][]string{
+		"list": {{"rpush", "list", "1", "2"}},
+		"queue": {
+			{"qrestore", "queue", "0", "1", "e"},
+			{"qadd", "queue", "pr", "1", "b"},
+			{"qadd", "queue", "pr", "2", "c"},
+			{"qadd", "queue", "pr", "3", "d"},
+			{"qadd", "queue", "pr", "1", "at", "1700000000000", "later"},
+			{"qrestore", "queue", "1", "1", "a", "lease", "lease", "pxat", "1700000000000"},
+			{"qconfig", "queue", "maxdeliveries", "5", "deadletter", "dead"},
+		},
+	}
+
+	byKey := map[string][][]string{}
+	for _, cmd := range cmds {
+		byKey[cmd[1]] = append(byKey[cmd[1]], cmd)
+	}
+
+	if !reflect.DeepEqual(byKey, expected) {
+		t.Error("Expected rewrite commands to be", expected, "got", byKey)
+	}
+}
+
+func TestZAddOptions(t *testing.T) {
+	d := NewDatabase()
+	d.ZAdd("board", []ZItem{{Member: "bill", Score: 10}}, ZAddOptions{})
+
+	if n, _ := d.ZAdd("board", []ZItem{{Member: "susan", Score: 5}}, ZAddOptions{XX: true}); n != 0 {
+		t.Error("Expected ZADD XX to not add new members")
+	}
+	if n, _ := d.ZAdd("board", []ZItem{{Member: "bill", Score: 5}, {Member: "susan", Score: 5}}, ZAddOptions{NX: true}); n != 1 {
+		t.Error("Expected ZADD NX to only add 'susan'")
+	}
+	if score, _, _ := d.ZScore("board", "bill"); score != 10 {
+		t.Error("Expected ZADD NX to not update 'bill'")
+	}
+	if n, _ := d.ZAdd("board", []ZItem{{Member: "bill", Score: 5}, {Member: "susan", Score: 8}}, ZAddOptions{GT: true, CH: true}); n != 1 {
+		t.Error("Expected ZADD GT CH to only change 'susan'")
+	}
+
+	if _, updated, _ := d.ZIncrBy("board", "bill", -1, ZAddOptions{GT: true}); updated {
+		t.Error("Expected ZADD GT INCR with a negative increment to not update 'bill'")
+	}
+	if score, updated, _ := d.ZIncrBy("board", "bill", 2.5, ZAddOptions{}); !updated || score != 12.5 {
+		t.Error("Expected ZINCRBY to return 12.5, got", score)
+	}
+
+	if _, err := d.ZAdd("board", []ZItem{{Member: "bill", Score: 1}}, ZAddOptions{}); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	d.Set("name", "bill", 0)
+	if _, err := d.ZAdd("name", []ZItem{{Member: "bill", Score: 1}}, ZAddOptions{}); err != ErrWrongType {
+		t.Error("Expected ZADD on a string to return", ErrWrongType)
+	}
+
+	d.ZRem("board", []string{"bill", "susan"})
+	if n, _ := d.ZCard("board"); n != 0 || d.Size() != 1 {
+		t.Error("Expected empty sorted set to be removed")
+	}
+}
+
+func TestExpireOptions(t *testing.T) {
+	d := NewDatabase()
+	d.Set("name", "bill", 0)
+	later := time.Now().UnixMilli() + 60000
+
+	if d.ExpireAt("name", later, ExpireOptions{XX: true}) || d.ExpireAt("name", later, ExpireOptions{GT: true}) {
+		t.Error("Expected XX and GT to not set an expiration on a key without one")
+	}
+	if !d.ExpireAt("name", later, ExpireOptions{LT: true}) {
+		t.Error("Expected LT to set an expiration on a key without one")
+	}
+	if d.ExpireAt("name", later+1000, ExpireOptions{NX: true}) || d.ExpireAt("name", later+1000, ExpireOptions{LT: true}) {
+		t.Error("Expected NX and LT to not extend the expiration")
+	}
+	if !d.ExpireAt("name", later+1000, ExpireOptions{XX: true, GT: true}) {
+		t.Error("Expected XX GT to extend the expiration")
+	}
+	if at, _ := d.ExpireTime("name"); at != later+1000 {
+		t.Error("Expected expiration to be", later+1000, "got", at)
+	}
+
+	d.SetKeepTTL("name", "susan")
+	if at, _ := d.ExpireTime("name"); at != later+1000 {
+		t.Error("Expected SET KEEPTTL to keep the expiration, got", at)
+	}
+	if !d.Persist("name") || d.Persist("name") {
+		t.Error("Expected PERSIST to only succeed once")
+	}
+	if at, found := d.ExpireTime("name"); !found || at != 0 {
+		t.Error("Expected key to not expire, got", at)
+	}
+
+	d.ExpireAt("name", time.Now().UnixMilli()-1, ExpireOptions{})
+	if _, found := d.ExpireTime("name"); found {
+		t.Error("Expected key with an expiration in the past to be removed")
+	}
+}
+
+func TestPQDeadLetter(t *testing.T) {
+	d := NewDatabase()
+	d.PQConfig("jobs", 2, "dead")
+	d.PQAdd("jobs", []string{"job"}, 1)
+
+	d.PQReserve("jobs", "a", 1000)
+	if target, nacked, _ := d.PQNack("jobs", "a"); !nacked || target != "jobs" {
+		t.Error("Expected PQNack('a') to put the item back to 'jobs', got", target, nacked)
+	}
+	d.PQReserve("jobs", "b", 2000)
+
+	if expired := d.ExpiredLeases(1500); len(expired) != 0 {
+		t.Error("Expected no expired leases, got", expired)
+	}
+	if expired := d.ExpiredLeases(2000); !reflect.DeepEqual(expired, []ExpiredLease{{Queue: "jobs", Id: "b"}}) {
+		t.Error("Expected lease 'b' to be expired, got", expired)
+	}
+
+	if target, _, _ := d.PQNack("jobs", "b"); target != "dead" {
+		t.Error("Expected PQNack('b') to put the item to 'dead', got", target)
+	}
+	if length, _, _ := d.PQLen("jobs"); length != 0 {
+		t.Error("Expected item to be removed from 'jobs' after 2 deliveries")
+	}
+	if v, _, _ := d.PQPop("dead"); v != "job" {
+		t.Error("Expected item to be moved to 'dead'")
+	}
+
+	d.PQConfig("jobs", 0, "")
+	if _, found := d.getObj("jobs"); found {
+		t.Error("Expected empty queue to be removed once it has no configuration")
+	}
+}
+
+func TestPQSchedule(t *testing.T) {
+	d := NewDatabase()
+	d.PQSchedule("jobs", []string{"a", "b"}, 1, 2000)
+
+	if _, found, _ := d.PQPop("jobs"); found {
+		t.Error("Expected delayed items to not be popped")
+	}
+	if due := d.DueQueues(1999); len(due) != 0 {
+		t.Error("Expected no due queues, got", due)
+	}
+	if due := d.DueQueues(2000); !reflect.DeepEqual(due, []string{"jobs"}) {
+		t.Error("Expected 'jobs' to be due, got", due)
+	}
+
+	if promoted, _ := d.PQPromote("jobs", 2000); promoted != 2 {
+		t.Error("Expected 2 items to be promoted, got", promoted)
+	}
+	if items, _ := d.PQScheduled("jobs"); len(items) != 0 {
+		t.Error("Expected no delayed items left, got", items)
+	}
+	if v, _, _ := d.PQPop("jobs"); v != "a" {
+		t.Error("Expected PQPop('jobs') to return 'a'")
+	}
+	if v, _, _ := d.PQPop("jobs"); v != "b" {
+		t.Error("Expected PQPop('jobs') to return 'b'")
+	}
+	if _, found := d.getObj("jobs"); found {
+		t.Error("Expected empty queue to be removed")
+	}
+
+	d.Set("name", "bill", 0)
+	if err := d.PQSchedule("name", []string{"a"}, 1, 2000); err != ErrWrongType {
+		t.Error("Expected PQSchedule on a string to return", ErrWrongType)
+	}
+}
+
+func TestPQPopCount(t *testing.T) {
+	d := NewDatabase()
+	d.PQAdd("jobs", []string{"a", "b"}, 1)
+	d.PQAdd("jobs", []string{"c"}, 0)
+
+	if v, _, _ := d.PQPeek("jobs"); v != "c" {
+		t.Error("Expected PQPeek('jobs') to return 'c'")
+	}
+	if values, _ := d.PQPopCount("jobs", 2); !reflect.DeepEqual(values, []string{"c", "a"}) {
+		t.Error("Expected PQPopCount('jobs', 2) to return [c a], got", values)
+	}
+	if values, _ := d.PQPopCount("jobs", 5); !reflect.DeepEqual(values, []string{"b"}) {
+		t.Error("Expected PQPopCount('jobs', 5) to return [b], got", values)
+	}
+	if _, found := d.getObj("jobs"); found {
+		t.Error("Expected empty queue to be removed")
+	}
+	if values, _ := d.PQPopCount("jobs", 1); len(values) != 0 {
+		t.Error("Expected PQPopCount() of a missing queue to return nothing, got", values)
+	}
+}
+
+func TestPQCreate(t *testing.T) {
+	d := NewDatabase()
+	if created, _ := d.PQCreate("jobs", OrderMax); !created {
+		t.Error("Expected PQCreate('jobs') to create the queue")
+	}
+	if created, _ := d.PQCreate("jobs", OrderMin); created {
+		t.Error("Expected PQCreate('jobs') to not replace an existing queue")
+	}
+
+	d.PQAdd("jobs", []string{"a"}, 1)
+	d.PQAdd("jobs", []string{"b"}, 2)
+	if v, _, _ := d.PQPop("jobs"); v != "b" {
+		t.Error("Expected PQPop('jobs') to return 'b'")
+	}
+	d.PQPop("jobs")
+	if _, found := d.getObj("jobs"); !found {
+		t.Error("Expected a created queue to be kept when empty")
+	}
+
+	expected := [][]string{{"qcreate", "jobs", "max"}}
+	if cmds := d.RewriteCommands(); !reflect.DeepEqual(cmds, expected) {
+		t.Error("Expected rewrite to be", expected, "got", cmds)
+	}
+
+	d.Set("name", "bill", 0)
+	if _, err := d.PQCreate("name", OrderMin); err != ErrWrongType {
+		t.Error("Expected PQCreate on a string to return", ErrWrongType)
+	}
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// How the key to remove is chosen when the memory limit is reached
+type EvictionPolicy = string
+
+const (
+	NoEviction     EvictionPolicy = "noeviction"      // Nothing is removed, writes are rejected
+	AllKeysLRU     EvictionPolicy = "allkeys-lru"     // The least recently used key
+	AllKeysLFU     EvictionPolicy = "allkeys-lfu"     // The least frequently used key
+	AllKeysRandom  EvictionPolicy = "allkeys-random"  // Any key
+	VolatileLRU    EvictionPolicy = "volatile-lru"    // The least recently used key with an expiration
+	VolatileLFU    EvictionPolicy = "volatile-lfu"    // The least frequently used key with an expiration
+	VolatileRandom EvictionPolicy = "volatile-random" // Any key with an expiration
+	VolatileTTL    EvictionPolicy = "volatile-ttl"    // The key that expires first
+)
+
+// Number of keys sampled to choose the one to evict with the LRU and LFU policies
+const DefaultEvictionSamples = 5
+
+func ParseEvictionPolicy(policy string) (EvictionPolicy, error) {
+	switch policy {
+	case NoEviction, AllKeysLRU, AllKeysLFU, AllKeysRandom, VolatileLRU, VolatileLFU, VolatileRandom, VolatileTTL:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid eviction policy '%s'", policy)
+}
+
+// Remove a key chosen by the eviction policy, returns false if there is no key the policy
+// can remove. Like Redis, the LRU and LFU policies are approximated by removing the best
+// candidate out of a few sampled keys.
+// see: https://redis.io/docs/latest/develop/reference/eviction/
+func (d *Database) Evict(policy EvictionPolicy, samples int) (string, bool) {
+	var keys []string
+	switch policy {
+	case VolatileTTL:
+		// The expire index is ordered by deadline, so no sampling is needed
+		entry, found := d.expires.peek()
+		if found {
+			keys = []string{entry.key}
+		}
+	case AllKeysRandom:
+		keys = d.sampleKeys(1)
+	case VolatileRandom:
+		keys = d.expires.sample(1)
+	case AllKeysLRU, AllKeysLFU:
+		keys = d.sampleKeys(samples)
+	case VolatileLRU, VolatileLFU:
+		keys = d.expires.sample(samples)
+	}
+
+	if len(keys) == 0 {
+		return "", false
+	}
+
+	now := time.Now().UnixMilli()
+	victim := keys[0]
+	for _, key := range keys[1:] {
+		if evictsBefore(policy, d.objs[key], d.objs[victim], now) {
+			victim = key
+		}
+	}
+
+	d.remove(victim)
+	d.stats.EvictedKeys++
+	return victim, true
+}
+
+// Whether an object is a better candidate for eviction than another one
+func evictsBefore(policy EvictionPolicy, obj *MemoObj, other *MemoObj, now int64) bool {
+	if policy == AllKeysLFU || policy == VolatileLFU {
+		freq, otherFreq := obj.decayedFreq(now), other.decayedFreq(now)
+		if freq != otherFreq {
+			return freq < otherFreq
+		}
+	}
+
+	return obj.lastAccess() < other.lastAccess()
+}
+
+// Get up to n keys starting from a random position of the keyspace
+func (d *Database) sampleKeys(n int) []string {
+	keys := make([]string, 0, n)
+	for key := range d.objs {
+		if len(keys) == n {
+			break
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
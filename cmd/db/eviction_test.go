@@ -0,0 +1,108 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsedMemory(t *testing.T) {
+	d := NewDatabase()
+	d.Set("name", strings.Repeat("x", 1000), 0)
+	d.SetAdd("set", []string{"a", "b", "c"})
+	used := d.UsedMemory()
+	if used < 1000 {
+		t.Error("Expected used memory to include the value, got", used)
+	}
+
+	d.SetAdd("set", []string{strings.Repeat("y", 1000)})
+	if d.UsedMemory() <= used {
+		t.Error("Expected used memory to grow after SADD")
+	}
+	if size, _ := d.MemoryUsage("name", 0); size != keyOverhead+len("name")+1000 {
+		t.Error("Expected other memory usage for 'name', got", size)
+	}
+
+	d.Del([]string{"name", "set"})
+	if used := d.UsedMemory(); used != 0 {
+		t.Error("Expected no used memory after deleting every key, got", used)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	d := NewDatabase()
+	now := time.Now().UnixMilli()
+	for i, key := range []string{"a", "b", "c"} {
+		d.Set(key, "v", 0)
+		d.objs[key].accessedAt = now - int64(i)*1000
+		d.objs[key].freq = uint32(10 - i)
+	}
+	d.Set("volatile", "v", now+60000)
+	d.Set("sooner", "v", now+30000)
+
+	if _, evicted := d.Evict(NoEviction, 10); evicted {
+		t.Error("Expected noeviction to not evict keys")
+	}
+	if key, _ := d.Evict(VolatileTTL, 10); key != "sooner" {
+		t.Error("Expected volatile-ttl to evict 'sooner', got", key)
+	}
+	if key, _ := d.Evict(AllKeysLRU, 10); key != "c" {
+		t.Error("Expected allkeys-lru to evict 'c', got", key)
+	}
+
+	d.objs["a"].freq = 1
+	if key, _ := d.Evict(AllKeysLFU, 10); key != "a" {
+		t.Error("Expected allkeys-lfu to evict 'a', got", key)
+	}
+	if key, _ := d.Evict(VolatileLRU, 10); key != "volatile" {
+		t.Error("Expected volatile-lru to evict 'volatile', got", key)
+	}
+	if _, evicted := d.Evict(VolatileRandom, 10); evicted {
+		t.Error("Expected volatile-random to not evict keys without an expiration")
+	}
+	if d.Size() != 1 || d.Stats().EvictedKeys != 4 {
+		t.Error("Expected 4 evicted keys, got", d.Stats().EvictedKeys)
+	}
+}
+
+func TestObject(t *testing.T) {
+	d := NewDatabase()
+	d.LPush("list", []string{"a"})
+	d.objs["list"].accessedAt -= 5000
+
+	if obj, _ := d.Object("list"); obj.Encoding != "linkedlist" || obj.IdleTime < 5000 || obj.Freq != lfuInitVal {
+		t.Error("Expected other object info, got", obj)
+	}
+	if obj, _ := d.Object("list"); obj.IdleTime < 5000 {
+		t.Error("Expected OBJECT to not record an access")
+	}
+	d.ExpireTime("list")
+	if obj, _ := d.Object("list"); obj.IdleTime < 5000 || obj.Freq != lfuInitVal {
+		t.Error("Expected TTL to not record an access, got", obj)
+	}
+
+	d.LLen("list")
+	if obj, _ := d.Object("list"); obj.IdleTime >= 5000 {
+		t.Error("Expected LLEN to record an access")
+	}
+	if _, found := d.Object("missing"); found {
+		t.Error("Expected missing key to not be found")
+	}
+}
+
+func TestLFUCounter(t *testing.T) {
+	obj := newValueObj("v")
+	now := time.Now().UnixMilli()
+	obj.accessedAt, obj.freq = now, lfuInitVal
+	for i := 0; i < 1000; i++ {
+		obj.touch(now)
+	}
+	if obj.freq <= lfuInitVal || obj.freq > 30 {
+		t.Error("Expected the counter to grow logarithmically, got", obj.freq)
+	}
+
+	freq := uint8(obj.freq)
+	if decayed := obj.decayedFreq(now + 3*lfuDecayTime); decayed != freq-3 {
+		t.Error("Expected the counter to decay by 3, got", decayed)
+	}
+}
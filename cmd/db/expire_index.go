@@ -0,0 +1,132 @@
+package db
+
+import "math/rand"
+
+// Keys that have an expiration ordered by their deadline, so that the expire job only visits
+// keys that are due instead of the whole keyspace. It is a binary heap that also tracks the
+// position of every key, so the expiration of a key can be changed or removed in O(log n).
+type expireIndex struct {
+	entries []expireEntry
+	pos     map[string]int
+}
+
+type expireEntry struct {
+	key string
+	at  int64 // Unix time in milliseconds
+}
+
+func newExpireIndex() *expireIndex {
+	return &expireIndex{pos: make(map[string]int)}
+}
+
+func (x *expireIndex) len() int {
+	return len(x.entries)
+}
+
+// Add a key or change its deadline, a deadline of 0 removes it
+func (x *expireIndex) set(key string, at int64) {
+	if at == 0 {
+		x.remove(key)
+		return
+	}
+
+	idx, found := x.pos[key]
+	if !found {
+		x.entries = append(x.entries, expireEntry{key: key, at: at})
+		idx = len(x.entries) - 1
+		x.pos[key] = idx
+		x.heapifyUp(idx)
+		return
+	}
+
+	prev := x.entries[idx].at
+	x.entries[idx].at = at
+	if at < prev {
+		x.heapifyUp(idx)
+	} else {
+		x.heapifyDown(idx)
+	}
+}
+
+func (x *expireIndex) remove(key string) {
+	idx, found := x.pos[key]
+	if !found {
+		return
+	}
+
+	last := len(x.entries) - 1
+	x.swapEntries(idx, last)
+	x.entries = x.entries[:last]
+	delete(x.pos, key)
+
+	if idx < last {
+		x.heapifyDown(idx)
+		x.heapifyUp(idx)
+	}
+}
+
+// Get the key with the earliest deadline
+func (x *expireIndex) peek() (expireEntry, bool) {
+	if len(x.entries) == 0 {
+		return expireEntry{}, false
+	}
+	return x.entries[0], true
+}
+
+// Get up to n random keys that have an expiration
+func (x *expireIndex) sample(n int) []string {
+	if len(x.entries) == 0 {
+		return nil
+	}
+
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = x.entries[rand.Intn(len(x.entries))].key
+	}
+
+	return keys
+}
+
+func (x *expireIndex) clone() *expireIndex {
+	clone := &expireIndex{entries: append([]expireEntry(nil), x.entries...), pos: make(map[string]int, len(x.pos))}
+	for k, idx := range x.pos {
+		clone.pos[k] = idx
+	}
+
+	return clone
+}
+
+func (x *expireIndex) heapifyUp(idx int) {
+	for idx > 0 {
+		parent := (idx - 1) / 2
+		if x.entries[parent].at <= x.entries[idx].at {
+			return
+		}
+		x.swapEntries(idx, parent)
+		idx = parent
+	}
+}
+
+func (x *expireIndex) heapifyDown(idx int) {
+	for {
+		smallest := idx
+		left, right := 2*idx+1, 2*idx+2
+		if left < len(x.entries) && x.entries[left].at < x.entries[smallest].at {
+			smallest = left
+		}
+		if right < len(x.entries) && x.entries[right].at < x.entries[smallest].at {
+			smallest = right
+		}
+		if smallest == idx {
+			return
+		}
+		x.swapEntries(idx, smallest)
+		idx = smallest
+	}
+}
+
+func (x *expireIndex) swapEntries(i int, j int) {
+	x.entries[i], x.entries[j] = x.entries[j], x.entries[i]
+	x.pos[x.entries[i].key] = i
+	x.pos[x.entries[j].key] = j
+}
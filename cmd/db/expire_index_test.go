@@ -0,0 +1,71 @@
+package db
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpireIndex(t *testing.T) {
+	index := newExpireIndex()
+	deadlines := map[string]int64{}
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(rand.Intn(200))
+		if rand.Intn(4) == 0 {
+			index.remove(key)
+			delete(deadlines, key)
+			continue
+		}
+
+		at := rand.Int63n(10000) + 1
+		index.set(key, at)
+		deadlines[key] = at
+	}
+
+	if index.len() != len(deadlines) {
+		t.Error("Expected", len(deadlines), "keys, got", index.len())
+	}
+
+	var prev int64
+	for index.len() > 0 {
+		entry, _ := index.peek()
+		if entry.at < prev || deadlines[entry.key] != entry.at {
+			t.Fatal("Expected keys in deadline order, got", entry.key, entry.at, "after", prev)
+		}
+		prev = entry.at
+		index.remove(entry.key)
+	}
+}
+
+func TestExpireCycle(t *testing.T) {
+	d := NewDatabase()
+	past := time.Now().UnixMilli() - 1000
+	for i := 0; i < 100; i++ {
+		d.Set("expired:"+strconv.Itoa(i), "v", past)
+	}
+	for i := 0; i < 10; i++ {
+		d.Set("key:"+strconv.Itoa(i), "v", past+60000)
+	}
+	d.Set("persistent", "v", 0)
+
+	if n := d.CleanupExpired(20); n != 20 {
+		t.Error("Expected CLEANUP to stop at its limit, removed", n)
+	}
+	if n, capped := d.ExpireCycle(20, time.Second); n != 80 || capped {
+		t.Error("Expected expire cycle to remove the backlog of expired keys, removed", n)
+	}
+	if d.Size() != 11 || d.VolatileSize() != 10 {
+		t.Error("Expected 11 keys and 10 volatile keys, got", d.Size(), d.VolatileSize())
+	}
+	if stats := d.Stats(); stats.ExpiredKeys != 100 {
+		t.Error("Expected 100 expired keys, got", stats.ExpiredKeys)
+	}
+
+	d.Persist("key:0")
+	d.Set("key:1", "v", 0)
+	d.Del([]string{"key:2"})
+	if d.VolatileSize() != 7 {
+		t.Error("Expected 7 volatile keys, got", d.VolatileSize())
+	}
+}
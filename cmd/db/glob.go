@@ -0,0 +1,140 @@
+package db
+
+import "errors"
+
+var ErrBadPattern = errors.New("ERR invalid pattern, unterminated character class")
+
+// Patterns nested deeper than this never match, it protects against patterns with too many
+// stars
+const maxGlobNesting = 1000
+
+// Check that a pattern can be used with Match(), the only malformed patterns are the ones with
+// a character class that is never closed
+func ValidatePattern(pattern string) error {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '[':
+			i++
+			if i < len(pattern) && pattern[i] == '^' {
+				i++
+			}
+			for ; i < len(pattern) && pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(pattern) {
+				return ErrBadPattern
+			}
+		}
+	}
+
+	return nil
+}
+
+// Match a string against a glob style pattern with the same rules as Redis:
+//   - `*` matches any sequence of characters, including none
+//   - `?` matches a single character
+//   - `[abc]`, `[a-z]` match a single character of the class, `[^abc]` one that is not in it
+//   - `\` escapes the next character, including inside classes
+//
+// Unlike filepath.Match, `/` is an ordinary character.
+// see: https://github.com/redis/redis/blob/unstable/src/util.c
+func Match(pattern string, s string) bool {
+	skipLonger := false
+	return matchGlob(pattern, s, &skipLonger, 0)
+}
+
+func matchGlob(pattern string, s string, skipLonger *bool, nesting int) bool {
+	if nesting > maxGlobNesting {
+		return false
+	}
+
+	p := 0
+	for p < len(pattern) && len(s) > 0 {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for ; len(s) > 0; s = s[1:] {
+				if matchGlob(pattern[p+1:], s, skipLonger, nesting+1) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+			}
+
+			// The rest of the pattern matches nowhere in the rest of the string, so making
+			// an earlier star match more characters can't help either
+			*skipLonger = true
+			return false
+		case '?':
+			s = s[1:]
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+
+			match := false
+			for ; p < len(pattern) && pattern[p] != ']'; p++ {
+				switch {
+				case pattern[p] == '\\' && p+1 < len(pattern):
+					p++
+					if pattern[p] == s[0] {
+						match = true
+					}
+				case p+2 < len(pattern) && pattern[p+1] == '-':
+					start, end := pattern[p], pattern[p+2]
+					if start > end {
+						start, end = end, start
+					}
+					if s[0] >= start && s[0] <= end {
+						match = true
+					}
+					p += 2
+				case pattern[p] == s[0]:
+					match = true
+				}
+			}
+			if p == len(pattern) {
+				// Unterminated classes end with the pattern
+				p--
+			}
+
+			if match == not {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if pattern[p] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+
+		p++
+	}
+
+	// Trailing stars also match the empty string
+	if len(s) == 0 {
+		for p < len(pattern) && pattern[p] == '*' {
+			p++
+		}
+	}
+
+	return p == len(pattern) && len(s) == 0
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "users/1", true},
+		{"users/*", "users/1", true},
+		{"*/1", "users/1", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"key\\", "key\\", true},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxc", false},
+		{"a*", "b", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+
+	for _, test := range tests {
+		if Match(test.pattern, test.s) != test.match {
+			t.Errorf("Expected Match(%q, %q) to be %v", test.pattern, test.s, test.match)
+		}
+	}
+
+	// Patterns with many stars that don't match must not take exponential time
+	if Match(strings.Repeat("*a", 50)+"b", strings.Repeat("a", 100)) {
+		t.Error("Expected pattern with many stars to not match")
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	for _, pattern := range []string{"*", "a[bc]", "[^a-z]*", "\\[", "[\\]]", "a\\"} {
+		if err := ValidatePattern(pattern); err != nil {
+			t.Error("Expected", pattern, "to be valid, got", err)
+		}
+	}
+	for _, pattern := range []string{"[", "a[bc", "[\\]", "[^"} {
+		if err := ValidatePattern(pattern); err != ErrBadPattern {
+			t.Error("Expected", pattern, "to be invalid")
+		}
+	}
+}
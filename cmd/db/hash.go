@@ -0,0 +1,99 @@
+package db
+
+// The Memo equivalent to a Redis Hash data structure, a collection of field-value pairs
+// see: https://redis.io/docs/latest/develop/data-types/hashes/
+type Hash struct {
+	Size  int
+	items map[string]string
+	scan  *scanTable // Fields of items, see: Scan()
+}
+
+func NewHash() *Hash {
+	return &Hash{
+		Size:  0,
+		items: map[string]string{},
+		scan:  newScanTable(),
+	}
+}
+
+func (h *Hash) Get(field string) (string, bool) {
+	value, found := h.items[field]
+	return value, found
+}
+
+// Set the value of a field, returns true if the field did not exist before
+func (h *Hash) Set(field string, value string) bool {
+	_, found := h.items[field]
+	if !found {
+		h.Size++
+		h.scan.add(field)
+	}
+
+	h.items[field] = value
+	return !found
+}
+
+func (h *Hash) Has(field string) bool {
+	_, found := h.items[field]
+	return found
+}
+
+func (h *Hash) Delete(field string) bool {
+	_, found := h.items[field]
+	if !found {
+		return false
+	}
+
+	h.Size--
+	delete(h.items, field)
+	h.scan.remove(field)
+	return true
+}
+
+func (h *Hash) Fields() []string {
+	fields := make([]string, 0, h.Size)
+	for f := range h.items {
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+func (h *Hash) Values() []string {
+	values := make([]string, 0, h.Size)
+	for _, v := range h.items {
+		values = append(values, v)
+	}
+
+	return values
+}
+
+// Get all fields and values as a flat list, eg. [field1, value1, field2, value2]
+func (h *Hash) Items() []string {
+	items := make([]string, 0, h.Size*2)
+	for f, v := range h.items {
+		items = append(items, f, v)
+	}
+
+	return items
+}
+
+// Get the fields and values in the buckets starting from the cursor as a flat list, returns
+// the cursor to continue from or 0 when every field was visited
+func (h *Hash) Scan(cursor uint64, count int) ([]string, uint64) {
+	items := []string{}
+	cursor = h.scan.scan(cursor, count, func(field string) {
+		items = append(items, field, h.items[field])
+	})
+
+	return items, cursor
+}
+
+func (h *Hash) Clone() *Hash {
+	clone := &Hash{Size: h.Size, items: make(map[string]string, len(h.items)), scan: h.scan.clone()}
+	for f, v := range h.items {
+		clone.items[f] = v
+	}
+
+	return clone
+}
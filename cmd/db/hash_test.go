@@ -0,0 +1,41 @@
+package db
+
+import "testing"
+
+func TestHash(t *testing.T) {
+	hash := NewHash()
+
+	if !hash.Set("name", "bill") {
+		t.Error("Expected Set('name') to return true")
+	}
+	hash.Set("age", "22")
+
+	if hash.Set("name", "susan") {
+		t.Error("Expected Set('name') to return false for existing field")
+	}
+	if hash.Size != 2 {
+		t.Error("Expected Size to be 2")
+	}
+	if v, found := hash.Get("name"); !found || v != "susan" {
+		t.Error("Expected Get('name') to return 'susan'")
+	}
+	if _, found := hash.Get("email"); found {
+		t.Error("Expected Get('email') to not be found")
+	}
+	if !hash.Has("age") {
+		t.Error("Expected Has('age') to return true")
+	}
+	if len(hash.Items()) != 4 {
+		t.Error("Expected Items() to return 4 elements")
+	}
+
+	if hash.Delete("email") {
+		t.Error("Expected Delete('email') to return false")
+	}
+	if !hash.Delete("name") {
+		t.Error("Expected Delete('name') to return true")
+	}
+	if hash.Size != 1 {
+		t.Error("Expected Size to be 1")
+	}
+}
@@ -80,3 +80,26 @@ func (l *List) PeekTail() string {
 	}
 	return l.tail.value
 }
+
+// Get all the items of the list from head to tail
+func (l *List) Items() []string {
+	items := make([]string, 0, l.Length)
+	node := l.head
+	for i := 0; i < l.Length; i++ {
+		items = append(items, node.value)
+		node = node.next
+	}
+
+	return items
+}
+
+func (l *List) Clone() *List {
+	clone := NewList()
+	node := l.head
+	for i := 0; i < l.Length; i++ {
+		clone.Append(node.value)
+		node = node.next
+	}
+
+	return clone
+}
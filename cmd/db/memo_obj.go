@@ -1,6 +1,11 @@
 package db
 
-import "time"
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
 
 type MemoObjType = byte
 
@@ -9,6 +14,8 @@ const (
 	ObjPQueue
 	ObjList
 	ObjSet
+	ObjHash
+	ObjZSet
 )
 
 // The base object that is stored in the database, all Memo data structures are a type of
@@ -17,10 +24,46 @@ const (
 type MemoObj struct {
 	Kind      MemoObjType
 	Value     string
-	ExpiresAt int64
+	ExpiresAt int64 // Unix time in milliseconds, 0 if the object never expires
 	PQueue    *PriorityQueue
 	List      *List
 	Set       *Set
+	Hash      *Hash
+	ZSet      *ZSet
+
+	size       int    // Estimated bytes used by the key, see: Database.UsedMemory()
+	accessedAt int64  // Unix time in milliseconds of the last access, see: touch()
+	freq       uint32 // Logarithmic access counter, see: touch()
+}
+
+// Parameters of the LFU counter, with the same defaults as Redis. The counter starts at
+// lfuInitVal, grows slower the higher it is and decreases by one for every lfuDecayTime
+// that the object is not accessed.
+// see: https://redis.io/docs/latest/develop/reference/eviction/#the-new-lfu-mode
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = 60 * 1000 // One minute in milliseconds
+)
+
+// Get the name of a type, used to filter keys by type with SCAN
+func TypeName(kind MemoObjType) string {
+	switch kind {
+	case ObjValue:
+		return "string"
+	case ObjPQueue:
+		return "pqueue"
+	case ObjList:
+		return "list"
+	case ObjSet:
+		return "set"
+	case ObjHash:
+		return "hash"
+	case ObjZSet:
+		return "zset"
+	}
+
+	return "none"
 }
 
 func newValueObj(value string) *MemoObj {
@@ -39,6 +82,14 @@ func newSetObj() *MemoObj {
 	return &MemoObj{Kind: ObjSet, Set: NewSet()}
 }
 
+func newHashObj() *MemoObj {
+	return &MemoObj{Kind: ObjHash, Hash: NewHash()}
+}
+
+func newZSetObj() *MemoObj {
+	return &MemoObj{Kind: ObjZSet, ZSet: NewZSet()}
+}
+
 func (obj *MemoObj) asValue() (string, bool) {
 	return obj.Value, obj.Kind == ObjValue
 }
@@ -55,9 +106,101 @@ func (obj *MemoObj) asSet() (*Set, bool) {
 	return obj.Set, obj.Kind == ObjSet
 }
 
-// Set expiration for object in seconds
-func (obj *MemoObj) ExpireIn(seconds int) {
-	obj.ExpiresAt = time.Now().Unix() + int64(seconds)
+func (obj *MemoObj) asHash() (*Hash, bool) {
+	return obj.Hash, obj.Kind == ObjHash
+}
+
+func (obj *MemoObj) asZSet() (*ZSet, bool) {
+	return obj.ZSet, obj.Kind == ObjZSet
+}
+
+// Create a deep copy of the object
+func (obj *MemoObj) clone() *MemoObj {
+	clone := &MemoObj{Kind: obj.Kind, Value: obj.Value, ExpiresAt: obj.ExpiresAt, size: obj.size, accessedAt: obj.accessedAt, freq: obj.freq}
+	switch obj.Kind {
+	case ObjPQueue:
+		clone.PQueue = obj.PQueue.Clone()
+	case ObjList:
+		clone.List = obj.List.Clone()
+	case ObjSet:
+		clone.Set = obj.Set.Clone()
+	case ObjHash:
+		clone.Hash = obj.Hash.Clone()
+	case ObjZSet:
+		clone.ZSet = obj.ZSet.Clone()
+	}
+
+	return clone
+}
+
+// Get the name of the data structure that holds the value of the object
+func (obj *MemoObj) encoding() string {
+	switch obj.Kind {
+	case ObjValue:
+		return "raw"
+	case ObjPQueue:
+		return "heap"
+	case ObjList:
+		return "linkedlist"
+	case ObjSet, ObjHash:
+		return "hashtable"
+	case ObjZSet:
+		return "skiplist"
+	}
+
+	return "unknown"
+}
+
+// Get the number of elements of a collection, including the reserved and delayed items of
+// priority queues, or the length of a string
+func (obj *MemoObj) length() int {
+	switch obj.Kind {
+	case ObjValue:
+		return len(obj.Value)
+	case ObjPQueue:
+		return obj.PQueue.Length + len(obj.PQueue.leases) + len(obj.PQueue.scheduled)
+	case ObjList:
+		return obj.List.Length
+	case ObjSet:
+		return obj.Set.Size
+	case ObjHash:
+		return obj.Hash.Size
+	case ObjZSet:
+		return obj.ZSet.Size
+	}
+
+	return 0
+}
+
+// Record an access to the object for the LRU and LFU eviction policies. Concurrent readers
+// record accesses atomically, an increment is lost if two of them touch the object at the same
+// time, which is fine for an approximate counter.
+func (obj *MemoObj) touch(now int64) {
+	freq := obj.decayedFreq(now)
+	if freq < math.MaxUint8 {
+		base := max(int(freq)-lfuInitVal, 0)
+		if rand.Float64() < 1/float64(base*lfuLogFactor+1) {
+			freq++
+		}
+	}
+
+	atomic.StoreUint32(&obj.freq, uint32(freq))
+	atomic.StoreInt64(&obj.accessedAt, now)
+}
+
+// Get the unix time in milliseconds of the last access
+func (obj *MemoObj) lastAccess() int64 {
+	return atomic.LoadInt64(&obj.accessedAt)
+}
+
+// Get the LFU counter after decreasing it for the time the object was not accessed
+func (obj *MemoObj) decayedFreq(now int64) uint8 {
+	freq := uint8(atomic.LoadUint32(&obj.freq))
+	periods := (now - obj.lastAccess()) / lfuDecayTime
+	if periods >= int64(freq) {
+		return 0
+	}
+	return freq - uint8(periods)
 }
 
 // Check if object has expired
@@ -0,0 +1,134 @@
+package db
+
+// Number of elements sampled to estimate the size of a collection, see: MemoryUsage()
+const DefaultMemorySamples = 5
+
+// Approximate number of bytes used by the runtime for every key and every element of a
+// collection, in addition to the bytes of their strings. They account for the object and its
+// entries in the key indexes (keyOverhead) and for the map entries, nodes and string headers
+// holding each element.
+const (
+	keyOverhead        = 160
+	listNodeOverhead   = 40
+	setMemberOverhead  = 64
+	hashFieldOverhead  = 64
+	zsetMemberOverhead = 96
+	pqItemOverhead     = 64
+	leaseOverhead      = 160
+)
+
+// Estimate the number of bytes used by a key and its value. The elements of collections are
+// sampled and their average size is multiplied by the number of elements, like MEMORY USAGE
+// does in Redis. A samples count of 0 visits all the elements.
+// see: https://redis.io/docs/latest/commands/memory-usage/
+func (d *Database) MemoryUsage(key string, samples int) (int, bool) {
+	obj, found := d.lookupObj(key)
+	if !found {
+		return 0, found
+	}
+
+	return memoryUsage(key, obj, samples), found
+}
+
+func memoryUsage(key string, obj *MemoObj, samples int) int {
+	size := keyOverhead + len(key)
+	switch obj.Kind {
+	case ObjValue:
+		size += len(obj.Value)
+	case ObjList:
+		size += sampleList(obj.List, samples)
+	case ObjSet:
+		size += sampleMap(obj.Set.items, samples, func(member string, _ bool) int {
+			return setMemberOverhead + len(member)
+		})
+	case ObjHash:
+		size += sampleMap(obj.Hash.items, samples, func(field string, value string) int {
+			return hashFieldOverhead + len(field) + len(value)
+		})
+	case ObjZSet:
+		size += sampleMap(obj.ZSet.scores, samples, func(member string, _ float64) int {
+			return zsetMemberOverhead + len(member)
+		})
+	case ObjPQueue:
+		size += samplePQueue(obj.PQueue, samples)
+	}
+
+	return size
+}
+
+// Multiply the average size of the sampled elements by the number of elements
+func extrapolate(sampled int, visited int, total int) int {
+	if visited == 0 {
+		return 0
+	}
+	return sampled * total / visited
+}
+
+func sampleList(l *List, samples int) int {
+	sampled, visited := 0, 0
+	for node := l.head; visited < l.Length && (samples == 0 || visited < samples); node = node.next {
+		sampled += listNodeOverhead + len(node.value)
+		visited++
+	}
+
+	return extrapolate(sampled, visited, l.Length)
+}
+
+func sampleMap[V any](m map[string]V, samples int, size func(string, V) int) int {
+	sampled, visited := 0, 0
+	for k, v := range m {
+		if samples != 0 && visited == samples {
+			break
+		}
+		sampled += size(k, v)
+		visited++
+	}
+
+	return extrapolate(sampled, visited, len(m))
+}
+
+func samplePQueue(p *PriorityQueue, samples int) int {
+	size := 0
+	for _, items := range [][]pqItem{p.items[:p.Length], p.scheduled} {
+		sampled, visited := 0, 0
+		for _, item := range items {
+			if samples != 0 && visited == samples {
+				break
+			}
+			sampled += pqItemOverhead + len(item.data)
+			visited++
+		}
+		size += extrapolate(sampled, visited, len(items))
+	}
+
+	return size + sampleMap(p.leases, samples, func(id string, lease *Lease) int {
+		return leaseOverhead + len(id) + len(lease.Data)
+	})
+}
+
+// Get the estimated number of bytes used by all the keys. The size of a key is estimated
+// again only after it was accessed, see: getObj()
+func (d *Database) UsedMemory() int {
+	for key := range d.dirty {
+		if obj, found := d.objs[key]; found {
+			size := memoryUsage(key, obj, DefaultMemorySamples)
+			d.used += size - obj.size
+			obj.size = size
+		}
+	}
+	clear(d.dirty)
+
+	return d.used
+}
+
+// Get the estimated number of bytes used by the keys of every type, see: TypeName()
+func (d *Database) MemoryByType() map[string]int {
+	d.UsedMemory()
+
+	usage := map[string]int{}
+	for _, obj := range d.objs {
+		usage[TypeName(obj.Kind)] += obj.size
+	}
+
+	return usage
+}
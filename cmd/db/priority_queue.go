@@ -2,54 +2,112 @@ package db
 
 import (
 	"fmt"
+	"sort"
 	"time"
 )
 
 type pqItem struct {
-	priority   int
+	priority   float64
 	insertedAt int64
+	seq        uint64 // Order the item was added to the queue, used to break ties
 	data       string
+	deliveries int   // Number of times the item was reserved
+	notBefore  int64 // Unix time in milliseconds the item becomes visible, 0 if it is not delayed
 }
 
-func newPqItem(data string, priority int) pqItem {
+func newPqItem(data string, priority float64) pqItem {
 	return pqItem{data: data, priority: priority, insertedAt: time.Now().UnixMilli()}
 }
 
-// Check if an item is of lower priority from another, it first checks the priority
-// and if those are equal it checks the time created.
-func (item *pqItem) isLowerThan(other pqItem) bool {
-	return item.priority < other.priority || item.insertedAt < other.insertedAt
-}
+// The order items of a queue are retrieved by their priority
+type QueueOrder byte
 
-// Check if an item is of higher priority from another, it first checks the priority
-// and if those are equal it checks the time created.
-func (item *pqItem) isHigherThan(other pqItem) bool {
-	return item.priority >= other.priority || item.insertedAt >= other.insertedAt
-}
+const (
+	OrderMin QueueOrder = iota // Lower priorities first
+	OrderMax                   // Higher priorities first
+)
 
 // This Memo data structure has no Redis equivalent, it is an implementation of a
-// priority queue based on a Min Heap. A lower priority means that an item will be retrieved
-// first (eg. an item with priority 1 with be retrieved before an item with priority 2).
-// If the priorities are the same then the item which was creted first will be retrieved.
+// priority queue based on a binary heap. By default a lower priority means that an item will be
+// retrieved first (eg. an item with priority 1 with be retrieved before an item with priority 2),
+// queues with OrderMax retrieve higher priorities first. If the priorities are the same then the
+// item which was added first will be retrieved.
 type PriorityQueue struct {
 	Length int
+	Order  QueueOrder
 	items  []pqItem
+	seq    uint64            // Sequence number of the next item
+	leases map[string]*Lease // Reserved items by lease id
+
+	// Delayed items ordered by the time they become visible, they are moved to the heap
+	// with Promote()
+	scheduled []pqItem
+
+	// Items delivered this many times are moved to the dead letter queue instead of being
+	// requeued, 0 for no limit
+	MaxDeliveries int
+	DeadLetter    string
+
+	created bool // Created with QCREATE, the queue is kept when it has no items
+}
+
+// An item reserved by a consumer, it has to be acknowledged before the lease expires or it
+// is delivered again
+type Lease struct {
+	Id         string
+	Data       string
+	Priority   float64
+	Deliveries int
+	ExpiresAt  int64 // Unix time in milliseconds
+	insertedAt int64
+	seq        uint64
+}
+
+// An item of a queue as seen by clients, times are unix times in milliseconds
+type QueueItem struct {
+	Data       string
+	Priority   float64
+	InsertedAt int64
+	NotBefore  int64 // Only set for delayed items
 }
 
 func NewPriorityQueue() *PriorityQueue {
-	return &PriorityQueue{}
+	return &PriorityQueue{leases: map[string]*Lease{}}
 }
 
 func (p *PriorityQueue) Debug() {
 	for i, v := range p.items {
-		fmt.Printf("%d  { v: %s, p: %d, t: %d } \n", i, v.data, v.priority, v.insertedAt)
+		fmt.Printf("%d  { v: %s, p: %g, t: %d, s: %d } \n", i, v.data, v.priority, v.insertedAt, v.seq)
 	}
 }
 
-func (p *PriorityQueue) Enqueue(data string, priority int) {
-	p.items = append(p.items, newPqItem(data, priority))
-	p.heapifyUp(p.Length)
-	p.Length++
+func (p *PriorityQueue) Enqueue(data string, priority float64) {
+	p.enqueueItem(p.newItem(data, priority))
+}
+
+// Create an item that is placed after the items of the same priority already in the queue
+func (p *PriorityQueue) newItem(data string, priority float64) pqItem {
+	item := newPqItem(data, priority)
+	item.seq = p.nextSeq()
+	return item
+}
+
+func (p *PriorityQueue) nextSeq() uint64 {
+	seq := p.seq
+	p.seq++
+	return seq
+}
+
+// Check if an item is retrieved before another, it first checks the priority and if those
+// are equal it checks the order they were added.
+func (p *PriorityQueue) before(item pqItem, other pqItem) bool {
+	if item.priority != other.priority {
+		if p.Order == OrderMax {
+			return item.priority > other.priority
+		}
+		return item.priority < other.priority
+	}
+	return item.seq < other.seq
 }
 
 func (p *PriorityQueue) Dequeue() string {
@@ -57,16 +115,239 @@ func (p *PriorityQueue) Dequeue() string {
 		return ""
 	}
 
+	return p.dequeueItem().data
+}
+
+func (p *PriorityQueue) dequeueItem() pqItem {
 	out := p.items[0]
 	p.Length--
 	if p.Length == 0 {
 		p.items = []pqItem{}
-		return out.data
+		return out
 	}
 
 	p.items[0] = p.items[p.Length]
+	p.items = p.items[:p.Length]
 	p.heapifyDown(0)
-	return out.data
+	return out
+}
+
+// Add an item keeping its insertion time and deliveries
+func (p *PriorityQueue) enqueueItem(item pqItem) {
+	p.items = append(p.items, item)
+	p.heapifyUp(p.Length)
+	p.Length++
+}
+
+// Move the next item to the reserved items under the given lease id
+func (p *PriorityQueue) Reserve(id string, expiresAt int64) (*Lease, bool) {
+	if p.Length == 0 {
+		return nil, false
+	}
+
+	item := p.dequeueItem()
+	lease := &Lease{
+		Id:         id,
+		Data:       item.data,
+		Priority:   item.priority,
+		Deliveries: item.deliveries + 1,
+		ExpiresAt:  expiresAt,
+		insertedAt: item.insertedAt,
+		seq:        item.seq,
+	}
+	p.leases[id] = lease
+
+	return lease, true
+}
+
+// Remove a reserved item, returns false if there is no such lease
+func (p *PriorityQueue) Release(id string) (*Lease, bool) {
+	lease, found := p.leases[id]
+	if found {
+		delete(p.leases, id)
+	}
+
+	return lease, found
+}
+
+// Put a released item back to the queue, it keeps its place among items of the same priority
+func (p *PriorityQueue) Requeue(lease *Lease) {
+	p.enqueueItem(pqItem{
+		priority:   lease.Priority,
+		insertedAt: lease.insertedAt,
+		seq:        lease.seq,
+		data:       lease.Data,
+		deliveries: lease.Deliveries,
+	})
+}
+
+// Add an item that is not visible until the given time
+func (p *PriorityQueue) Schedule(data string, priority float64, notBefore int64) {
+	item := newPqItem(data, priority)
+	item.notBefore = notBefore
+	p.scheduleItem(item)
+}
+
+// Items with the same time keep the order they were added
+func (p *PriorityQueue) scheduleItem(item pqItem) {
+	idx := sort.Search(len(p.scheduled), func(i int) bool {
+		return p.scheduled[i].notBefore > item.notBefore
+	})
+	p.scheduled = append(p.scheduled, pqItem{})
+	copy(p.scheduled[idx+1:], p.scheduled[idx:])
+	p.scheduled[idx] = item
+}
+
+// Get the number of delayed items that are visible at the given time
+func (p *PriorityQueue) Due(now int64) int {
+	return sort.Search(len(p.scheduled), func(i int) bool {
+		return p.scheduled[i].notBefore > now
+	})
+}
+
+// Move the delayed items that are visible at the given time to the queue, they are placed after
+// the items of the same priority already in the queue. Returns the number of items moved.
+func (p *PriorityQueue) Promote(now int64) int {
+	due := p.Due(now)
+	for _, item := range p.scheduled[:due] {
+		item.notBefore = 0
+		item.seq = p.nextSeq()
+		p.enqueueItem(item)
+	}
+	p.scheduled = p.scheduled[due:]
+
+	return due
+}
+
+// Get the delayed items ordered by the time they become visible
+func (p *PriorityQueue) Scheduled() []QueueItem {
+	items := make([]QueueItem, len(p.scheduled))
+	for i, item := range p.scheduled {
+		items[i] = item.view()
+	}
+
+	return items
+}
+
+func (item *pqItem) view() QueueItem {
+	return QueueItem{Data: item.data, Priority: item.priority, InsertedAt: item.insertedAt, NotBefore: item.notBefore}
+}
+
+// Get the items in the order they would be dequeued
+func (p *PriorityQueue) sortedItems() []pqItem {
+	items := make([]pqItem, p.Length)
+	copy(items, p.items[:p.Length])
+	sort.Slice(items, func(i, j int) bool {
+		return p.before(items[i], items[j])
+	})
+
+	return items
+}
+
+// Get the items from start to stop in the order they would be dequeued, negative indexes
+// count from the last item
+func (p *PriorityQueue) Range(start int, stop int) []QueueItem {
+	if start < 0 {
+		start += p.Length
+	}
+	if stop < 0 {
+		stop += p.Length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= p.Length {
+		stop = p.Length - 1
+	}
+	if start > stop {
+		return []QueueItem{}
+	}
+
+	sorted := p.sortedItems()
+	items := make([]QueueItem, 0, stop-start+1)
+	for _, item := range sorted[start : stop+1] {
+		items = append(items, item.view())
+	}
+
+	return items
+}
+
+// Remove all the items with the given data, including delayed items. Returns the number of
+// items removed.
+func (p *PriorityQueue) Remove(data string) int {
+	removed := 0
+	items := p.items[:0]
+	for _, item := range p.items[:p.Length] {
+		if item.data == data {
+			removed++
+			continue
+		}
+		items = append(items, item)
+	}
+	p.items = items
+	p.Length = len(items)
+
+	scheduled := p.scheduled[:0]
+	for _, item := range p.scheduled {
+		if item.data == data {
+			removed++
+			continue
+		}
+		scheduled = append(scheduled, item)
+	}
+	p.scheduled = scheduled
+
+	if removed > 0 {
+		p.heapify()
+	}
+
+	return removed
+}
+
+// Change the priority of all the items with the given data, including delayed items. The
+// items keep their insertion time. Returns the number of items updated.
+func (p *PriorityQueue) Update(data string, priority float64) int {
+	updated := 0
+	for i := range p.items[:p.Length] {
+		if p.items[i].data == data {
+			p.items[i].priority = priority
+			updated++
+		}
+	}
+	for i := range p.scheduled {
+		if p.scheduled[i].data == data {
+			p.scheduled[i].priority = priority
+			updated++
+		}
+	}
+
+	if updated > 0 {
+		p.heapify()
+	}
+
+	return updated
+}
+
+// Get the reserved items ordered by expiration time
+func (p *PriorityQueue) Leases() []*Lease {
+	leases := make([]*Lease, 0, len(p.leases))
+	for _, lease := range p.leases {
+		leases = append(leases, lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].ExpiresAt != leases[j].ExpiresAt {
+			return leases[i].ExpiresAt < leases[j].ExpiresAt
+		}
+		return leases[i].Id < leases[j].Id
+	})
+
+	return leases
+}
+
+// A queue can be removed when it has no items, no reserved or delayed items, no configuration
+// and it was not created explicitly
+func (p *PriorityQueue) isEmpty() bool {
+	return p.Length == 0 && len(p.leases) == 0 && len(p.scheduled) == 0 && p.MaxDeliveries == 0 && !p.created
 }
 
 func (p *PriorityQueue) Peek() string {
@@ -77,6 +358,52 @@ func (p *PriorityQueue) Peek() string {
 	return p.items[0].data
 }
 
+func (p *PriorityQueue) Clone() *PriorityQueue {
+	clone := &PriorityQueue{
+		Length:        p.Length,
+		Order:         p.Order,
+		seq:           p.seq,
+		items:         make([]pqItem, p.Length),
+		leases:        make(map[string]*Lease, len(p.leases)),
+		scheduled:     make([]pqItem, len(p.scheduled)),
+		MaxDeliveries: p.MaxDeliveries,
+		DeadLetter:    p.DeadLetter,
+		created:       p.created,
+	}
+	copy(clone.items, p.items[:p.Length])
+	copy(clone.scheduled, p.scheduled)
+	for id, lease := range p.leases {
+		l := *lease
+		clone.leases[id] = &l
+	}
+
+	return clone
+}
+
+// Number the items of a queue loaded from a snapshot that had no sequence numbers, following
+// their insertion time. Such snapshots only have queues with OrderMin.
+func (p *PriorityQueue) resequence() {
+	sort.SliceStable(p.items, func(i, j int) bool {
+		if p.items[i].priority != p.items[j].priority {
+			return p.items[i].priority < p.items[j].priority
+		}
+		return p.items[i].insertedAt < p.items[j].insertedAt
+	})
+	for i := range p.items {
+		p.items[i].seq = p.nextSeq()
+	}
+	for _, lease := range p.Leases() {
+		lease.seq = p.nextSeq()
+	}
+}
+
+// Restore the heap after items were changed in place
+func (p *PriorityQueue) heapify() {
+	for i := p.Length/2 - 1; i >= 0; i-- {
+		p.heapifyDown(i)
+	}
+}
+
 // Move up to the correct position in the heap
 func (p *PriorityQueue) heapifyUp(idx int) {
 	if idx == 0 {
@@ -86,7 +413,7 @@ func (p *PriorityQueue) heapifyUp(idx int) {
 	pIdx := p.parent(idx)
 	parent := p.items[pIdx]
 	current := p.items[idx]
-	if current.isLowerThan(parent) {
+	if p.before(current, parent) {
 		p.swapItems(idx, pIdx)
 		p.heapifyUp(pIdx)
 	}
@@ -104,16 +431,15 @@ func (p *PriorityQueue) heapifyDown(idx int) {
 		return
 	}
 
-	current := p.items[idx]
-	left := p.items[lIdx]
-	right := p.items[rIdx]
-
-	if right.isLowerThan(left) && right.isLowerThan(current) {
-		p.swapItems(idx, rIdx)
-		p.heapifyDown(rIdx)
-	} else if right.isHigherThan(left) && left.isLowerThan(current) {
-		p.swapItems(idx, lIdx)
-		p.heapifyDown(lIdx)
+	// Swap with the child that is retrieved first if it goes before the current item
+	child := lIdx
+	if rIdx < p.Length && p.before(p.items[rIdx], p.items[lIdx]) {
+		child = rIdx
+	}
+
+	if p.before(p.items[child], p.items[idx]) {
+		p.swapItems(idx, child)
+		p.heapifyDown(child)
 	}
 }
 
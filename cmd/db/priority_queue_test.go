@@ -1,6 +1,9 @@
 package db
 
-import "testing"
+import (
+	"strconv"
+	"testing"
+)
 
 func TestPriorityQueue(t *testing.T) {
 	pq := NewPriorityQueue()
@@ -65,3 +68,117 @@ func TestPriorityQueue(t *testing.T) {
 		t.Error("Expected Dequeue() to return 3")
 	}
 }
+
+func TestPriorityQueueReserve(t *testing.T) {
+	pq := NewPriorityQueue()
+	pq.Enqueue("1", 1)
+	pq.Enqueue("2", 2)
+
+	lease, ok := pq.Reserve("a", 1000)
+	if !ok || lease.Data != "1" || lease.Deliveries != 1 {
+		t.Error("Expected Reserve() to return the first item, got", lease)
+	}
+	if pq.Length != 1 || pq.isEmpty() {
+		t.Error("Expected reserved item to not be counted in Length but keep the queue")
+	}
+
+	pq.Enqueue("3", 3)
+	released, ok := pq.Release("a")
+	if !ok || released != lease {
+		t.Error("Expected Release('a') to return the lease")
+	}
+	if _, ok := pq.Release("a"); ok {
+		t.Error("Expected Release('a') to only succeed once")
+	}
+
+	pq.Requeue(released)
+	if lease, _ = pq.Reserve("b", 1000); lease.Data != "1" || lease.Deliveries != 2 {
+		t.Error("Expected requeued item to be reserved again, got", lease)
+	}
+	if pq.Dequeue() != "2" || pq.Dequeue() != "3" {
+		t.Error("Expected remaining items to be dequeued in order")
+	}
+}
+
+func TestPriorityQueueSchedule(t *testing.T) {
+	pq := NewPriorityQueue()
+	pq.Schedule("late", 1, 2000)
+	pq.Schedule("early", 2, 1000)
+	pq.Schedule("also early", 1, 1000)
+
+	if pq.Length != 0 || pq.Peek() != "" || pq.isEmpty() {
+		t.Error("Expected delayed items to not be visible but keep the queue")
+	}
+	if pq.Due(999) != 0 || pq.Due(1000) != 2 || pq.Due(5000) != 3 {
+		t.Error("Expected other number of due items")
+	}
+
+	scheduled := pq.Scheduled()
+	if len(scheduled) != 3 || scheduled[0].Data != "early" || scheduled[1].Data != "also early" || scheduled[2].NotBefore != 2000 {
+		t.Error("Expected delayed items ordered by time, got", scheduled)
+	}
+
+	if promoted := pq.Promote(1500); promoted != 2 || pq.Length != 2 {
+		t.Error("Expected 2 items to be promoted, got", promoted)
+	}
+	if pq.Dequeue() != "also early" || pq.Dequeue() != "early" || pq.Dequeue() != "" {
+		t.Error("Expected promoted items to be dequeued by priority")
+	}
+	if pq.Promote(2000) != 1 || pq.Dequeue() != "late" || !pq.isEmpty() {
+		t.Error("Expected last item to be promoted")
+	}
+}
+
+func TestPriorityQueueManage(t *testing.T) {
+	pq := NewPriorityQueue()
+	pq.Enqueue("a", 3)
+	pq.Enqueue("b", 1)
+	pq.Enqueue("c", 2)
+	pq.Enqueue("b", 4)
+	pq.Schedule("b", 1, 1000)
+
+	items := pq.Range(0, -1)
+	if len(items) != 4 || items[0].Data != "b" || items[1].Data != "c" || items[2].Data != "a" || items[3].Priority != 4 {
+		t.Error("Expected items in dequeue order, got", items)
+	}
+	if items = pq.Range(-2, 10); len(items) != 2 || items[0].Data != "a" {
+		t.Error("Expected last 2 items, got", items)
+	}
+	if items = pq.Range(3, 1); len(items) != 0 {
+		t.Error("Expected empty range, got", items)
+	}
+
+	if updated := pq.Update("a", 0); updated != 1 || pq.Peek() != "a" {
+		t.Error("Expected 'a' to be moved to the front")
+	}
+	if removed := pq.Remove("b"); removed != 3 || pq.Length != 2 || len(pq.Scheduled()) != 0 {
+		t.Error("Expected all 'b' items to be removed, got", removed)
+	}
+	if pq.Dequeue() != "a" || pq.Dequeue() != "c" || !pq.isEmpty() {
+		t.Error("Expected remaining items to be dequeued in order")
+	}
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	pq := NewPriorityQueue()
+	pq.Order = OrderMax
+	for i := 0; i < 100; i++ {
+		pq.Enqueue(strconv.Itoa(i), 1)
+	}
+	pq.Enqueue("high", 1.5)
+	pq.Enqueue("low", -1)
+
+	if pq.Dequeue() != "high" {
+		t.Error("Expected Dequeue() to return the highest priority first")
+	}
+	// Items added in the same millisecond are still dequeued in the order they were added
+	for i := 0; i < 100; i++ {
+		if v := pq.Dequeue(); v != strconv.Itoa(i) {
+			t.Error("Expected Dequeue() to return", i, "got", v)
+			break
+		}
+	}
+	if pq.Dequeue() != "low" {
+		t.Error("Expected Dequeue() to return the lowest priority last")
+	}
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+const scanMinBuckets = 4
+
+var scanSeed = maphash.MakeSeed()
+
+// A set of strings that can be iterated with a cursor while it is modified, it is used by SCAN
+// and SSCAN. Strings are spread in buckets by their hash and the number of buckets grows and
+// shrinks with the number of strings. Like the Redis dict, the cursor is advanced by
+// incrementing its reversed bits, so every string present for the whole iteration is returned
+// at least once even if the table is resized between calls. Strings can be returned more than
+// once if the table shrinks.
+// see: https://github.com/redis/redis/blob/unstable/src/dict.c
+type scanTable struct {
+	buckets [][]string
+	size    int
+}
+
+func newScanTable() *scanTable {
+	return &scanTable{buckets: make([][]string, scanMinBuckets)}
+}
+
+func scanHash(s string) uint64 {
+	return maphash.String(scanSeed, s)
+}
+
+func (t *scanTable) mask() uint64 {
+	return uint64(len(t.buckets) - 1)
+}
+
+// Add a string, it must not be in the table already
+func (t *scanTable) add(s string) {
+	idx := scanHash(s) & t.mask()
+	t.buckets[idx] = append(t.buckets[idx], s)
+	t.size++
+
+	if t.size > 2*len(t.buckets) {
+		t.resize(2 * len(t.buckets))
+	}
+}
+
+func (t *scanTable) remove(s string) {
+	idx := scanHash(s) & t.mask()
+	bucket := t.buckets[idx]
+	for i := range bucket {
+		if bucket[i] == s {
+			bucket[i] = bucket[len(bucket)-1]
+			t.buckets[idx] = bucket[:len(bucket)-1]
+			t.size--
+			break
+		}
+	}
+
+	if len(t.buckets) > scanMinBuckets && t.size < len(t.buckets)/8 {
+		t.resize(len(t.buckets) / 2)
+	}
+}
+
+func (t *scanTable) resize(n int) {
+	buckets := make([][]string, n)
+	mask := uint64(n - 1)
+	for _, bucket := range t.buckets {
+		for _, s := range bucket {
+			idx := scanHash(s) & mask
+			buckets[idx] = append(buckets[idx], s)
+		}
+	}
+	t.buckets = buckets
+}
+
+// Visit whole buckets starting from the cursor until at least count strings are visited,
+// returns the cursor to continue from or 0 if the iteration is complete. Empty buckets also
+// count towards the work done, so a call returns in bounded time on a sparse table.
+func (t *scanTable) scan(cursor uint64, count int, fn func(string)) uint64 {
+	mask := t.mask()
+	visited := 0
+	for steps := 0; steps < count*10; steps++ {
+		for _, s := range t.buckets[cursor&mask] {
+			fn(s)
+			visited++
+		}
+
+		// Set the bits above the mask so that incrementing the reversed cursor carries
+		// over them
+		cursor |= ^mask
+		cursor = bits.Reverse64(bits.Reverse64(cursor) + 1)
+		if cursor == 0 || visited >= count {
+			break
+		}
+	}
+
+	return cursor
+}
+
+func (t *scanTable) clone() *scanTable {
+	clone := &scanTable{buckets: make([][]string, len(t.buckets)), size: t.size}
+	for i, bucket := range t.buckets {
+		clone.buckets[i] = append([]string(nil), bucket...)
+	}
+
+	return clone
+}
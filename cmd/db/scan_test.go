@@ -0,0 +1,134 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+)
+
+func scanAll(t *scanTable, count int, between func()) map[string]int {
+	seen := map[string]int{}
+	cursor := uint64(0)
+	for {
+		cursor = t.scan(cursor, count, func(s string) {
+			seen[s]++
+		})
+		if cursor == 0 {
+			return seen
+		}
+		between()
+	}
+}
+
+func TestScanTable(t *testing.T) {
+	table := newScanTable()
+	for i := 0; i < 1000; i++ {
+		table.add(strconv.Itoa(i))
+	}
+
+	seen := scanAll(table, 10, func() {})
+	if len(seen) != 1000 {
+		t.Error("Expected every string to be returned, got", len(seen))
+	}
+	for s, n := range seen {
+		if n != 1 {
+			t.Error("Expected", s, "to be returned once without resizing, got", n)
+		}
+	}
+
+	// Grow the table during the scan
+	added := 1000
+	seen = scanAll(table, 10, func() {
+		for i := 0; i < 100 && added < 10000; i++ {
+			table.add(strconv.Itoa(added))
+			added++
+		}
+	})
+	for i := 0; i < 1000; i++ {
+		if seen[strconv.Itoa(i)] == 0 {
+			t.Error("Expected", i, "to be returned while the table grows")
+		}
+	}
+
+	// Shrink the table during the scan, the first 100 strings are kept
+	removed := added
+	seen = scanAll(table, 10, func() {
+		for i := 0; i < 200 && removed > 100; i++ {
+			removed--
+			table.remove(strconv.Itoa(removed))
+		}
+	})
+	for i := 0; i < 100; i++ {
+		if seen[strconv.Itoa(i)] == 0 {
+			t.Error("Expected", i, "to be returned while the table shrinks")
+		}
+	}
+	if table.size != 100 || len(table.buckets) >= 1024 {
+		t.Error("Expected the table to shrink, got", len(table.buckets), "buckets")
+	}
+}
+
+func TestScan(t *testing.T) {
+	d := NewDatabase()
+	for i := 0; i < 50; i++ {
+		d.Set("key:"+strconv.Itoa(i), "v", 0)
+	}
+	d.SetAdd("set", []string{"a", "b", "c"})
+	d.Set("expired", "v", 0)
+	d.objs["expired"].ExpiresAt = 1
+
+	seen := map[string]bool{}
+	cursor := uint64(0)
+	for {
+		var keys []string
+		keys, cursor = d.Scan(cursor, 5, "*", "")
+		for _, key := range keys {
+			seen[key] = true
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(seen) != 51 || seen["expired"] {
+		t.Error("Expected every key that has not expired to be returned, got", len(seen))
+	}
+
+	if keys, _ := d.Scan(0, 1000, "key:1*", "string"); len(keys) != 11 {
+		t.Error("Expected 11 keys to match 'key:1*', got", keys)
+	}
+	if keys, _ := d.Scan(0, 1000, "*", "set"); len(keys) != 1 || keys[0] != "set" {
+		t.Error("Expected only 'set' to be of type set, got", keys)
+	}
+
+	members, cursor, _ := d.SScan("set", 0, 10, "[ab]")
+	if len(members) != 2 || cursor != 0 {
+		t.Error("Expected 2 members to match '[ab]', got", members)
+	}
+	if _, _, err := d.SScan("key:1", 0, 10, "*"); err != ErrWrongType {
+		t.Error("Expected SScan() of a string to return", ErrWrongType)
+	}
+
+	for i := 0; i < 100; i++ {
+		d.HSet("hash", []string{"f" + strconv.Itoa(i), strconv.Itoa(i)})
+	}
+	fields := map[string]string{}
+	calls := 0
+	for cursor = 0; ; calls++ {
+		var items []string
+		items, cursor, _ = d.HScan("hash", cursor, 10, "*")
+		for i := 0; i < len(items); i += 2 {
+			fields[items[i]] = items[i+1]
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(fields) != 100 || fields["f42"] != "42" || calls < 5 {
+		t.Error("Expected every field to be returned in several calls, got", len(fields), "fields in", calls+1, "calls")
+	}
+	if items, _, _ := d.HScan("hash", 0, 1000, "f1?"); len(items) != 20 {
+		t.Error("Expected 10 fields to match 'f1?', got", items)
+	}
+	if _, _, err := d.HScan("set", 0, 10, "*"); err != ErrWrongType {
+		t.Error("Expected HScan() of a set to return", ErrWrongType)
+	}
+}
@@ -5,12 +5,14 @@ package db
 type Set struct {
 	Size  int
 	items map[string]bool
+	scan  *scanTable // Members of items, see: Scan()
 }
 
 func NewSet() *Set {
 	return &Set{
 		Size:  0,
 		items: map[string]bool{},
+		scan:  newScanTable(),
 	}
 }
 
@@ -29,6 +31,7 @@ func (s *Set) Add(item string) {
 	_, found := s.items[item]
 	if !found {
 		s.Size++
+		s.scan.add(item)
 	}
 
 	s.items[item] = true
@@ -46,5 +49,26 @@ func (s *Set) Delete(key string) bool {
 
 	s.Size--
 	delete(s.items, key)
+	s.scan.remove(key)
 	return true
 }
+
+// Get the members in the buckets starting from the cursor, returns the cursor to continue from
+// or 0 when every member was visited
+func (s *Set) Scan(cursor uint64, count int) ([]string, uint64) {
+	members := []string{}
+	cursor = s.scan.scan(cursor, count, func(member string) {
+		members = append(members, member)
+	})
+
+	return members, cursor
+}
+
+func (s *Set) Clone() *Set {
+	clone := &Set{Size: s.Size, items: make(map[string]bool, len(s.items)), scan: s.scan.clone()}
+	for k, v := range s.items {
+		clone.items[k] = v
+	}
+
+	return clone
+}
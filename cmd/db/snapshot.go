@@ -0,0 +1,565 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Snapshots are a compact binary representation of the whole keyspace, the layout is:
+//
+//	"MEMO" <version byte> <aux fields> <object>... <eof byte> <crc32 of everything before it>
+//
+// where every object is written as <kind byte> <key> <expiresAt> <payload>. Strings are
+// prefixed by their length as an uvarint, integers are written as varints and floats as their
+// big endian IEEE 754 representation. Aux fields are string pairs prefixed by their count, they
+// carry information about the snapshot rather than the keyspace.
+//
+// Version 2 added the delivery count of queue items, the queue configuration and the reserved
+// items of queues. Version 3 added the delayed items of queues. Version 4 changed queue
+// priorities to floats and added the sequence numbers and the order of queues. Version 5 added
+// the aux fields. Older snapshots can still be read.
+const snapshotMagic = "MEMO"
+const snapshotVersion = 5
+const snapshotEOF = 0xff
+
+var ErrBadSnapshot = errors.New("invalid or corrupted snapshot")
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (sw *snapshotWriter) write(b []byte) {
+	if sw.err != nil {
+		return
+	}
+	sw.crc.Write(b)
+	_, sw.err = sw.w.Write(b)
+}
+
+func (sw *snapshotWriter) writeByte(b byte) {
+	sw.write([]byte{b})
+}
+
+func (sw *snapshotWriter) writeInt(n int64) {
+	l := binary.PutVarint(sw.buf[:], n)
+	sw.write(sw.buf[:l])
+}
+
+func (sw *snapshotWriter) writeFloat(f float64) {
+	binary.BigEndian.PutUint64(sw.buf[:8], math.Float64bits(f))
+	sw.write(sw.buf[:8])
+}
+
+func (sw *snapshotWriter) writeLen(n int) {
+	l := binary.PutUvarint(sw.buf[:], uint64(n))
+	sw.write(sw.buf[:l])
+}
+
+func (sw *snapshotWriter) writeString(s string) {
+	sw.writeLen(len(s))
+	sw.write([]byte(s))
+}
+
+func (sw *snapshotWriter) writeObj(key string, obj *MemoObj) {
+	sw.writeByte(obj.Kind)
+	sw.writeString(key)
+	sw.writeInt(obj.ExpiresAt)
+
+	switch obj.Kind {
+	case ObjValue:
+		sw.writeString(obj.Value)
+	case ObjList:
+		items := obj.List.Items()
+		sw.writeLen(len(items))
+		for _, item := range items {
+			sw.writeString(item)
+		}
+	case ObjSet:
+		items := obj.Set.Items()
+		sw.writeLen(len(items))
+		for _, item := range items {
+			sw.writeString(item)
+		}
+	case ObjHash:
+		items := obj.Hash.Items()
+		sw.writeLen(len(items))
+		for _, item := range items {
+			sw.writeString(item)
+		}
+	case ObjZSet:
+		items := obj.ZSet.Items()
+		sw.writeLen(len(items))
+		for _, item := range items {
+			sw.writeString(item.Member)
+			sw.writeFloat(item.Score)
+		}
+	case ObjPQueue:
+		sw.writeLen(obj.PQueue.Length)
+		for _, item := range obj.PQueue.items[:obj.PQueue.Length] {
+			sw.writeFloat(item.priority)
+			sw.writeInt(item.insertedAt)
+			sw.writeString(item.data)
+			sw.writeInt(int64(item.deliveries))
+			sw.writeInt(int64(item.seq))
+		}
+
+		sw.writeInt(int64(obj.PQueue.MaxDeliveries))
+		sw.writeString(obj.PQueue.DeadLetter)
+		leases := obj.PQueue.Leases()
+		sw.writeLen(len(leases))
+		for _, lease := range leases {
+			sw.writeString(lease.Id)
+			sw.writeFloat(lease.Priority)
+			sw.writeInt(lease.insertedAt)
+			sw.writeString(lease.Data)
+			sw.writeInt(int64(lease.Deliveries))
+			sw.writeInt(lease.ExpiresAt)
+			sw.writeInt(int64(lease.seq))
+		}
+
+		sw.writeLen(len(obj.PQueue.scheduled))
+		for _, item := range obj.PQueue.scheduled {
+			sw.writeFloat(item.priority)
+			sw.writeInt(item.insertedAt)
+			sw.writeString(item.data)
+			sw.writeInt(item.notBefore)
+		}
+
+		created := byte(0)
+		if obj.PQueue.created {
+			created = 1
+		}
+		sw.writeByte(byte(obj.PQueue.Order))
+		sw.writeByte(created)
+		sw.writeInt(int64(obj.PQueue.seq))
+	}
+}
+
+// Write a snapshot of all the keys that have not expired yet, aux can be nil
+func (d *Database) WriteSnapshot(w io.Writer, aux map[string]string) error {
+	sw := &snapshotWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+
+	sw.write([]byte(snapshotMagic))
+	sw.writeByte(snapshotVersion)
+	sw.writeLen(len(aux))
+	for k, v := range aux {
+		sw.writeString(k)
+		sw.writeString(v)
+	}
+	for k, obj := range d.objs {
+		if obj.hasExpired() {
+			continue
+		}
+		sw.writeObj(k, obj)
+	}
+	sw.writeByte(snapshotEOF)
+
+	if sw.err != nil {
+		return sw.err
+	}
+
+	// The checksum itself is not part of the checksum
+	binary.BigEndian.PutUint32(sw.buf[:4], sw.crc.Sum32())
+	if _, err := sw.w.Write(sw.buf[:4]); err != nil {
+		return err
+	}
+
+	return sw.w.Flush()
+}
+
+type snapshotReader struct {
+	r       *bufio.Reader
+	crc     hash.Hash32
+	version byte
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	sr.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (sr *snapshotReader) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		return nil, err
+	}
+	sr.crc.Write(b)
+	return b, nil
+}
+
+func (sr *snapshotReader) readInt() (int64, error) {
+	return binary.ReadVarint(sr)
+}
+
+func (sr *snapshotReader) readFloat() (float64, error) {
+	b, err := sr.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+}
+
+func (sr *snapshotReader) readLen() (int, error) {
+	n, err := binary.ReadUvarint(sr)
+	return int(n), err
+}
+
+func (sr *snapshotReader) readString() (string, error) {
+	n, err := sr.readLen()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := sr.read(n)
+	return string(b), err
+}
+
+func (sr *snapshotReader) readStrings() ([]string, error) {
+	n, err := sr.readLen()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]string, n)
+	for i := 0; i < n; i++ {
+		items[i], err = sr.readString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+func (sr *snapshotReader) readObj(kind MemoObjType) (*MemoObj, error) {
+	var obj *MemoObj
+	switch kind {
+	case ObjValue:
+		value, err := sr.readString()
+		if err != nil {
+			return nil, err
+		}
+		obj = newValueObj(value)
+	case ObjList:
+		items, err := sr.readStrings()
+		if err != nil {
+			return nil, err
+		}
+		obj = newListObj()
+		for _, item := range items {
+			obj.List.Append(item)
+		}
+	case ObjSet:
+		items, err := sr.readStrings()
+		if err != nil {
+			return nil, err
+		}
+		obj = newSetObj()
+		for _, item := range items {
+			obj.Set.Add(item)
+		}
+	case ObjHash:
+		items, err := sr.readStrings()
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%2 != 0 {
+			return nil, ErrBadSnapshot
+		}
+		obj = newHashObj()
+		for i := 0; i < len(items); i += 2 {
+			obj.Hash.Set(items[i], items[i+1])
+		}
+	case ObjZSet:
+		n, err := sr.readLen()
+		if err != nil {
+			return nil, err
+		}
+
+		obj = newZSetObj()
+		for i := 0; i < n; i++ {
+			member, err := sr.readString()
+			if err != nil {
+				return nil, err
+			}
+			score, err := sr.readFloat()
+			if err != nil {
+				return nil, err
+			}
+			obj.ZSet.Add(member, score)
+		}
+	case ObjPQueue:
+		n, err := sr.readLen()
+		if err != nil {
+			return nil, err
+		}
+
+		// Items are stored in heap order so they can be loaded as they are
+		obj = newPQueueObj()
+		for i := 0; i < n; i++ {
+			priority, err := sr.readPriority()
+			if err != nil {
+				return nil, err
+			}
+			insertedAt, err := sr.readInt()
+			if err != nil {
+				return nil, err
+			}
+			data, err := sr.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			item := pqItem{priority: priority, insertedAt: insertedAt, data: data}
+			if sr.version >= 2 {
+				deliveries, err := sr.readInt()
+				if err != nil {
+					return nil, err
+				}
+				item.deliveries = int(deliveries)
+			}
+			if sr.version >= 4 {
+				seq, err := sr.readInt()
+				if err != nil {
+					return nil, err
+				}
+				item.seq = uint64(seq)
+			}
+			obj.PQueue.items = append(obj.PQueue.items, item)
+		}
+		obj.PQueue.Length = n
+
+		if sr.version >= 2 {
+			if err := sr.readQueueState(obj.PQueue); err != nil {
+				return nil, err
+			}
+		}
+		if sr.version < 4 {
+			obj.PQueue.resequence()
+		}
+	default:
+		return nil, ErrBadSnapshot
+	}
+
+	return obj, nil
+}
+
+// Read the configuration, the reserved and the delayed items and the order of a queue
+func (sr *snapshotReader) readQueueState(pqueue *PriorityQueue) error {
+	maxDeliveries, err := sr.readInt()
+	if err != nil {
+		return err
+	}
+	pqueue.MaxDeliveries = int(maxDeliveries)
+	if pqueue.DeadLetter, err = sr.readString(); err != nil {
+		return err
+	}
+
+	n, err := sr.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		lease := &Lease{}
+		if lease.Id, err = sr.readString(); err != nil {
+			return err
+		}
+		if lease.Priority, err = sr.readPriority(); err != nil {
+			return err
+		}
+		if lease.insertedAt, err = sr.readInt(); err != nil {
+			return err
+		}
+		if lease.Data, err = sr.readString(); err != nil {
+			return err
+		}
+		deliveries, err := sr.readInt()
+		if err != nil {
+			return err
+		}
+		if lease.ExpiresAt, err = sr.readInt(); err != nil {
+			return err
+		}
+		if sr.version >= 4 {
+			seq, err := sr.readInt()
+			if err != nil {
+				return err
+			}
+			lease.seq = uint64(seq)
+		}
+
+		lease.Deliveries = int(deliveries)
+		pqueue.leases[lease.Id] = lease
+	}
+
+	if sr.version < 3 {
+		return nil
+	}
+
+	if n, err = sr.readLen(); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		priority, err := sr.readPriority()
+		if err != nil {
+			return err
+		}
+		insertedAt, err := sr.readInt()
+		if err != nil {
+			return err
+		}
+		data, err := sr.readString()
+		if err != nil {
+			return err
+		}
+		notBefore, err := sr.readInt()
+		if err != nil {
+			return err
+		}
+
+		item := pqItem{priority: priority, insertedAt: insertedAt, data: data, notBefore: notBefore}
+		pqueue.scheduled = append(pqueue.scheduled, item)
+	}
+
+	if sr.version < 4 {
+		return nil
+	}
+
+	order, err := sr.ReadByte()
+	if err != nil {
+		return err
+	}
+	created, err := sr.ReadByte()
+	if err != nil {
+		return err
+	}
+	seq, err := sr.readInt()
+	if err != nil {
+		return err
+	}
+	pqueue.Order, pqueue.created, pqueue.seq = QueueOrder(order), created == 1, uint64(seq)
+
+	return nil
+}
+
+// Queue priorities were integers before version 4
+func (sr *snapshotReader) readPriority() (float64, error) {
+	if sr.version >= 4 {
+		return sr.readFloat()
+	}
+
+	priority, err := sr.readInt()
+	return float64(priority), err
+}
+
+// Read a database and the aux fields from a snapshot created by WriteSnapshot(), keys that
+// expired while the snapshot was on disk are skipped
+func ReadSnapshot(r io.Reader) (*Database, map[string]string, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+
+	header, err := sr.read(len(snapshotMagic) + 1)
+	if err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, nil, ErrBadSnapshot
+	}
+	sr.version = header[len(snapshotMagic)]
+	if sr.version < 1 || sr.version > snapshotVersion {
+		return nil, nil, errors.New("unsupported snapshot version")
+	}
+
+	aux := map[string]string{}
+	if sr.version >= 5 {
+		fields, err := sr.readLen()
+		if err != nil {
+			return nil, nil, ErrBadSnapshot
+		}
+		for i := 0; i < fields; i++ {
+			k, err := sr.readString()
+			if err != nil {
+				return nil, nil, ErrBadSnapshot
+			}
+			if aux[k], err = sr.readString(); err != nil {
+				return nil, nil, ErrBadSnapshot
+			}
+		}
+	}
+
+	d := NewDatabase()
+	for {
+		kind, err := sr.ReadByte()
+		if err != nil {
+			return nil, nil, ErrBadSnapshot
+		}
+
+		if kind == snapshotEOF {
+			break
+		}
+
+		key, err := sr.readString()
+		if err != nil {
+			return nil, nil, ErrBadSnapshot
+		}
+		expiresAt, err := sr.readInt()
+		if err != nil {
+			return nil, nil, ErrBadSnapshot
+		}
+
+		obj, err := sr.readObj(kind)
+		if err != nil {
+			return nil, nil, ErrBadSnapshot
+		}
+
+		obj.ExpiresAt = expiresAt
+		if !obj.hasExpired() {
+			d.put(key, obj)
+			if obj.Kind == ObjPQueue && (len(obj.PQueue.leases) > 0 || len(obj.PQueue.scheduled) > 0) {
+				d.timed[key] = true
+			}
+		}
+	}
+
+	var checksum [4]byte
+	if _, err := io.ReadFull(sr.r, checksum[:]); err != nil {
+		return nil, nil, ErrBadSnapshot
+	}
+	if binary.BigEndian.Uint32(checksum[:]) != sr.crc.Sum32() {
+		return nil, nil, ErrBadSnapshot
+	}
+
+	return d, aux, nil
+}
+
+// Create a deep copy of the database, it is used for writing snapshots in the background
+// without holding the database lock for the whole write.
+func (d *Database) Clone() *Database {
+	clone := &Database{
+		objs:    make(map[string]*MemoObj, len(d.objs)),
+		keys:    d.keys.clone(),
+		expires: d.expires.clone(),
+		timed:   make(map[string]bool, len(d.timed)),
+		used:    d.used,
+		dirty:   make(map[string]bool, len(d.dirty)),
+	}
+	for k := range d.dirty {
+		clone.dirty[k] = true
+	}
+	for k, obj := range d.objs {
+		clone.objs[k] = obj.clone()
+	}
+	for k := range d.timed {
+		clone.timed[k] = true
+	}
+
+	return clone
+}
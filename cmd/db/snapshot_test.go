@@ -0,0 +1,108 @@
+package db
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	d := NewDatabase()
+	d.Set("name", "bill", 0)
+	d.RPush("list", []string{"1", "2", "3"})
+	d.SetAdd("set", []string{"a", "b"})
+	d.PQAdd("queue", []string{"low"}, 2)
+	d.PQAdd("queue", []string{"high"}, 1)
+	d.PQAdd("queue", []string{"reserved"}, 0)
+	d.PQReserve("queue", "lease", 1700000000000)
+	d.PQConfig("queue", 3, "dead")
+	d.PQSchedule("queue", []string{"delayed"}, 1, 1700000000000)
+	d.PQCreate("max", OrderMax)
+	d.PQAdd("max", []string{"a", "b"}, 0.5)
+	d.PQAdd("max", []string{"c"}, 2.5)
+	d.HSet("hash", []string{"f", "v"})
+	d.ZAdd("zset", []ZItem{{Member: "a", Score: 1.5}, {Member: "b", Score: -2}}, ZAddOptions{})
+
+	var buf bytes.Buffer
+	if err := d.WriteSnapshot(&buf, map[string]string{"wal-id": "abc"}); err != nil {
+		t.Fatal("Unexpected error writing snapshot", err)
+	}
+
+	loaded, aux, err := ReadSnapshot(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal("Unexpected error reading snapshot", err)
+	}
+
+	if aux["wal-id"] != "abc" {
+		t.Error("Expected aux field wal-id to be 'abc', got", aux)
+	}
+
+	if loaded.Size() != 7 {
+		t.Error("Expected Size() to be 7, got", loaded.Size())
+	}
+	if name, _, _ := loaded.Get("name"); name != "bill" {
+		t.Error("Expected Get('name') to return 'bill'")
+	}
+
+	obj, _ := loaded.getObj("list")
+	if items := obj.List.Items(); !reflect.DeepEqual(items, []string{"1", "2", "3"}) {
+		t.Error("Expected list items to be [1 2 3], got", items)
+	}
+
+	members, _ := loaded.SetMembers("set")
+	sort.Strings(members)
+	if !reflect.DeepEqual(members, []string{"a", "b"}) {
+		t.Error("Expected set members to be [a b], got", members)
+	}
+
+	if v, _, _ := loaded.PQPop("queue"); v != "high" {
+		t.Error("Expected PQPop('queue') to return 'high'")
+	}
+	if v, _, _ := loaded.PQPop("queue"); v != "low" {
+		t.Error("Expected PQPop('queue') to return 'low'")
+	}
+	if expired := loaded.ExpiredLeases(1700000000000); !reflect.DeepEqual(expired, []ExpiredLease{{Queue: "queue", Id: "lease"}}) {
+		t.Error("Expected the reserved item to be loaded, got", expired)
+	}
+	if obj, _ := loaded.getObj("queue"); obj.PQueue.MaxDeliveries != 3 || obj.PQueue.DeadLetter != "dead" {
+		t.Error("Expected the queue configuration to be loaded")
+	}
+	if due := loaded.DueQueues(1700000000000); !reflect.DeepEqual(due, []string{"queue"}) {
+		t.Error("Expected the delayed item to be loaded, got", due)
+	}
+	loaded.PQAdd("max", []string{"d"}, 0.5)
+	if values, _ := loaded.PQPopCount("max", 4); !reflect.DeepEqual(values, []string{"c", "a", "b", "d"}) {
+		t.Error("Expected the order of the queue to be loaded, got", values)
+	}
+	if _, found := loaded.getObj("max"); !found {
+		t.Error("Expected the created queue to be kept")
+	}
+
+	if v, _, _ := loaded.HGet("hash", "f"); v != "v" {
+		t.Error("Expected HGet('hash', 'f') to return 'v'")
+	}
+
+	items, _ := loaded.ZRange("zset", ZRangeOptions{Start: 0, Stop: -1})
+	if !reflect.DeepEqual(items, []ZItem{{Member: "b", Score: -2}, {Member: "a", Score: 1.5}}) {
+		t.Error("Expected zset items to be [b a], got", items)
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	d := NewDatabase()
+	d.Set("name", "bill", 0)
+
+	var buf bytes.Buffer
+	d.WriteSnapshot(&buf, nil)
+
+	data := buf.Bytes()
+	data[len(data)-6] ^= 0xff
+	if _, _, err := ReadSnapshot(bytes.NewReader(data)); err != ErrBadSnapshot {
+		t.Error("Expected corrupted snapshot to return ErrBadSnapshot")
+	}
+
+	if _, _, err := ReadSnapshot(bytes.NewReader(data[:len(data)-3])); err != ErrBadSnapshot {
+		t.Error("Expected truncated snapshot to return ErrBadSnapshot")
+	}
+}
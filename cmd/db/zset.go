@@ -0,0 +1,522 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+var ErrScoreNotFloat = errors.New("ERR min or max is not a float")
+var ErrLexRange = errors.New("ERR min or max not valid string range item")
+
+const zslMaxLevel = 32
+const zslP = 0.25
+
+type ZItem struct {
+	Member string
+	Score  float64
+}
+
+type zslLevel struct {
+	forward *zslNode
+	span    int // Number of nodes skipped by following the forward pointer
+}
+
+type zslNode struct {
+	member   string
+	score    float64
+	backward *zslNode
+	level    []zslLevel
+}
+
+func newZslNode(level int, score float64, member string) *zslNode {
+	return &zslNode{member: member, score: score, level: make([]zslLevel, level)}
+}
+
+// Check if the node is ordered before the given score and member, nodes are sorted by score
+// and nodes with the same score are sorted lexicographically
+func (n *zslNode) isBefore(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// A skiplist with spans on every level so that the rank of a node can be calculated while
+// searching for it, see: https://en.wikipedia.org/wiki/Skip_list
+type skiplist struct {
+	header *zslNode
+	tail   *zslNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{header: newZslNode(zslMaxLevel, 0, ""), level: 1}
+}
+
+func zslRandomLevel() int {
+	level := 1
+	for level < zslMaxLevel && rand.Float64() < zslP {
+		level++
+	}
+
+	return level
+}
+
+func (zsl *skiplist) insert(score float64, member string) {
+	var update [zslMaxLevel]*zslNode
+	var rank [zslMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.isBefore(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = newZslNode(level, score, member)
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+
+	// Levels above the new node now skip one more node
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+}
+
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [zslMaxLevel]*zslNode
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.isBefore(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+	return true
+}
+
+// Get the 1-based rank of a node, 0 if it does not exist
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && (x.level[i].forward.isBefore(score, member) ||
+			(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if x != zsl.header && x.score == score && x.member == member {
+			return rank
+		}
+	}
+
+	return 0
+}
+
+// Get the node with the given 1-based rank
+func (zsl *skiplist) byRank(rank int) *zslNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if traversed == rank {
+			return x
+		}
+	}
+
+	return nil
+}
+
+// Get the first node for which gteMin() is true, if lteMax() is not true for it
+// then there are no nodes in the range
+func (zsl *skiplist) first(gteMin func(*zslNode) bool, lteMax func(*zslNode) bool) *zslNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !gteMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !lteMax(x) {
+		return nil
+	}
+
+	return x
+}
+
+// Get the last node for which lteMax() is true, if gteMin() is not true for it
+// then there are no nodes in the range
+func (zsl *skiplist) last(gteMin func(*zslNode) bool, lteMax func(*zslNode) bool) *zslNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && lteMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == zsl.header || !gteMin(x) {
+		return nil
+	}
+
+	return x
+}
+
+// A score range bound, eg. "1.5" (inclusive), "(1.5" (exclusive) or "-inf"
+type ScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+func ParseScoreBound(s string) (ScoreBound, error) {
+	bound := ScoreBound{}
+	if strings.HasPrefix(s, "(") {
+		bound.Exclusive = true
+		s = s[1:]
+	}
+
+	value, err := ParseScore(s)
+	if err != nil {
+		return bound, ErrScoreNotFloat
+	}
+
+	bound.Value = value
+	return bound, nil
+}
+
+func (b ScoreBound) isBelow(score float64) bool {
+	if b.Exclusive {
+		return b.Value < score
+	}
+	return b.Value <= score
+}
+
+func (b ScoreBound) isAbove(score float64) bool {
+	if b.Exclusive {
+		return b.Value > score
+	}
+	return b.Value >= score
+}
+
+// A lexicographical range bound, eg. "[a" (inclusive), "(a" (exclusive), "-" for the
+// lowest and "+" for the highest possible string
+type LexBound struct {
+	Value     string
+	Exclusive bool
+	Inf       int // -1 for "-", 1 for "+"
+}
+
+func ParseLexBound(s string) (LexBound, error) {
+	switch {
+	case s == "-":
+		return LexBound{Inf: -1}, nil
+	case s == "+":
+		return LexBound{Inf: 1}, nil
+	case strings.HasPrefix(s, "("):
+		return LexBound{Value: s[1:], Exclusive: true}, nil
+	case strings.HasPrefix(s, "["):
+		return LexBound{Value: s[1:]}, nil
+	}
+
+	return LexBound{}, ErrLexRange
+}
+
+func (b LexBound) isBelow(member string) bool {
+	if b.Inf != 0 {
+		return b.Inf < 0
+	}
+	if b.Exclusive {
+		return b.Value < member
+	}
+	return b.Value <= member
+}
+
+func (b LexBound) isAbove(member string) bool {
+	if b.Inf != 0 {
+		return b.Inf > 0
+	}
+	if b.Exclusive {
+		return b.Value > member
+	}
+	return b.Value >= member
+}
+
+// Parse a score, "inf", "+inf" and "-inf" are also valid scores
+func ParseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New("not a valid float")
+	}
+
+	return score, nil
+}
+
+func FormatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// The Memo equivalent to a Redis Sorted Set data structure, a set where every member has a
+// score and members are ordered by it. Members with the same score are ordered
+// lexicographically.
+// see: https://redis.io/docs/latest/develop/data-types/sorted-sets/
+type ZSet struct {
+	Size   int
+	scores map[string]float64
+	zsl    *skiplist
+}
+
+func NewZSet() *ZSet {
+	return &ZSet{
+		Size:   0,
+		scores: map[string]float64{},
+		zsl:    newSkiplist(),
+	}
+}
+
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, found := z.scores[member]
+	return score, found
+}
+
+// Add a member or update its score, returns true if the member did not exist before
+func (z *ZSet) Add(member string, score float64) bool {
+	current, found := z.scores[member]
+	if found {
+		if current == score {
+			return false
+		}
+		z.zsl.delete(current, member)
+	} else {
+		z.Size++
+	}
+
+	z.scores[member] = score
+	z.zsl.insert(score, member)
+	return !found
+}
+
+func (z *ZSet) Remove(member string) bool {
+	score, found := z.scores[member]
+	if !found {
+		return false
+	}
+
+	z.Size--
+	delete(z.scores, member)
+	z.zsl.delete(score, member)
+	return true
+}
+
+// Get the 0-based rank of a member, in descending order if rev is true
+func (z *ZSet) Rank(member string, rev bool) (int, bool) {
+	score, found := z.scores[member]
+	if !found {
+		return -1, false
+	}
+
+	rank := z.zsl.rank(score, member)
+	if rev {
+		return z.Size - rank, true
+	}
+	return rank - 1, true
+}
+
+// Get members by their rank, negative indexes count from the end as in Redis, eg. -1 is
+// the last member
+func (z *ZSet) RangeByRank(start int, stop int, rev bool) []ZItem {
+	if start < 0 {
+		start += z.Size
+	}
+	if stop < 0 {
+		stop += z.Size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= z.Size {
+		stop = z.Size - 1
+	}
+	if start > stop {
+		return []ZItem{}
+	}
+
+	items := make([]ZItem, 0, stop-start+1)
+	if rev {
+		for x := z.zsl.byRank(z.Size - start); x != nil && len(items) < cap(items); x = x.backward {
+			items = append(items, ZItem{Member: x.member, Score: x.score})
+		}
+	} else {
+		for x := z.zsl.byRank(start + 1); x != nil && len(items) < cap(items); x = x.level[0].forward {
+			items = append(items, ZItem{Member: x.member, Score: x.score})
+		}
+	}
+
+	return items
+}
+
+// Walk the range between first and last, skipping offset items and returning at most count
+// items, a negative count returns everything
+func (z *ZSet) walk(first *zslNode, last *zslNode, rev bool, offset int, count int) []ZItem {
+	items := []ZItem{}
+	if first == nil || last == nil || z.zsl.rank(first.score, first.member) > z.zsl.rank(last.score, last.member) {
+		return items
+	}
+
+	x, end := first, last
+	if rev {
+		x, end = last, first
+	}
+
+	for ; x != nil && count != 0; offset-- {
+		if offset <= 0 {
+			items = append(items, ZItem{Member: x.member, Score: x.score})
+			count--
+		}
+
+		if x == end {
+			break
+		}
+		if rev {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+
+	return items
+}
+
+func (z *ZSet) scoreRange(min ScoreBound, max ScoreBound) (*zslNode, *zslNode) {
+	gteMin := func(n *zslNode) bool { return min.isBelow(n.score) }
+	lteMax := func(n *zslNode) bool { return max.isAbove(n.score) }
+	return z.zsl.first(gteMin, lteMax), z.zsl.last(gteMin, lteMax)
+}
+
+func (z *ZSet) lexRange(min LexBound, max LexBound) (*zslNode, *zslNode) {
+	gteMin := func(n *zslNode) bool { return min.isBelow(n.member) }
+	lteMax := func(n *zslNode) bool { return max.isAbove(n.member) }
+	return z.zsl.first(gteMin, lteMax), z.zsl.last(gteMin, lteMax)
+}
+
+func (z *ZSet) RangeByScore(min ScoreBound, max ScoreBound, rev bool, offset int, count int) []ZItem {
+	first, last := z.scoreRange(min, max)
+	return z.walk(first, last, rev, offset, count)
+}
+
+// Get members in a lexicographical range, this only makes sense if all members have the
+// same score
+func (z *ZSet) RangeByLex(min LexBound, max LexBound, rev bool, offset int, count int) []ZItem {
+	first, last := z.lexRange(min, max)
+	return z.walk(first, last, rev, offset, count)
+}
+
+// Count the members with a score in the range
+func (z *ZSet) Count(min ScoreBound, max ScoreBound) int {
+	first, last := z.scoreRange(min, max)
+	if first == nil || last == nil {
+		return 0
+	}
+
+	count := z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+func (z *ZSet) RemoveRangeByScore(min ScoreBound, max ScoreBound) int {
+	items := z.RangeByScore(min, max, false, 0, -1)
+	for _, item := range items {
+		z.Remove(item.Member)
+	}
+
+	return len(items)
+}
+
+// Get all members in ascending order
+func (z *ZSet) Items() []ZItem {
+	items := make([]ZItem, 0, z.Size)
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		items = append(items, ZItem{Member: x.member, Score: x.score})
+	}
+
+	return items
+}
+
+func (z *ZSet) Clone() *ZSet {
+	clone := NewZSet()
+	for _, item := range z.Items() {
+		clone.Add(item.Member, item.Score)
+	}
+
+	return clone
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func zsetMembers(items []ZItem) []string {
+	members := make([]string, len(items))
+	for i, item := range items {
+		members[i] = item.Member
+	}
+
+	return members
+}
+
+func equalMembers(items []ZItem, expected ...string) bool {
+	members := zsetMembers(items)
+	if len(members) != len(expected) {
+		return false
+	}
+	for i := range members {
+		if members[i] != expected[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestZSet(t *testing.T) {
+	zset := NewZSet()
+
+	if !zset.Add("bill", 10) {
+		t.Error("Expected Add('bill') to return true")
+	}
+	zset.Add("susan", 30)
+	zset.Add("john", 20)
+	zset.Add("anna", 20)
+
+	if zset.Add("bill", 40) {
+		t.Error("Expected Add('bill') to return false for existing member")
+	}
+	if zset.Size != 4 {
+		t.Error("Expected Size to be 4")
+	}
+	if score, found := zset.Score("bill"); !found || score != 40 {
+		t.Error("Expected Score('bill') to be 40")
+	}
+	if !equalMembers(zset.Items(), "anna", "john", "susan", "bill") {
+		t.Error("Expected members to be ordered by score and member, got", zsetMembers(zset.Items()))
+	}
+
+	if rank, _ := zset.Rank("john", false); rank != 1 {
+		t.Error("Expected Rank('john') to be 1, got", rank)
+	}
+	if rank, _ := zset.Rank("john", true); rank != 2 {
+		t.Error("Expected reverse Rank('john') to be 2, got", rank)
+	}
+	if _, found := zset.Rank("mike", false); found {
+		t.Error("Expected Rank('mike') to not be found")
+	}
+
+	if !equalMembers(zset.RangeByRank(1, -1, false), "john", "susan", "bill") {
+		t.Error("Expected RangeByRank(1, -1) to return 3 members")
+	}
+	if !equalMembers(zset.RangeByRank(0, 1, true), "bill", "susan") {
+		t.Error("Expected reverse RangeByRank(0, 1) to return 'bill' and 'susan'")
+	}
+	if len(zset.RangeByRank(5, 10, false)) != 0 {
+		t.Error("Expected RangeByRank(5, 10) to be empty")
+	}
+
+	min := ScoreBound{Value: 20, Exclusive: true}
+	max := ScoreBound{Value: math.Inf(1)}
+	if !equalMembers(zset.RangeByScore(min, max, false, 0, -1), "susan", "bill") {
+		t.Error("Expected RangeByScore((20, +inf) to return 'susan' and 'bill'")
+	}
+	if !equalMembers(zset.RangeByScore(ScoreBound{Value: 20}, max, true, 1, 2), "susan", "john") {
+		t.Error("Expected reverse RangeByScore with limit to return 'susan' and 'john'")
+	}
+	if zset.Count(ScoreBound{Value: 20}, ScoreBound{Value: 30}) != 3 {
+		t.Error("Expected Count(20, 30) to be 3")
+	}
+	if zset.Count(ScoreBound{Value: 30}, ScoreBound{Value: 20}) != 0 {
+		t.Error("Expected Count(30, 20) to be 0")
+	}
+
+	if zset.RemoveRangeByScore(ScoreBound{Value: 20}, ScoreBound{Value: 20}) != 2 {
+		t.Error("Expected RemoveRangeByScore(20, 20) to remove 2 members")
+	}
+	if !zset.Remove("bill") || zset.Remove("bill") {
+		t.Error("Expected Remove('bill') to only succeed once")
+	}
+	if zset.Size != 1 {
+		t.Error("Expected Size to be 1")
+	}
+}
+
+func TestZSetRangeByLex(t *testing.T) {
+	zset := NewZSet()
+	for _, member := range []string{"a", "b", "c", "d", "e"} {
+		zset.Add(member, 0)
+	}
+
+	min, _ := ParseLexBound("[b")
+	max, _ := ParseLexBound("(e")
+	if !equalMembers(zset.RangeByLex(min, max, false, 0, -1), "b", "c", "d") {
+		t.Error("Expected RangeByLex([b, (e) to return 'b', 'c' and 'd'")
+	}
+
+	min, _ = ParseLexBound("-")
+	max, _ = ParseLexBound("+")
+	if !equalMembers(zset.RangeByLex(min, max, true, 0, 2), "e", "d") {
+		t.Error("Expected reverse RangeByLex(-, +) with limit to return 'e' and 'd'")
+	}
+
+	if _, err := ParseLexBound("b"); err != ErrLexRange {
+		t.Error("Expected ParseLexBound('b') to fail")
+	}
+}
+
+func TestZSetRanks(t *testing.T) {
+	// Enough members for the skiplist to have multiple levels
+	zset := NewZSet()
+	for i := 999; i >= 0; i-- {
+		zset.Add(strconv.Itoa(i), float64(i))
+	}
+	for i := 0; i < 1000; i += 2 {
+		zset.Remove(strconv.Itoa(i))
+	}
+
+	for i := 1; i < 1000; i += 2 {
+		if rank, _ := zset.Rank(strconv.Itoa(i), false); rank != i/2 {
+			t.Fatalf("Expected Rank('%d') to be %d, got %d", i, i/2, rank)
+		}
+	}
+
+	items := zset.RangeByRank(100, 101, false)
+	if !equalMembers(items, "201", "203") {
+		t.Error("Expected RangeByRank(100, 101) to return '201' and '203', got", zsetMembers(items))
+	}
+}
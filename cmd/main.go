@@ -10,8 +10,12 @@ import (
 	"os"
 	"skabillium/memo/cmd/db"
 	"skabillium/memo/cmd/resp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	lua "github.com/yuin/gopher-lua"
 )
 
 const MemoVersion = "0.0.1"
@@ -25,6 +29,13 @@ const CurrentRespVersion = "2"
 // see: runExpireJob() and db.CleanupExpired()
 const DefaultCleanupLimit = 20
 
+// Time a cleanup cycle can keep removing expired keys while it finds a backlog of them
+// see: db.ExpireCycle()
+const ExpireCycleBudget = 25 * time.Millisecond
+
+// Time between cleanup cycles while there is a backlog of expired keys
+const ExpireBacklogInterval = 100 * time.Millisecond
+
 var ErrNoAuth = errors.New("NOAUTH Authentication required")
 var ErrWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled")
 var ErrNoProto = errors.New("NOPROTO unsupported protocol version")
@@ -33,9 +44,12 @@ var ErrUnsupportedType = errors.New("ERR unsupported type for request")
 // Helper struct for holding any connection specific information and communicating with
 // clients
 type MemoContext struct {
-	conn    net.Conn
-	rw      *bufio.ReadWriter
-	hasAuth bool
+	conn       net.Conn
+	rw         *bufio.ReadWriter
+	hasAuth    bool
+	replica    *replica    // Set if the connection belongs to a follower
+	subscriber *subscriber // Set if the connection is in subscriber mode
+	tx         transaction
 }
 
 func NewMemoContext(conn net.Conn) *MemoContext {
@@ -65,6 +79,16 @@ func (c *MemoContext) EndWith(message any) {
 	c.End()
 }
 
+// Send a reply to the client, in subscriber mode it is queued with the published messages
+// since the subscriber writes to the connection from its own goroutine
+func (c *MemoContext) Reply(message any) {
+	if c.subscriber != nil {
+		c.subscriber.send(message)
+		return
+	}
+	c.EndWith(message)
+}
+
 func (c *MemoContext) End() {
 	c.rw.Flush()
 }
@@ -73,7 +97,114 @@ func (c *MemoContext) End() {
 func (s *Server) Execute(cmd *Command) any {
 	s.dbmu.Lock()
 	defer s.dbmu.Unlock()
+	return s.execute(cmd)
+}
+
+// Same as Execute() but commands that modify the database are also appended to the WAL and
+// sent to the followers. This happens while holding the database lock so that the order of
+// the log and the replication stream is the same as the order of execution. Read-only commands
+// only share the lock, so they run in parallel with each other.
+func (s *Server) ExecuteAndLog(cmd *Command, exec string) any {
+	if cmd.IsReadOnly() {
+		s.dbmu.RLock()
+		defer s.dbmu.RUnlock()
+		return s.execute(cmd)
+	}
+
+	s.dbmu.Lock()
+	if !cmd.IsWrite() {
+		defer s.dbmu.Unlock()
+		return s.executeRead(cmd)
+	}
+
+	if s.repl.isFollower() {
+		s.dbmu.Unlock()
+		return ErrReadOnly
+	}
+
+	res, offset := s.executeWrite(cmd, exec)
+	s.dbmu.Unlock()
+
+	return s.waitSync(res, offset)
+}
+
+// Wait for the WAL to be synced up to the offset of a write before returning its result.
+// This happens without holding the lock, so that commands from other connections can be
+// synced together with a single fsync.
+func (s *Server) waitSync(res any, offset int64) any {
+	if s.wal == nil || offset < 0 {
+		return res
+	}
 
+	if err := s.wal.WaitSync(offset); err != nil {
+		fmt.Println(err)
+		return ErrWalSync
+	}
+
+	return res
+}
+
+// Execute a write command, append it to the WAL and send it to the followers. Returns the
+// result and the offset of the command in the WAL. The database lock must be held by the
+// caller.
+func (s *Server) executeWrite(cmd *Command, exec string) (any, int64) {
+	if !s.freeMemory() && cmd.DeniedOnOOM() {
+		return ErrOOM, -1
+	}
+	if seesQueueItems(cmd.Kind) {
+		s.promoteDue(cmd)
+	}
+	cmd, exec = withAbsoluteExpiry(cmd, exec, time.Now())
+
+	// Writes of a batch are logged when it ends, see: endBatch()
+	var offset int64 = -1
+	if s.batch != nil {
+		s.batch.execs = append(s.batch.execs, exec)
+	} else if s.wal != nil {
+		var err error
+		if offset, err = s.wal.Append(exec); err != nil {
+			return err, -1
+		}
+	}
+
+	s.nackedTo = ""
+	res := s.execute(cmd)
+	if _, failed := res.(error); !failed {
+		s.touchWatched(cmd)
+	}
+	if s.batch == nil {
+		s.replicate(exec)
+	}
+
+	if len(s.blocked[cmd.Key]) > 0 {
+		s.serveBlocked(cmd)
+	}
+	if key := s.nackedTo; len(s.blocked[key]) > 0 {
+		s.serveBlocked(&Command{Kind: CmdQueueNack, Key: key})
+	}
+
+	// The rewrite must start after the command is executed, since it is already part of
+	// the old log
+	if s.wal != nil && s.batch == nil && !s.rewriting && !s.saving && s.wal.NeedsRewrite(s.options.WalRewriteMultiple) {
+		if err := s.bgRewriteWal(); err == nil {
+			fmt.Println("Started automatic WAL rewrite")
+		}
+	}
+
+	return res, offset
+}
+
+// Execute a command that does not modify the database. The database lock must be held by the
+// caller.
+func (s *Server) executeRead(cmd *Command) any {
+	if seesQueueItems(cmd.Kind) {
+		s.promoteDue(cmd)
+	}
+
+	return s.execute(cmd)
+}
+
+func (s *Server) execute(cmd *Command) any {
 	switch cmd.Kind {
 	case CmdVersion:
 		return resp.SimpleString(MemoVersion)
@@ -85,6 +216,16 @@ func (s *Server) Execute(cmd *Command) any {
 		}
 		return s.Info
 	case CmdInfo:
+		switch cmd.Section {
+		case "replication":
+			return s.replicationInfo()
+		case "stats":
+			return s.statsInfo()
+		case "keyspace":
+			return s.keyspaceInfo()
+		case "memory":
+			return s.memoryInfo()
+		}
 		return "Memo server version " + MemoVersion
 	case CmdKeys:
 		keys := s.db.Keys(cmd.Pattern)
@@ -96,14 +237,99 @@ func (s *Server) Execute(cmd *Command) any {
 		return s.db.Size()
 	case CmdCleanup:
 		return s.db.CleanupExpired(cmd.Limit)
+	case CmdSave:
+		if err := s.save(); err != nil {
+			return err
+		}
+		return resp.SimpleString("OK")
+	case CmdBgSave:
+		if err := s.bgSave(); err != nil {
+			return err
+		}
+		return resp.SimpleString("Background saving started")
+	case CmdRewriteWal:
+		if err := s.bgRewriteWal(); err != nil {
+			return err
+		}
+		return resp.SimpleString("Background WAL rewriting started")
+	case CmdReplicaOf:
+		s.replicaOf(cmd.Addr)
+		return resp.SimpleString("OK")
 	case CmdExpire:
-		ok := s.db.Expire(cmd.Key, cmd.ExpireIn)
+		ok := s.db.ExpireAt(cmd.Key, time.Now().UnixMilli()+cmd.ExpireIn, cmd.Expire)
+		if !ok {
+			return 0
+		}
+		return 1
+	case CmdPExpireAt:
+		ok := s.db.ExpireAt(cmd.Key, cmd.ExpireAt, cmd.Expire)
+		if !ok {
+			return 0
+		}
+		return 1
+	case CmdPersist:
+		ok := s.db.Persist(cmd.Key)
 		if !ok {
 			return 0
 		}
 		return 1
+	case CmdTTL, CmdPTTL, CmdExpireTime, CmdPExpireTime:
+		at, found := s.db.ExpireTime(cmd.Key)
+		if !found {
+			return -2
+		}
+		if at == 0 {
+			return -1
+		}
+
+		switch cmd.Kind {
+		case CmdTTL:
+			// Rounded to the closest second
+			return int((at - time.Now().UnixMilli() + 500) / 1000)
+		case CmdPTTL:
+			return int(at - time.Now().UnixMilli())
+		case CmdExpireTime:
+			return int(at / 1000)
+		default:
+			return int(at)
+		}
+	case CmdMemoryUsage:
+		size, found := s.db.MemoryUsage(cmd.Key, cmd.Count)
+		if !found {
+			return nil
+		}
+		return size
+	case CmdMemoryStats:
+		return s.memoryStats()
+	case CmdAnalyze:
+		// Transactions and scripts already hold the database lock, so the keyspace is
+		// analyzed at once, see: analyze()
+		a := newKeyAnalyzer(cmd)
+		a.scanAll(s.db)
+		return a.reply()
+	case CmdObjectEncoding, CmdObjectIdleTime, CmdObjectFreq:
+		obj, found := s.db.Object(cmd.Key)
+		if !found {
+			return nil
+		}
+
+		switch cmd.Kind {
+		case CmdObjectEncoding:
+			return obj.Encoding
+		case CmdObjectIdleTime:
+			return int(obj.IdleTime / 1000)
+		default:
+			return obj.Freq
+		}
 	case CmdSet:
-		s.db.Set(cmd.Key, cmd.Value, cmd.ExpireIn)
+		switch {
+		case cmd.KeepTTL:
+			s.db.SetKeepTTL(cmd.Key, cmd.Value)
+		case cmd.ExpireIn != 0:
+			s.db.Set(cmd.Key, cmd.Value, time.Now().UnixMilli()+cmd.ExpireIn)
+		default:
+			s.db.Set(cmd.Key, cmd.Value, cmd.ExpireAt)
+		}
 		return resp.SimpleString("OK")
 	case CmdGet:
 		value, found, err := s.db.Get(cmd.Key)
@@ -121,9 +347,26 @@ func (s *Server) Execute(cmd *Command) any {
 	case CmdDel:
 		return s.db.Del(cmd.Keys)
 	case CmdQueueAdd:
+		if cmd.NotBefore > 0 {
+			if err := s.db.PQSchedule(cmd.Key, cmd.Values, cmd.Priority, cmd.NotBefore); err != nil {
+				return err
+			}
+			return 1
+		}
 		s.db.PQAdd(cmd.Key, cmd.Values, cmd.Priority)
 		return 1
 	case CmdQueuePop:
+		if cmd.Count > 0 {
+			values, err := s.db.PQPopCount(cmd.Key, cmd.Count)
+			if err != nil {
+				return err
+			}
+			if len(values) == 0 {
+				return nil
+			}
+			return values
+		}
+
 		value, found, err := s.db.PQPop(cmd.Key)
 		if err != nil {
 			return err
@@ -175,6 +418,109 @@ func (s *Server) Execute(cmd *Command) any {
 			return err
 		}
 		return length
+	case CmdBLPop, CmdBRPop, CmdBQPop:
+		return s.popFirst(cmd)
+	case CmdQueueReserve:
+		lease, found, err := s.db.PQReserve(cmd.Key, cmd.LeaseId, cmd.ExpireAt)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		return []any{lease.Id, lease.Data, lease.Deliveries}
+	case CmdQueueAck, CmdQueueNack:
+		var released bool
+		var err error
+		if cmd.Kind == CmdQueueAck {
+			released, err = s.db.PQAck(cmd.Key, cmd.LeaseId)
+		} else {
+			var target string
+			target, released, err = s.db.PQNack(cmd.Key, cmd.LeaseId)
+			if target != cmd.Key {
+				s.nackedTo = target
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+		if !released {
+			return 0
+		}
+		return 1
+	case CmdQueueConfig:
+		if err := s.db.PQConfig(cmd.Key, cmd.Deliveries, cmd.Value); err != nil {
+			return err
+		}
+		return resp.SimpleString("OK")
+	case CmdQueueRestore:
+		var lease *db.Lease
+		if cmd.LeaseId != "" {
+			lease = &db.Lease{Id: cmd.LeaseId, ExpiresAt: cmd.ExpireAt}
+		}
+		if err := s.db.PQRestore(cmd.Key, cmd.Value, cmd.Priority, cmd.Deliveries, lease); err != nil {
+			return err
+		}
+		return resp.SimpleString("OK")
+	case CmdQueuePromote:
+		promoted, err := s.db.PQPromote(cmd.Key, cmd.NotBefore)
+		if err != nil {
+			return err
+		}
+		return promoted
+	case CmdQueueCreate:
+		created, err := s.db.PQCreate(cmd.Key, cmd.Order)
+		if err != nil {
+			return err
+		}
+		if !created {
+			return 0
+		}
+		return 1
+	case CmdQueuePeek:
+		value, found, err := s.db.PQPeek(cmd.Key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		return value
+	case CmdQueueRange:
+		items, err := s.db.PQRange(cmd.Key, cmd.Start, cmd.Stop)
+		if err != nil {
+			return err
+		}
+
+		out := make([]any, len(items))
+		for i, item := range items {
+			out[i] = []any{item.Data, db.FormatScore(item.Priority), int(item.InsertedAt)}
+		}
+		return out
+	case CmdQueueRem:
+		removed, err := s.db.PQRem(cmd.Key, cmd.Value)
+		if err != nil {
+			return err
+		}
+		return removed
+	case CmdQueueUpdate:
+		updated, err := s.db.PQUpdate(cmd.Key, cmd.Value, cmd.Priority)
+		if err != nil {
+			return err
+		}
+		return updated
+	case CmdQueueScheduled:
+		items, err := s.db.PQScheduled(cmd.Key)
+		if err != nil {
+			return err
+		}
+
+		out := make([]any, len(items))
+		for i, item := range items {
+			out[i] = []any{item.Data, db.FormatScore(item.Priority), int(item.NotBefore)}
+		}
+		return out
 	case CmdSetAdd:
 		added, err := s.db.SetAdd(cmd.Key, cmd.Values)
 		if err != nil {
@@ -213,6 +559,206 @@ func (s *Server) Execute(cmd *Command) any {
 			return err
 		}
 		return inter
+	case CmdHSet:
+		added, err := s.db.HSet(cmd.Key, cmd.Values)
+		if err != nil {
+			return err
+		}
+		return added
+	case CmdHSetNX:
+		set, err := s.db.HSetNX(cmd.Key, cmd.Values[0], cmd.Values[1])
+		if err != nil {
+			return err
+		}
+		if !set {
+			return 0
+		}
+		return 1
+	case CmdHGet:
+		value, found, err := s.db.HGet(cmd.Key, cmd.Value)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		return value
+	case CmdHMGet:
+		values := make([]any, len(cmd.Values))
+		for i, field := range cmd.Values {
+			value, found, err := s.db.HGet(cmd.Key, field)
+			if err != nil {
+				return err
+			}
+			if found {
+				values[i] = value
+			}
+		}
+		return values
+	case CmdHDel:
+		deleted, err := s.db.HDel(cmd.Key, cmd.Values)
+		if err != nil {
+			return err
+		}
+		return deleted
+	case CmdHExists:
+		exists, err := s.db.HExists(cmd.Key, cmd.Value)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return 0
+		}
+		return 1
+	case CmdHLen:
+		length, err := s.db.HLen(cmd.Key)
+		if err != nil {
+			return err
+		}
+		return length
+	case CmdHKeys:
+		fields, err := s.db.HKeys(cmd.Key)
+		if err != nil {
+			return err
+		}
+		return fields
+	case CmdHVals:
+		values, err := s.db.HVals(cmd.Key)
+		if err != nil {
+			return err
+		}
+		return values
+	case CmdHGetAll:
+		items, err := s.db.HGetAll(cmd.Key)
+		if err != nil {
+			return err
+		}
+		return items
+	case CmdHIncrBy:
+		value, err := s.db.HIncrBy(cmd.Key, cmd.Value, cmd.Incr)
+		if err != nil {
+			return err
+		}
+		return value
+	case CmdHIncrByFloat:
+		value, err := s.db.HIncrByFloat(cmd.Key, cmd.Value, cmd.IncrFloat)
+		if err != nil {
+			return err
+		}
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case CmdScan:
+		keys, cursor := s.db.Scan(cmd.Cursor, scanCount(cmd), cmd.Pattern, cmd.ObjType)
+		return []any{strconv.FormatUint(cursor, 10), keys}
+	case CmdSetScan:
+		members, cursor, err := s.db.SScan(cmd.Key, cmd.Cursor, scanCount(cmd), cmd.Pattern)
+		if err != nil {
+			return err
+		}
+		return []any{strconv.FormatUint(cursor, 10), members}
+	case CmdHScan:
+		items, cursor, err := s.db.HScan(cmd.Key, cmd.Cursor, scanCount(cmd), cmd.Pattern)
+		if err != nil {
+			return err
+		}
+		return []any{strconv.FormatUint(cursor, 10), items}
+	case CmdZAdd:
+		if cmd.ZAdd.Incr {
+			member := cmd.Members[0]
+			score, updated, err := s.db.ZIncrBy(cmd.Key, member.Member, member.Score, cmd.ZAdd)
+			if err != nil {
+				return err
+			}
+			if !updated {
+				return nil
+			}
+			return db.FormatScore(score)
+		}
+
+		added, err := s.db.ZAdd(cmd.Key, cmd.Members, cmd.ZAdd)
+		if err != nil {
+			return err
+		}
+		return added
+	case CmdZIncrBy:
+		score, _, err := s.db.ZIncrBy(cmd.Key, cmd.Value, cmd.IncrFloat, db.ZAddOptions{})
+		if err != nil {
+			return err
+		}
+		return db.FormatScore(score)
+	case CmdZScore:
+		score, found, err := s.db.ZScore(cmd.Key, cmd.Value)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		return db.FormatScore(score)
+	case CmdZRank, CmdZRevRank:
+		rank, found, err := s.db.ZRank(cmd.Key, cmd.Value, cmd.Kind == CmdZRevRank)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		return rank
+	case CmdZRange:
+		items, err := s.db.ZRange(cmd.Key, cmd.ZRange)
+		if err != nil {
+			return err
+		}
+
+		out := make([]string, 0, len(items))
+		for _, item := range items {
+			out = append(out, item.Member)
+			if cmd.WithScores {
+				out = append(out, db.FormatScore(item.Score))
+			}
+		}
+		return out
+	case CmdZRem:
+		removed, err := s.db.ZRem(cmd.Key, cmd.Values)
+		if err != nil {
+			return err
+		}
+		return removed
+	case CmdZRemRangeByScore:
+		removed, err := s.db.ZRemRangeByScore(cmd.Key, cmd.Min, cmd.Max)
+		if err != nil {
+			return err
+		}
+		return removed
+	case CmdZCard:
+		size, err := s.db.ZCard(cmd.Key)
+		if err != nil {
+			return err
+		}
+		return size
+	case CmdZCount:
+		count, err := s.db.ZCount(cmd.Key, cmd.Min, cmd.Max)
+		if err != nil {
+			return err
+		}
+		return count
+	case CmdScriptLoad:
+		sha, _, err := s.loadScript(cmd.Value)
+		if err != nil {
+			return err
+		}
+		return sha
+	case CmdScriptExists:
+		out := make([]any, len(cmd.Keys))
+		for i, sha := range cmd.Keys {
+			out[i] = 0
+			if _, found := s.scripts[sha]; found {
+				out[i] = 1
+			}
+		}
+		return out
+	case CmdScriptFlush:
+		s.scripts = map[string]*lua.FunctionProto{}
+		return resp.SimpleString("OK")
 	}
 
 	return nil
@@ -223,17 +769,29 @@ type ServerInfo struct {
 	Version     string
 	Proto       int
 	Mode        string
+	Role        string
 	Modules     []string
 	Connections int
 }
 
 type Server struct {
-	ln      net.Listener
-	quitCh  chan struct{}
-	options *ServerOptions
-	dbmu    sync.Mutex // Mutex to synchronize db acces from different connections
-	db      *db.Database
-	walch   chan string
+	ln        net.Listener
+	quitCh    chan struct{}
+	options   *ServerOptions
+	dbmu      sync.RWMutex // Read-only commands share it, everything else holds it exclusively
+	db        *db.Database
+	wal       *Wal
+	walLoaded WalPosition // End of the WAL when the loaded snapshot was taken
+	saving    bool        // Whether a background save is in progress
+	rewriting bool        // Whether a background WAL rewrite is in progress
+	repl      replicationState
+	pubsub    *pubsub
+	watchers  map[string]map[*MemoContext]bool // Connections watching every key, see: watch()
+	blocked   map[string][]*blockedClient      // Connections blocked on every key, see: blockingPop()
+	scripts   map[string]*lua.FunctionProto    // Compiled scripts by SHA1
+	batch     *writeBatch                      // Writes of the running transaction or script
+	nackedTo  string                           // Dead letter queue that received an item from the last QNACK
+	script    scriptRunner
 
 	// Server info
 	connMu sync.Mutex // Mutex to increment connections
@@ -242,14 +800,23 @@ type Server struct {
 
 func NewServer(options *ServerOptions) *Server {
 	return &Server{
-		options: options,
-		quitCh:  make(chan struct{}),
-		db:      db.NewDatabase(),
+		options:  options,
+		quitCh:   make(chan struct{}),
+		db:       db.NewDatabase(),
+		pubsub:   newPubSub(),
+		watchers: map[string]map[*MemoContext]bool{},
+		blocked:  map[string][]*blockedClient{},
+		scripts:  map[string]*lua.FunctionProto{},
+		repl: replicationState{
+			id:      newReplicationId(),
+			backlog: newBacklog(options.ReplBacklogSize),
+		},
 		Info: ServerInfo{
 			Server:      "memo",
 			Version:     MemoVersion,
 			Proto:       2,
 			Mode:        "standalone",
+			Role:        "leader",
 			Modules:     []string{},
 			Connections: 0,
 		},
@@ -273,41 +840,34 @@ func (s *Server) closeConn(conn net.Conn) {
 
 // If the Write Ahead Log is enabled, this function reads it and rebuilds the database from the
 // logged commands. It is meant to run only once, before the server is actually started.
+// If the last record is incomplete and the "wal-truncate" option is set, the log is truncated
+// right before it instead of failing.
 func (s *Server) BuildDbFromWal() (int, error) {
-	file, err := os.Open(WalName)
-	if err != nil {
-		return -1, err
-	}
-	defer file.Close()
-
-	rd := bufio.NewReader(file)
-	var ops int
-	for {
-		// WAL is serialized as bulk strings
-		line, err := resp.Read(rd)
+	ops, err := ReadWal(WalName, s.walLoaded, func(exec string) error {
+		cmds, _, err := parseRecord(exec)
 		if err != nil {
-			if err != io.EOF {
-				return -1, err
-			}
-			break
+			return err
 		}
 
-		exec, ok := line.(string)
-		if !ok {
-			s.db.FlushAll()
-			return -1, errors.New("corrupted wal file, please manually verify that the contents are correct")
+		for _, cmd := range cmds {
+			if cmd.IsWrite() {
+				s.Execute(cmd)
+			}
 		}
+		return nil
+	})
 
-		cmd, err := ParseCommand(exec)
-		if err != nil {
-			return -1, err
+	var walErr *WalError
+	if errors.As(err, &walErr) && walErr.Torn && s.options.WalTruncate {
+		if err := os.Truncate(WalName, walErr.Offset); err != nil {
+			return ops, err
 		}
 
-		s.Execute(cmd)
-		ops++
+		fmt.Printf("Truncated incomplete record at offset %d of %s\n", walErr.Offset, WalName)
+		return ops, nil
 	}
 
-	return ops, nil
+	return ops, err
 }
 
 // Start server with the options provided by the cli
@@ -327,17 +887,27 @@ func (s *Server) Start() error {
 	}
 
 	if s.options.WalEnabled {
-		s.walch = make(chan string)
-		fmt.Println("WAL enabled:", WalName)
-		go writeToWAL(s.walch)
+		wal, err := OpenWal(WalName, s.options.WalFsync)
+		if err != nil {
+			return err
+		}
+		defer wal.Close()
+
+		s.wal = wal
+		fmt.Println("WAL enabled:", WalName, "fsync:", s.options.WalFsync)
+	}
+
+	if s.options.ReplicaOf != "" {
+		s.dbmu.Lock()
+		s.replicaOf(s.options.ReplicaOf)
+		s.dbmu.Unlock()
+		fmt.Println("Replicating from", s.options.ReplicaOf)
 	}
 
 	fmt.Println("Memo server started on port", s.options.Port)
 
 	<-s.quitCh
 
-	close(s.walch)
-
 	return nil
 }
 
@@ -361,6 +931,16 @@ func (s *Server) handleConnection(conn net.Conn) {
 	defer s.closeConn(conn)
 
 	ctx := NewMemoContext(conn)
+	defer func() {
+		if ctx.replica != nil {
+			s.removeReplica(ctx.replica)
+		}
+		if ctx.subscriber != nil {
+			s.closeSubscriber(ctx)
+		}
+		s.unwatch(ctx)
+	}()
+
 	for {
 		req, err := resp.Read(ctx.rw.Reader)
 		if err != nil {
@@ -372,13 +952,15 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 		exec, err := StringifyRequest(req)
 		if err != nil {
-			ctx.EndWith(err)
+			ctx.Reply(err)
 			continue
 		}
 
 		command, err := ParseCommand(exec)
 		if err != nil {
-			ctx.EndWith(err)
+			// Transactions with invalid commands are discarded on EXEC
+			ctx.tx.failed = ctx.tx.active
+			ctx.Reply(err)
 			continue
 		}
 
@@ -387,15 +969,72 @@ func (s *Server) handleConnection(conn net.Conn) {
 		}
 
 		if err = s.CanExecute(ctx, command); err != nil {
-			ctx.EndWith(err)
+			ctx.Reply(err)
+			continue
+		}
+
+		// Connections of followers only receive the replication stream
+		if ctx.replica != nil {
+			if command.Kind == CmdReplConf {
+				s.ackReplica(ctx.replica, command.Offset)
+			}
+			continue
+		}
+
+		// SCRIPT KILL is handled without the database lock, since the script holds it
+		if command.Kind == CmdScriptKill {
+			if err := s.script.kill(); err != nil {
+				ctx.Reply(err)
+			} else {
+				ctx.Reply(resp.SimpleString("OK"))
+			}
+			continue
+		}
+
+		// Commands don't wait for the database lock behind a script that takes too long
+		if s.script.wait(s.options.ScriptTimeLimit) {
+			ctx.Reply(ErrScriptBusy)
+			continue
+		}
+
+		if ctx.subscriber != nil {
+			s.handlePubSub(ctx, command)
+			continue
+		}
+
+		if ctx.tx.active || isTransactionCommand(command.Kind) {
+			s.handleTransaction(ctx, command, exec)
+			continue
+		}
+
+		if command.Kind == CmdSync || command.Kind == CmdPSync {
+			s.syncReplica(ctx, command)
 			continue
 		}
 
-		if s.options.WalEnabled {
-			s.walch <- exec
+		// Pub/Sub does not need the database lock
+		if isPubSubCommand(command.Kind) {
+			s.handlePubSub(ctx, command)
+			continue
+		}
+
+		if command.Kind == CmdEval || command.Kind == CmdEvalSha {
+			ctx.EndWith(s.ExecuteScript(command))
+			continue
+		}
+
+		if isBlockingCommand(command.Kind) {
+			ctx.EndWith(s.blockingPop(ctx, command))
+			continue
+		}
+
+		// ANALYZE takes the database lock for one batch of keys at a time
+		if command.Kind == CmdAnalyze {
+			ctx.EndWith(s.analyze(command))
+			continue
 		}
 
-		res := s.Execute(command)
+		res := s.ExecuteAndLog(command, exec)
 		ctx.Write(res)
 		ctx.End()
 	}
@@ -421,18 +1060,48 @@ func (s *Server) CanExecute(ctx *MemoContext, command *Command) error {
 }
 
 // Job to delete expired keys, by default it runs every second but can be customized
-// with the "cleanup-interval" cli option (in seconds)
+// with the "cleanup-interval" cli option (in seconds). While a cycle runs out of time
+// before removing all the expired keys, the next one runs after ExpireBacklogInterval.
 func (s *Server) runExpireJob() {
-	// Remove expired keys every second
-	ticker := time.NewTicker(s.options.CleanupInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(s.options.CleanupInterval)
+	defer timer.Stop()
 
-	for range ticker.C {
+	for range timer.C {
 		s.dbmu.Lock()
-		s.db.CleanupExpired(s.options.CleanupLimit)
+		_, capped := s.db.ExpireCycle(s.options.CleanupLimit, ExpireCycleBudget)
+		s.redeliverExpired()
+		s.promoteScheduled()
 
 		s.dbmu.Unlock()
+
+		next := s.options.CleanupInterval
+		if capped {
+			next = min(next, ExpireBacklogInterval)
+		}
+		timer.Reset(next)
+	}
+}
+
+func (s *Server) statsInfo() string {
+	stats := s.db.Stats()
+
+	var info strings.Builder
+	info.WriteString("# Stats\r\n")
+	fmt.Fprintf(&info, "expired_keys:%d\r\n", stats.ExpiredKeys)
+	fmt.Fprintf(&info, "expired_time_cap_reached_count:%d\r\n", stats.ExpireCyclesCapped)
+	fmt.Fprintf(&info, "evicted_keys:%d\r\n", stats.EvictedKeys)
+
+	return info.String()
+}
+
+func (s *Server) keyspaceInfo() string {
+	var info strings.Builder
+	info.WriteString("# Keyspace\r\n")
+	if s.db.Size() > 0 {
+		fmt.Fprintf(&info, "db0:keys=%d,expires=%d\r\n", s.db.Size(), s.db.VolatileSize())
 	}
+
+	return info.String()
 }
 
 // The actual main function of the server, it reads and options provided
@@ -444,18 +1113,30 @@ func runServer() error {
 		flag.PrintDefaults()
 	}
 
-	options := getServerOptions()
+	options, err := getServerOptions()
+	if err != nil {
+		return err
+	}
+
 	server := NewServer(options)
 
+	if FileExists(SnapshotName) {
+		keys, err := server.LoadSnapshot()
+		if err != nil {
+			fmt.Println("Failed to load snapshot", SnapshotName)
+			fmt.Println(err)
+		} else {
+			fmt.Printf("Loaded %d keys from snapshot\n", keys)
+		}
+	}
+
 	if options.WalEnabled {
 		if FileExists(WalName) {
 			ops, err := server.BuildDbFromWal()
 			if err != nil {
-				fmt.Println("Failed to initialize database from WAL")
-				fmt.Println(err)
-			} else {
-				fmt.Printf("Initialized database from %d commands\n", ops)
+				return fmt.Errorf("failed to initialize database from WAL: %w", err)
 			}
+			fmt.Printf("Initialized database from %d commands\n", ops)
 		}
 	}
 
@@ -465,7 +1146,12 @@ func runServer() error {
 // Main is only responsible for running the runServer function and exiting with an error
 // if it occurs
 func main() {
-	err := runServer()
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		err = runAnalyze(os.Args[2:])
+	} else {
+		err = runServer()
+	}
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
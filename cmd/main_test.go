@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newBenchServer(keys int) *Server {
+	s := NewServer(&ServerOptions{})
+	for i := 0; i < keys; i++ {
+		key := "key:" + strconv.Itoa(i)
+		s.Execute(&Command{Kind: CmdSet, Key: key, Value: "value"})
+		s.Execute(&Command{Kind: CmdHSet, Key: "hash:" + strconv.Itoa(i), Values: []string{"field", "value", "other", "value"}})
+	}
+
+	return s
+}
+
+// Run with -race, reads share the database lock and must not modify the database
+func TestConcurrentReads(t *testing.T) {
+	s := newBenchServer(100)
+	s.Execute(&Command{Kind: CmdSet, Key: "expired", Value: "v", ExpireAt: time.Now().UnixMilli() + 10})
+	time.Sleep(20 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := strconv.Itoa((i + j) % 100)
+				if res := s.ExecuteAndLog(&Command{Kind: CmdGet, Key: "key:" + key}, ""); res != "value" && i%2 == 0 {
+					t.Error("Expected key:"+key+" to be 'value', got", res)
+					return
+				}
+				s.ExecuteAndLog(&Command{Kind: CmdHGetAll, Key: "hash:" + key}, "")
+				s.ExecuteAndLog(&Command{Kind: CmdObjectFreq, Key: "key:" + key}, "")
+				s.ExecuteAndLog(&Command{Kind: CmdScan, Pattern: "*", Cursor: uint64(j)}, "")
+				if res := s.ExecuteAndLog(&Command{Kind: CmdKeys, Pattern: "exp*"}, ""); len(res.([]string)) != 0 {
+					t.Error("Expected KEYS to skip the expired key, got", res)
+					return
+				}
+				if res := s.ExecuteAndLog(&Command{Kind: CmdGet, Key: "expired"}, ""); res != nil {
+					t.Error("Expected expired key to be missing, got", res)
+					return
+				}
+				if i%2 == 1 {
+					s.ExecuteAndLog(&Command{Kind: CmdSet, Key: "key:" + key, Value: "value"}, "")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The expired key is removed by the expire job or a write, not by reads
+	if s.db.Size() != 201 {
+		t.Error("Expected the expired key to be kept by reads, got", s.db.Size(), "keys")
+	}
+}
+
+// While a read holds the shared lock, other reads still run but writes wait for it. This is
+// what lets reads scale with the number of CPUs, see: BenchmarkExecute()
+func TestReadsShareLock(t *testing.T) {
+	s := newBenchServer(1)
+	s.dbmu.RLock()
+
+	read := make(chan any)
+	go func() { read <- s.ExecuteAndLog(&Command{Kind: CmdGet, Key: "key:0"}, "") }()
+	select {
+	case res := <-read:
+		if res != "value" {
+			t.Error("Expected key:0 to be 'value', got", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a read to run while another read holds the lock")
+	}
+
+	written := make(chan any)
+	go func() { written <- s.ExecuteAndLog(&Command{Kind: CmdSet, Key: "key:0", Value: "other"}, "") }()
+	select {
+	case <-written:
+		t.Error("Expected a write to wait for the read to finish")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.dbmu.RUnlock()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the write to run after the read finished")
+	}
+}
+
+// Compare reads that share the database lock with the same reads holding it exclusively, as
+// every command did before read-only commands were marked. Run with -cpu to see how both
+// scale, eg. go test ./cmd -run ^$ -bench Execute -cpu 1,4,16
+func BenchmarkExecute(b *testing.B) {
+	s := newBenchServer(10000)
+	get := func(i int) *Command {
+		return &Command{Kind: CmdHGetAll, Key: "hash:" + strconv.Itoa(i%10000)}
+	}
+
+	b.Run("read/shared", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				s.ExecuteAndLog(get(i), "")
+			}
+		})
+	})
+	b.Run("read/exclusive", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				s.Execute(get(i))
+			}
+		})
+	})
+	// One write every ten commands
+	b.Run("mixed", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if i%10 == 0 {
+					s.ExecuteAndLog(&Command{Kind: CmdSet, Key: "key:" + strconv.Itoa(i%10000), Value: "value"}, "")
+				} else {
+					s.ExecuteAndLog(get(i), "")
+				}
+			}
+		})
+	})
+}
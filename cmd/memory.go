@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"skabillium/memo/cmd/db"
+	"strings"
+	"time"
+)
+
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// Evict keys with the eviction policy until the used memory is under the limit, returns false
+// if the limit is still exceeded. Evicted keys are deleted in the WAL and on the followers
+// with DEL, followers never evict keys themselves. The database lock must be held by the
+// caller.
+func (s *Server) freeMemory() bool {
+	if s.options.MaxMemory == 0 || s.repl.isFollower() {
+		return true
+	}
+
+	for s.db.UsedMemory() > s.options.MaxMemory {
+		key, evicted := s.db.Evict(s.options.MaxMemoryPolicy, s.options.MaxMemorySamples)
+		if !evicted {
+			return false
+		}
+
+		if _, err := s.propagate(StringifyArgs([]string{"del", key})); err != nil {
+			fmt.Println(err)
+		}
+		s.touchWatched(&Command{Kind: CmdDel, Keys: []string{key}})
+	}
+
+	return true
+}
+
+func (s *Server) memoryInfo() string {
+	var info strings.Builder
+	info.WriteString("# Memory\r\n")
+	fmt.Fprintf(&info, "used_memory:%d\r\n", s.db.UsedMemory())
+	fmt.Fprintf(&info, "maxmemory:%d\r\n", s.options.MaxMemory)
+	info.WriteString("maxmemory_policy:" + s.options.MaxMemoryPolicy + "\r\n")
+
+	return info.String()
+}
+
+// Get the memory used by the keys of every type and the heap statistics of the runtime, as a
+// list of name-value pairs like MEMORY STATS in Redis
+func (s *Server) memoryStats() []any {
+	used := s.db.UsedMemory()
+	keys := s.db.Size()
+	perKey := 0
+	if keys > 0 {
+		perKey = used / keys
+	}
+
+	stats := []any{"dataset.bytes", used, "keys.count", keys, "keys.bytes-per-key", perKey}
+	usage := s.db.MemoryByType()
+	for _, kind := range []db.MemoObjType{db.ObjValue, db.ObjList, db.ObjSet, db.ObjHash, db.ObjZSet, db.ObjPQueue} {
+		name := db.TypeName(kind)
+		stats = append(stats, name+".bytes", usage[name])
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return append(stats,
+		"heap.alloc", int(mem.HeapAlloc),
+		"heap.inuse", int(mem.HeapInuse),
+		"heap.sys", int(mem.HeapSys),
+		"heap.objects", int(mem.HeapObjects),
+		"gc.count", int(mem.NumGC),
+		"gc.pause-total-ms", int(mem.PauseTotalNs/uint64(time.Millisecond)),
+	)
+}
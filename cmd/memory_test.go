@@ -0,0 +1,53 @@
+package main
+
+import (
+	"skabillium/memo/cmd/db"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStats(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+	s.Execute(&Command{Kind: CmdSet, Key: "name", Value: strings.Repeat("x", 1000)})
+	s.Execute(&Command{Kind: CmdSetAdd, Key: "set", Values: []string{"a", "b"}})
+
+	stats := map[string]int{}
+	res := s.Execute(&Command{Kind: CmdMemoryStats}).([]any)
+	for i := 0; i < len(res); i += 2 {
+		stats[res[i].(string)] = res[i+1].(int)
+	}
+	if stats["keys.count"] != 2 || stats["string.bytes"] < 1000 || stats["set.bytes"] == 0 || stats["heap.alloc"] == 0 {
+		t.Error("Expected other memory stats, got", stats)
+	}
+	if stats["dataset.bytes"] != stats["string.bytes"]+stats["set.bytes"] {
+		t.Error("Expected the dataset to be the sum of the types, got", stats)
+	}
+}
+
+func TestFreeMemory(t *testing.T) {
+	s := NewServer(&ServerOptions{MaxMemory: 10000, MaxMemoryPolicy: db.NoEviction, MaxMemorySamples: 5})
+	value := strings.Repeat("x", 1000)
+
+	var res any
+	for i := 0; i < 20 && res != ErrOOM; i++ {
+		res, _ = s.executeWrite(&Command{Kind: CmdSet, Key: "key:" + strconv.Itoa(i), Value: value}, "")
+	}
+	if res != ErrOOM {
+		t.Fatal("Expected writes to be rejected with noeviction")
+	}
+	if res, _ := s.executeWrite(&Command{Kind: CmdDel, Keys: []string{"key:0"}}, "del key:0"); res == ErrOOM {
+		t.Error("Expected DEL to be allowed over the memory limit")
+	}
+
+	s.options.MaxMemoryPolicy = db.AllKeysLRU
+	for i := 0; i < 20; i++ {
+		if res, _ := s.executeWrite(&Command{Kind: CmdSet, Key: "key:" + strconv.Itoa(i), Value: value}, ""); res == ErrOOM {
+			t.Fatal("Expected keys to be evicted with allkeys-lru")
+		}
+	}
+	// Keys are evicted before writes, so the last write can exceed the limit
+	if !s.freeMemory() || s.db.UsedMemory() > 10000 || s.db.Stats().EvictedKeys == 0 {
+		t.Error("Expected keys to be evicted to stay under the limit, used", s.db.UsedMemory())
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"skabillium/memo/cmd/db"
+	"sort"
+	"sync"
+)
+
+// Number of messages that can be queued for a subscriber before it is disconnected
+const SubscriberBufferSize = 1 << 12
+
+var ErrSubscriberMode = errors.New("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+
+// A connection that subscribed to at least one channel or pattern. Once a connection
+// subscribes, everything written to it goes through the channel so that replies and
+// published messages are never written at the same time.
+type subscriber struct {
+	ctx      *MemoContext
+	ch       chan any
+	done     chan struct{} // Closed when everything in the channel has been written
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+func newSubscriber(ctx *MemoContext) *subscriber {
+	sub := &subscriber{
+		ctx:      ctx,
+		ch:       make(chan any, SubscriberBufferSize),
+		done:     make(chan struct{}),
+		channels: map[string]bool{},
+		patterns: map[string]bool{},
+	}
+	go sub.run()
+
+	return sub
+}
+
+func (sub *subscriber) run() {
+	defer close(sub.done)
+
+	for msg := range sub.ch {
+		sub.ctx.Write(msg)
+		if len(sub.ch) == 0 {
+			sub.ctx.End()
+		}
+	}
+}
+
+// Queue a message for the subscriber, returns false if it was not queued because the
+// subscriber can't keep up, in which case it is disconnected
+func (sub *subscriber) send(msg any) bool {
+	select {
+	case sub.ch <- msg:
+		return true
+	default:
+		fmt.Println("Subscriber", sub.ctx.conn.RemoteAddr(), "can't keep up, disconnecting")
+		sub.ctx.conn.Close()
+		return false
+	}
+}
+
+func (sub *subscriber) count() int {
+	return len(sub.channels) + len(sub.patterns)
+}
+
+// Keeps track of the subscribers of every channel and pattern. It has its own lock so that
+// publishing never waits for the database lock and vice versa.
+type pubsub struct {
+	mu       sync.Mutex
+	channels map[string]map[*subscriber]bool
+	patterns map[string]map[*subscriber]bool
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{
+		channels: map[string]map[*subscriber]bool{},
+		patterns: map[string]map[*subscriber]bool{},
+	}
+}
+
+func addSubscriber(subs map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	if subs[name] == nil {
+		subs[name] = map[*subscriber]bool{}
+	}
+	subs[name][sub] = true
+}
+
+func removeSubscriber(subs map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	delete(subs[name], sub)
+	if len(subs[name]) == 0 {
+		delete(subs, name)
+	}
+}
+
+// Subscribe to a channel, the confirmation is sent while holding the lock so that it is
+// always received before the first message
+func (ps *pubsub) subscribe(sub *subscriber, channel string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	sub.channels[channel] = true
+	addSubscriber(ps.channels, channel, sub)
+	sub.send([]any{"subscribe", channel, sub.count()})
+}
+
+func (ps *pubsub) unsubscribe(sub *subscriber, channel string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(sub.channels, channel)
+	removeSubscriber(ps.channels, channel, sub)
+	return sub.count()
+}
+
+func (ps *pubsub) psubscribe(sub *subscriber, pattern string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	sub.patterns[pattern] = true
+	addSubscriber(ps.patterns, pattern, sub)
+	sub.send([]any{"psubscribe", pattern, sub.count()})
+}
+
+func (ps *pubsub) punsubscribe(sub *subscriber, pattern string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(sub.patterns, pattern)
+	removeSubscriber(ps.patterns, pattern, sub)
+	return sub.count()
+}
+
+// Remove all subscriptions of a subscriber, after this no more messages are sent to it
+func (ps *pubsub) remove(sub *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.unregister(sub)
+	sub.channels = map[string]bool{}
+	sub.patterns = map[string]bool{}
+}
+
+// Stop sending messages to a subscriber, its own list of subscriptions is left as is since
+// only its connection changes it. The lock must be held by the caller.
+func (ps *pubsub) unregister(sub *subscriber) {
+	for channel := range sub.channels {
+		removeSubscriber(ps.channels, channel, sub)
+	}
+	for pattern := range sub.patterns {
+		removeSubscriber(ps.patterns, pattern, sub)
+	}
+}
+
+// Send a message to every subscriber of the channel and every subscriber of a matching
+// pattern, returns the number of subscribers the message was queued for. Subscribers that
+// are disconnected for not keeping up receive nothing else.
+func (ps *pubsub) publish(channel string, message string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	receivers := 0
+	for sub := range ps.channels[channel] {
+		if sub.send([]any{"message", channel, message}) {
+			receivers++
+		} else {
+			ps.unregister(sub)
+		}
+	}
+
+	for pattern, subs := range ps.patterns {
+		if !db.Match(pattern, channel) {
+			continue
+		}
+
+		for sub := range subs {
+			if sub.send([]any{"pmessage", pattern, channel, message}) {
+				receivers++
+			} else {
+				ps.unregister(sub)
+			}
+		}
+	}
+
+	return receivers
+}
+
+// Get the channels with at least one subscriber, an empty pattern matches all channels
+func (ps *pubsub) activeChannels(pattern string) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	channels := []string{}
+	for channel := range ps.channels {
+		if pattern != "" {
+			if !db.Match(pattern, channel) {
+				continue
+			}
+		}
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	return channels
+}
+
+// Get the number of subscribers of every channel as a flat list, eg. [channel1, 2, channel2, 0]
+func (ps *pubsub) numSub(channels []string) []any {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	out := make([]any, 0, len(channels)*2)
+	for _, channel := range channels {
+		out = append(out, channel, len(ps.channels[channel]))
+	}
+
+	return out
+}
+
+func (ps *pubsub) numPat() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.patterns)
+}
+
+// Commands that are handled by the Pub/Sub broker instead of the database
+func isPubSubCommand(kind CommandType) bool {
+	switch kind {
+	case CmdSubscribe, CmdUnsubscribe, CmdPSubscribe, CmdPUnsubscribe, CmdPublish,
+		CmdPubSubChannels, CmdPubSubNumSub, CmdPubSubNumPat:
+		return true
+	}
+
+	return false
+}
+
+// Handle a Pub/Sub command or any command of a connection in subscriber mode. The
+// connection enters subscriber mode with its first subscription and leaves it when it has
+// no subscriptions left.
+func (s *Server) handlePubSub(ctx *MemoContext, cmd *Command) {
+	sub := ctx.subscriber
+	reply := ctx.Reply
+
+	switch cmd.Kind {
+	case CmdSubscribe, CmdUnsubscribe, CmdPSubscribe, CmdPUnsubscribe, CmdPing:
+	default:
+		if sub != nil {
+			reply(ErrSubscriberMode)
+			return
+		}
+	}
+
+	switch cmd.Kind {
+	case CmdPublish:
+		reply(s.pubsub.publish(cmd.Key, cmd.Value))
+	case CmdPubSubChannels:
+		reply(s.pubsub.activeChannels(cmd.Pattern))
+	case CmdPubSubNumSub:
+		reply(s.pubsub.numSub(cmd.Keys))
+	case CmdPubSubNumPat:
+		reply(s.pubsub.numPat())
+	case CmdSubscribe, CmdPSubscribe:
+		if sub == nil {
+			sub = newSubscriber(ctx)
+			ctx.subscriber = sub
+		}
+
+		for _, name := range cmd.Keys {
+			if cmd.Kind == CmdSubscribe {
+				s.pubsub.subscribe(sub, name)
+			} else {
+				s.pubsub.psubscribe(sub, name)
+			}
+		}
+	case CmdUnsubscribe, CmdPUnsubscribe:
+		kind, names := "unsubscribe", cmd.Keys
+		if cmd.Kind == CmdPUnsubscribe {
+			kind = "punsubscribe"
+		}
+
+		// Without arguments unsubscribe from everything
+		if len(names) == 0 && sub != nil {
+			subscriptions := sub.channels
+			if cmd.Kind == CmdPUnsubscribe {
+				subscriptions = sub.patterns
+			}
+			for name := range subscriptions {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+
+		if len(names) == 0 {
+			count := 0
+			if sub != nil {
+				count = sub.count()
+			}
+			reply([]any{kind, nil, count})
+		}
+
+		for _, name := range names {
+			count := 0
+			if sub != nil && cmd.Kind == CmdUnsubscribe {
+				count = s.pubsub.unsubscribe(sub, name)
+			} else if sub != nil {
+				count = s.pubsub.punsubscribe(sub, name)
+			}
+			reply([]any{kind, name, count})
+		}
+
+		if sub != nil && sub.count() == 0 {
+			s.closeSubscriber(ctx)
+		}
+	case CmdPing:
+		reply([]any{"pong", ""})
+	}
+}
+
+// Remove all subscriptions of the connection and wait for the queued messages to be written
+func (s *Server) closeSubscriber(ctx *MemoContext) {
+	s.pubsub.remove(ctx.subscriber)
+	close(ctx.subscriber.ch)
+	<-ctx.subscriber.done
+	ctx.subscriber = nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"skabillium/memo/cmd/resp"
+	"testing"
+)
+
+func TestPubSub(t *testing.T) {
+	ps := newPubSub()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	sub := newSubscriber(NewMemoContext(server))
+	r := bufio.NewReader(client)
+
+	read := func() any {
+		msg, err := resp.Read(r)
+		if err != nil {
+			t.Fatal("Unexpected error reading message", err)
+		}
+		return msg
+	}
+
+	ps.subscribe(sub, "news")
+	ps.psubscribe(sub, "n*")
+	if msg := read(); !reflect.DeepEqual(msg, []any{"subscribe", "news", 1}) {
+		t.Error("Expected subscribe confirmation, got", msg)
+	}
+	if msg := read(); !reflect.DeepEqual(msg, []any{"psubscribe", "n*", 2}) {
+		t.Error("Expected psubscribe confirmation, got", msg)
+	}
+
+	if n := ps.publish("news", "hello"); n != 2 {
+		t.Error("Expected publish('news') to have 2 receivers, got", n)
+	}
+	if msg := read(); !reflect.DeepEqual(msg, []any{"message", "news", "hello"}) {
+		t.Error("Expected message, got", msg)
+	}
+	if msg := read(); !reflect.DeepEqual(msg, []any{"pmessage", "n*", "news", "hello"}) {
+		t.Error("Expected pattern message, got", msg)
+	}
+
+	if n := ps.publish("sport", "hi"); n != 0 {
+		t.Error("Expected publish('sport') to have no receivers, got", n)
+	}
+	if channels := ps.activeChannels(""); !reflect.DeepEqual(channels, []string{"news"}) {
+		t.Error("Expected active channels to be [news], got", channels)
+	}
+	if numSub := ps.numSub([]string{"news", "sport"}); !reflect.DeepEqual(numSub, []any{"news", 1, "sport", 0}) {
+		t.Error("Expected numSub to be [news 1 sport 0], got", numSub)
+	}
+
+	ps.remove(sub)
+	if ps.numPat() != 0 || len(ps.activeChannels("")) != 0 {
+		t.Error("Expected no subscriptions after remove()")
+	}
+	if n := ps.publish("news", "hello"); n != 0 {
+		t.Error("Expected publish('news') to have no receivers after remove(), got", n)
+	}
+}
+
+func TestPublishSlowSubscriber(t *testing.T) {
+	ps := newPubSub()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	// Nothing is written to the connection, so the buffer is full after the confirmations
+	sub := &subscriber{ctx: NewMemoContext(server), ch: make(chan any, 2), channels: map[string]bool{}, patterns: map[string]bool{}}
+	ps.subscribe(sub, "news")
+	ps.psubscribe(sub, "n*")
+
+	if n := ps.publish("news", "hello"); n != 0 {
+		t.Error("Expected publish('news') to not be queued for a full subscriber, got", n)
+	}
+	if numSub := ps.numSub([]string{"news"}); !reflect.DeepEqual(numSub, []any{"news", 0}) || ps.numPat() != 0 {
+		t.Error("Expected the disconnected subscriber to be removed, got", numSub, ps.numPat())
+	}
+	if _, err := client.Write([]byte("ping")); err == nil {
+		t.Error("Expected the subscriber connection to be closed")
+	}
+	if sub.count() != 2 {
+		t.Error("Expected the subscriptions of the connection to be left as is, got", sub.count())
+	}
+}
+
+// Errors for commands sent in subscriber mode are written by the subscriber, run with -race
+func TestSubscriberErrors(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+	server, client := net.Pipe()
+	defer client.Close()
+	s.newConn()
+	go s.handleConnection(server)
+
+	r := bufio.NewReader(client)
+	payload, _ := resp.Serialize([]any{"subscribe", "news"})
+	client.Write([]byte(payload))
+	if msg, err := resp.Read(r); err != nil || !reflect.DeepEqual(msg, []any{"subscribe", "news", 1}) {
+		t.Fatal("Expected subscribe confirmation, got", msg, err)
+	}
+
+	const n = 100
+	go func() {
+		for i := 0; i < n; i++ {
+			s.pubsub.publish("news", "hello")
+		}
+	}()
+	go func() {
+		payload, _ := resp.Serialize([]any{"unknown"})
+		for i := 0; i < n; i++ {
+			client.Write([]byte(payload))
+		}
+	}()
+
+	messages, errs := 0, 0
+	for messages+errs < 2*n {
+		msg, err := resp.Read(r)
+		if err != nil {
+			t.Fatal("Unexpected error reading message", err)
+		}
+		if _, ok := msg.(error); ok {
+			errs++
+		} else if reflect.DeepEqual(msg, []any{"message", "news", "hello"}) {
+			messages++
+		} else {
+			t.Fatal("Expected a message or an error, got", msg)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+func newLeaseId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Put the reserved queue items whose lease expired back to their queues. This goes through
+// the WAL and the followers like any other write, followers only apply what the leader sends.
+// The database lock must be held by the caller.
+func (s *Server) redeliverExpired() {
+	if s.repl.isFollower() {
+		return
+	}
+
+	for _, lease := range s.db.ExpiredLeases(time.Now().UnixMilli()) {
+		nack := &Command{Kind: CmdQueueNack, Key: lease.Queue, LeaseId: lease.Id}
+		s.executeWrite(nack, StringifyArgs([]string{"qnack", lease.Queue, lease.Id}))
+	}
+}
+
+// Commands that read or take the items of queues, delayed items that are due are made visible
+// before they run
+func seesQueueItems(kind CommandType) bool {
+	switch kind {
+	case CmdQueuePop, CmdQueueReserve, CmdBQPop, CmdQueuePeek, CmdQueueRange:
+		return true
+	}
+
+	return false
+}
+
+// Make the due delayed items of the queues of a command visible. Promotions are written to the
+// WAL and sent to the followers, so they see the same items as the leader regardless of their
+// clock. The database lock must be held by the caller.
+func (s *Server) promoteDue(cmd *Command) {
+	if s.repl.isFollower() {
+		return
+	}
+
+	keys := cmd.Keys
+	if cmd.Key != "" {
+		keys = []string{cmd.Key}
+	}
+
+	now := time.Now().UnixMilli()
+	for _, key := range keys {
+		if s.db.PQDue(key, now) > 0 {
+			s.promote(key, now)
+		}
+	}
+}
+
+// Make the due delayed items of all queues visible, so clients blocked on them are served.
+// The database lock must be held by the caller.
+func (s *Server) promoteScheduled() {
+	if s.repl.isFollower() {
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	for _, key := range s.db.DueQueues(now) {
+		s.promote(key, now)
+	}
+}
+
+func (s *Server) promote(key string, now int64) {
+	at := strconv.FormatInt(now, 10)
+	promote := &Command{Kind: CmdQueuePromote, Key: key, NotBefore: now}
+	s.executeWrite(promote, StringifyArgs([]string{"qpromote", key, at}))
+}
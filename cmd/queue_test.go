@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedeliverExpired(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+	s.Execute(&Command{Kind: CmdQueueAdd, Key: "jobs", Values: []string{"a", "b"}, Priority: 1})
+
+	expired := s.Execute(&Command{Kind: CmdQueueReserve, Key: "jobs", LeaseId: "old", ExpireAt: 1})
+	if !reflect.DeepEqual(expired, []any{"old", "a", 1}) {
+		t.Error("Expected QRESERVE to return [old a 1], got", expired)
+	}
+	s.Execute(&Command{Kind: CmdQueueReserve, Key: "jobs", LeaseId: "new", ExpireAt: 1 << 62})
+
+	s.dbmu.Lock()
+	s.redeliverExpired()
+	s.dbmu.Unlock()
+
+	if res := s.Execute(&Command{Kind: CmdQueueAck, Key: "jobs", LeaseId: "old"}); res != 0 {
+		t.Error("Expected expired lease to be released, got", res)
+	}
+	if res := s.Execute(&Command{Kind: CmdQueuePop, Key: "jobs"}); res != "a" {
+		t.Error("Expected expired item to be redelivered, got", res)
+	}
+	if res := s.Execute(&Command{Kind: CmdQueueAck, Key: "jobs", LeaseId: "new"}); res != 1 {
+		t.Error("Expected QACK of an active lease to return 1, got", res)
+	}
+}
+
+func TestPromoteDue(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+	now := time.Now().UnixMilli()
+	s.Execute(&Command{Kind: CmdQueueAdd, Key: "jobs", Values: []string{"due"}, Priority: 2, NotBefore: now - 1})
+	s.Execute(&Command{Kind: CmdQueueAdd, Key: "jobs", Values: []string{"later"}, Priority: 1, NotBefore: now + 60000})
+
+	scheduled := s.Execute(&Command{Kind: CmdQueueScheduled, Key: "jobs"})
+	expected := []any{[]any{"due", "2", int(now - 1)}, []any{"later", "1", int(now + 60000)}}
+	if !reflect.DeepEqual(scheduled, expected) {
+		t.Error("Expected QSCHEDULED to return", expected, "got", scheduled)
+	}
+	if res := s.Execute(&Command{Kind: CmdQueuePop, Key: "jobs"}); res != nil {
+		t.Error("Expected delayed items to not be visible before they are promoted, got", res)
+	}
+
+	s.dbmu.Lock()
+	res, _ := s.executeWrite(&Command{Kind: CmdQueuePop, Key: "jobs"}, "qpop jobs")
+	s.dbmu.Unlock()
+	if res != "due" {
+		t.Error("Expected QPOP to return the due item, got", res)
+	}
+
+	s.dbmu.Lock()
+	res, _ = s.executeWrite(&Command{Kind: CmdQueuePop, Key: "jobs"}, "qpop jobs")
+	s.dbmu.Unlock()
+	if res != nil {
+		t.Error("Expected the item that is not due to stay delayed, got", res)
+	}
+}
+
+func TestDeadLetterServesBlocked(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+	s.Execute(&Command{Kind: CmdQueueConfig, Key: "jobs", Deliveries: 1, Value: "dead"})
+	s.Execute(&Command{Kind: CmdQueueAdd, Key: "jobs", Values: []string{"a", "b"}, Priority: 1})
+	s.Execute(&Command{Kind: CmdQueueReserve, Key: "jobs", LeaseId: "nacked", ExpireAt: 1 << 62})
+	s.Execute(&Command{Kind: CmdQueueReserve, Key: "jobs", LeaseId: "expired", ExpireAt: 1})
+
+	results := make(chan any, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- s.blockingPop(NewMemoContext(nil), &Command{Kind: CmdBQPop, Keys: []string{"dead"}})
+		}()
+		waitBlocked(s, "dead", i+1)
+	}
+
+	s.dbmu.Lock()
+	s.executeWrite(&Command{Kind: CmdQueueNack, Key: "jobs", LeaseId: "nacked"}, "qnack jobs nacked")
+	s.dbmu.Unlock()
+	if res := <-results; !reflect.DeepEqual(res, []any{"dead", "a"}) {
+		t.Error("Expected QNACK to serve the client blocked on the dead letter queue, got", res)
+	}
+
+	s.dbmu.Lock()
+	s.redeliverExpired()
+	s.dbmu.Unlock()
+	if res := <-results; !reflect.DeepEqual(res, []any{"dead", "b"}) {
+		t.Error("Expected an expired lease to serve the client blocked on the dead letter queue, got", res)
+	}
+}
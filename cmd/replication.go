@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"skabillium/memo/cmd/db"
+	"skabillium/memo/cmd/resp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of commands that can be queued for a follower before it is disconnected
+const ReplicaBufferSize = 1 << 16
+
+// How often followers acknowledge the offset they have processed
+const ReplicaAckInterval = time.Second
+
+// How long a follower waits before reconnecting to its leader
+const ReplicaRetryInterval = time.Second
+
+var ErrReadOnly = errors.New("READONLY You can't write against a read only replica")
+
+// A follower connected to this server
+type replica struct {
+	ctx       *MemoContext
+	ch        chan string
+	ackOffset int64
+	lastAck   time.Time
+}
+
+// Replication state of the server, it is guarded by the database lock. Every write command
+// is sent to all the followers in the order it was executed, the offset is the total number
+// of bytes of the replication stream so far. Followers keep the id and offset of their leader.
+type replicationState struct {
+	id       string
+	offset   int64
+	replicas []*replica
+	backlog  *backlog
+
+	// Id of the leader this server followed before it was promoted and the offset up to
+	// which its history is shared, so followers of the old leader can continue from here
+	prevId     string
+	prevOffset int64
+
+	// Follower only
+	leader string        // Address of the leader, empty if this server is a leader
+	stop   chan struct{} // Closed to stop replicating from the current leader
+	linkUp bool
+	lastIO time.Time
+	conn   net.Conn
+}
+
+func newReplicationId() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (r *replicationState) isFollower() bool {
+	return r.leader != ""
+}
+
+// Send a write command to all the followers, followers that can't keep up are disconnected
+// and will have to sync again. The database lock must be held by the caller.
+func (s *Server) replicate(exec string) {
+	record := resp.SerializeStr(exec)
+	s.repl.offset += int64(len(record))
+	s.repl.backlog.write(record)
+
+	replicas := s.repl.replicas[:0]
+	for _, r := range s.repl.replicas {
+		select {
+		case r.ch <- exec:
+			replicas = append(replicas, r)
+		default:
+			fmt.Println("Follower", r.ctx.conn.RemoteAddr(), "can't keep up, disconnecting")
+			close(r.ch)
+		}
+	}
+	s.repl.replicas = replicas
+}
+
+// Handle a SYNC or PSYNC request from a follower. If the follower asked to continue from an
+// offset that is still in the backlog it only receives the part of the stream it missed,
+// otherwise it receives a snapshot of the database. In both cases it then receives every
+// write command executed from that point on.
+func (s *Server) syncReplica(ctx *MemoContext, cmd *Command) {
+	s.dbmu.Lock()
+	r := &replica{ctx: ctx, ch: make(chan string, ReplicaBufferSize), lastAck: time.Now()}
+	r.ackOffset = s.repl.offset
+	s.repl.replicas = append(s.repl.replicas, r)
+	ctx.replica = r
+
+	if cmd.Kind == CmdPSync {
+		if missed, ok := s.missedSince(cmd.ReplId, cmd.Offset); ok {
+			header := "CONTINUE " + s.repl.id
+			s.dbmu.Unlock()
+
+			ctx.Write(resp.SimpleString(header))
+			ctx.rw.Write(missed)
+			ctx.End()
+
+			fmt.Printf("Follower %s continued from offset %d\n", ctx.conn.RemoteAddr(), cmd.Offset)
+			go s.streamToReplica(r)
+			return
+		}
+	}
+
+	clone := s.db.Clone()
+	header := fmt.Sprintf("FULLRESYNC %s %d", s.repl.id, s.repl.offset)
+	s.dbmu.Unlock()
+
+	var snapshot bytes.Buffer
+	if err := clone.WriteSnapshot(&snapshot, nil); err != nil {
+		fmt.Println("Failed to create snapshot for follower:", err)
+		s.removeReplica(r)
+		ctx.conn.Close()
+		return
+	}
+
+	ctx.Write(resp.SimpleString(header))
+	ctx.Write(snapshot.String())
+	ctx.End()
+
+	fmt.Println("Follower", ctx.conn.RemoteAddr(), "synced")
+	go s.streamToReplica(r)
+}
+
+// Get the part of the replication stream after the given offset, if the history of this
+// server is the same as the one of the given id up to that point and it is still in the
+// backlog. The database lock must be held by the caller.
+func (s *Server) missedSince(id string, offset int64) ([]byte, bool) {
+	if id != s.repl.id && !(id == s.repl.prevId && offset <= s.repl.prevOffset) {
+		return nil, false
+	}
+
+	return s.repl.backlog.readFrom(offset)
+}
+
+func (s *Server) streamToReplica(r *replica) {
+	for exec := range r.ch {
+		r.ctx.Write(exec)
+		if len(r.ch) == 0 {
+			r.ctx.End()
+		}
+	}
+
+	// The channel is only closed when the follower is dropped
+	r.ctx.conn.Close()
+}
+
+func (s *Server) removeReplica(r *replica) {
+	s.dbmu.Lock()
+	defer s.dbmu.Unlock()
+
+	for i, other := range s.repl.replicas {
+		if other == r {
+			s.repl.replicas = append(s.repl.replicas[:i], s.repl.replicas[i+1:]...)
+			close(r.ch)
+			return
+		}
+	}
+}
+
+func (s *Server) ackReplica(r *replica, offset int64) {
+	s.dbmu.Lock()
+	defer s.dbmu.Unlock()
+	r.ackOffset = offset
+	r.lastAck = time.Now()
+}
+
+// Start replicating from the given leader, or stop replicating if the address is empty.
+// The database lock must be held by the caller.
+func (s *Server) replicaOf(addr string) {
+	if s.repl.stop != nil {
+		close(s.repl.stop)
+		s.repl.stop = nil
+	}
+	if s.repl.conn != nil {
+		s.repl.conn.Close()
+	}
+
+	s.repl.leader = addr
+	s.repl.linkUp = false
+	if addr == "" {
+		// Writes accepted from now on are a new history, but followers of the old leader
+		// can still continue from any point before this one
+		s.repl.prevId = s.repl.id
+		s.repl.prevOffset = s.repl.offset
+		s.repl.id = newReplicationId()
+		s.Info.Role = "leader"
+		fmt.Println("Stopped replication, running as leader")
+		return
+	}
+
+	s.Info.Role = "follower"
+	s.repl.stop = make(chan struct{})
+	go s.runReplication(addr, s.repl.stop)
+}
+
+// Keep replicating from the leader until stopped, reconnecting if the connection drops
+func (s *Server) runReplication(addr string, stop chan struct{}) {
+	for {
+		err := s.replicateFrom(addr, stop)
+
+		s.dbmu.Lock()
+		s.repl.linkUp = false
+		s.dbmu.Unlock()
+
+		if isClosed(stop) {
+			return
+		}
+
+		fmt.Println("Lost connection to leader", addr+":", err)
+		time.Sleep(ReplicaRetryInterval)
+	}
+}
+
+func (s *Server) replicateFrom(addr string, stop chan struct{}) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.dbmu.Lock()
+	if isClosed(stop) {
+		s.dbmu.Unlock()
+		return nil
+	}
+	s.repl.conn = conn
+	s.dbmu.Unlock()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	send := func(args ...string) error {
+		req := make([]any, len(args))
+		for i, arg := range args {
+			req[i] = arg
+		}
+		payload, _ := resp.Serialize(req)
+		rw.WriteString(payload)
+		return rw.Flush()
+	}
+
+	// Followers use their own credentials to authenticate with the leader
+	if err := send("auth", s.options.User, s.options.Password); err != nil {
+		return err
+	}
+	if res, err := resp.Read(rw.Reader); err != nil {
+		return err
+	} else if err, ok := res.(error); ok {
+		return err
+	}
+
+	// Try to continue from where the last connection stopped
+	s.dbmu.Lock()
+	id, offset := s.repl.id, s.repl.offset
+	s.dbmu.Unlock()
+
+	if err := send("psync", id, strconv.FormatInt(offset, 10)); err != nil {
+		return err
+	}
+	if err := s.readSyncResponse(rw.Reader, stop); err != nil {
+		return err
+	}
+
+	go s.sendAcks(send, stop)
+
+	for {
+		exec, err := readBulkString(rw.Reader)
+		if err != nil {
+			return err
+		}
+
+		cmds, execs, err := parseRecord(exec)
+		if err != nil {
+			return err
+		}
+
+		s.dbmu.Lock()
+		if isClosed(stop) {
+			s.dbmu.Unlock()
+			return nil
+		}
+
+		// Applying the record also advances the offset by the same number of bytes the
+		// leader did and passes it on to the followers of this server
+		s.repl.lastIO = time.Now()
+		s.applyRecord(exec, cmds, execs)
+		s.dbmu.Unlock()
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Read the response to PSYNC, if the leader could not continue from the requested offset
+// the database is replaced with the snapshot sent by the leader
+func (s *Server) readSyncResponse(rd *bufio.Reader, stop chan struct{}) error {
+	res, err := resp.Read(rd)
+	if err != nil {
+		return err
+	}
+	if err, ok := res.(error); ok {
+		return err
+	}
+
+	header, _ := res.(string)
+	parts := strings.Split(header, " ")
+	if len(parts) == 2 && parts[0] == "CONTINUE" {
+		s.dbmu.Lock()
+		s.repl.linkUp = true
+		s.repl.lastIO = time.Now()
+		s.dbmu.Unlock()
+
+		fmt.Println("Continuing replication from leader", s.repl.leader)
+		return nil
+	}
+
+	if len(parts) != 3 || parts[0] != "FULLRESYNC" {
+		return fmt.Errorf("unexpected response to psync '%s'", header)
+	}
+	offset, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := readBulkString(rd)
+	if err != nil {
+		return err
+	}
+	d, _, err := db.ReadSnapshot(strings.NewReader(snapshot))
+	if err != nil {
+		return err
+	}
+
+	s.dbmu.Lock()
+	defer s.dbmu.Unlock()
+
+	if isClosed(stop) {
+		return nil
+	}
+
+	// Followers of this server have a different dataset now, so they have to sync again
+	for _, r := range s.repl.replicas {
+		close(r.ch)
+	}
+	s.repl.replicas = nil
+
+	s.db = d
+	s.repl.id = parts[1]
+	s.repl.offset = offset
+	s.repl.prevId = ""
+	s.repl.backlog.reset(offset)
+	s.repl.linkUp = true
+	s.repl.lastIO = time.Now()
+
+	// Persist the new dataset, the old WAL describes a history that no longer applies
+	if s.wal != nil {
+		if err := s.save(); err != nil {
+			fmt.Println("Failed to save dataset received from leader:", err)
+		}
+	}
+
+	fmt.Println("Full sync with leader", s.repl.leader, "completed")
+	return nil
+}
+
+// Periodically let the leader know how much of the replication stream has been processed
+func (s *Server) sendAcks(send func(args ...string) error, stop chan struct{}) {
+	ticker := time.NewTicker(ReplicaAckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.dbmu.Lock()
+			offset := s.repl.offset
+			s.dbmu.Unlock()
+
+			if err := send("replconf", "ack", strconv.FormatInt(offset, 10)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read a bulk string, unlike resp.Read() this can read strings of any size
+func readBulkString(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if line[0] != resp.RespString {
+		return "", fmt.Errorf("expected bulk string, got '%s'", strings.TrimSpace(line))
+	}
+
+	n, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return "", err
+	}
+
+	return string(b[:n]), nil
+}
+
+// Replication section of the INFO command
+func (s *Server) replicationInfo() string {
+	var info strings.Builder
+	info.WriteString("# Replication\r\n")
+	info.WriteString("role:" + s.Info.Role + "\r\n")
+
+	if s.repl.isFollower() {
+		host, port, _ := net.SplitHostPort(s.repl.leader)
+		status := "down"
+		if s.repl.linkUp {
+			status = "up"
+		}
+
+		info.WriteString("leader_host:" + host + "\r\n")
+		info.WriteString("leader_port:" + port + "\r\n")
+		info.WriteString("leader_link_status:" + status + "\r\n")
+		if !s.repl.lastIO.IsZero() {
+			fmt.Fprintf(&info, "leader_last_io_seconds_ago:%d\r\n", int(time.Since(s.repl.lastIO).Seconds()))
+		}
+	}
+
+	fmt.Fprintf(&info, "connected_followers:%d\r\n", len(s.repl.replicas))
+	for i, r := range s.repl.replicas {
+		fmt.Fprintf(&info, "follower%d:addr=%s,offset=%d,lag=%d\r\n",
+			i, r.ctx.conn.RemoteAddr(), r.ackOffset, int(time.Since(r.lastAck).Seconds()))
+	}
+
+	info.WriteString("replication_id:" + s.repl.id + "\r\n")
+	fmt.Fprintf(&info, "replication_offset:%d\r\n", s.repl.offset)
+
+	return info.String()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"skabillium/memo/cmd/db"
+	"skabillium/memo/cmd/resp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReplicationServer() *Server {
+	return NewServer(&ServerOptions{AuthEnabled: true, User: "memo", Password: "secret"})
+}
+
+// Serve connections on a loopback listener, returns its address
+func listen(t *testing.T, s *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.newConn()
+			go s.handleConnection(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func follow(t *testing.T, s *Server, addr string) {
+	s.dbmu.Lock()
+	s.replicaOf(addr)
+	s.dbmu.Unlock()
+
+	t.Cleanup(func() {
+		s.dbmu.Lock()
+		s.replicaOf("")
+		s.dbmu.Unlock()
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func replicationOffset(s *Server) int64 {
+	s.dbmu.RLock()
+	defer s.dbmu.RUnlock()
+	return s.repl.offset
+}
+
+func replicationInfo(s *Server) string {
+	return s.ExecuteAndLog(&Command{Kind: CmdInfo, Section: "replication"}, "").(string)
+}
+
+func TestReplication(t *testing.T) {
+	leader := newReplicationServer()
+	addr := listen(t, leader)
+	execLine(t, leader, "set before sync")
+
+	// The follower authenticates with its own credentials, which are the same as the leader's
+	follower := newReplicationServer()
+	follow(t, follower, addr)
+	waitFor(t, "full sync", func() bool { return execLine(t, follower, "get before") == "sync" })
+
+	execLine(t, leader, "set after sync")
+	execLine(t, leader, "hincrby hash f 2")
+	ctx := NewMemoContext(nil)
+	ctx.tx.active = true
+	for _, line := range []string{"rpush list a", "rpush list b"} {
+		cmd, _ := ParseCommand(line)
+		ctx.tx.queue = append(ctx.tx.queue, queuedCommand{cmd: cmd, exec: line})
+	}
+	leader.execTransaction(ctx)
+
+	offset := replicationOffset(leader)
+	waitFor(t, "streamed writes", func() bool { return replicationOffset(follower) == offset })
+	if res := execLine(t, follower, "get after"); res != "sync" {
+		t.Error("Expected after to be 'sync', got", res)
+	}
+	if res := execLine(t, follower, "hget hash f"); res != "2" {
+		t.Error("Expected hash field to be 2, got", res)
+	}
+	if res := execLine(t, follower, "llen list"); res != 2 {
+		t.Error("Expected list length to be 2, got", res)
+	}
+
+	if res := execLine(t, follower, "set other value"); res != ErrReadOnly {
+		t.Error("Expected write on follower to fail with", ErrReadOnly, "got", res)
+	}
+
+	info := replicationInfo(follower)
+	for _, field := range []string{"role:follower", "leader_link_status:up", "replication_offset:" + strconv.FormatInt(offset, 10)} {
+		if !regexp.MustCompile(`(?m)^` + field + `\r$`).MatchString(info) {
+			t.Error("Expected follower info to contain", field, "got", info)
+		}
+	}
+
+	// Followers acknowledge their offset every second
+	ack := regexp.MustCompile(`follower0:addr=[^,]+,offset=` + strconv.FormatInt(offset, 10) + `,lag=[01]\r`)
+	waitFor(t, "acknowledged offset", func() bool { return ack.MatchString(replicationInfo(leader)) })
+	if info := replicationInfo(leader); !regexp.MustCompile(`connected_followers:1\r`).MatchString(info) {
+		t.Error("Expected leader to have one follower, got", info)
+	}
+}
+
+func TestReplicationWrongPassword(t *testing.T) {
+	leader := newReplicationServer()
+	addr := listen(t, leader)
+
+	follower := NewServer(&ServerOptions{User: "memo", Password: "wrong"})
+	follow(t, follower, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	if info := replicationInfo(follower); !regexp.MustCompile(`leader_link_status:down\r`).MatchString(info) {
+		t.Error("Expected the link to be down, got", info)
+	}
+	if info := replicationInfo(leader); !regexp.MustCompile(`connected_followers:0\r`).MatchString(info) {
+		t.Error("Expected leader to have no followers, got", info)
+	}
+}
+
+// Connect to the leader like a follower and send PSYNC, returns the reply and the connection
+// to read the replication stream from
+func psync(t *testing.T, addr string, id string, offset int64) (string, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	rd := bufio.NewReader(conn)
+	for _, req := range [][]any{{"auth", "memo", "secret"}, {"psync", id, strconv.FormatInt(offset, 10)}} {
+		payload, _ := resp.Serialize(req)
+		conn.Write([]byte(payload))
+	}
+	if res, err := resp.Read(rd); err != nil {
+		t.Fatal("Unexpected error reading auth reply", err)
+	} else if err, ok := res.(error); ok {
+		t.Fatal("Expected auth to succeed, got", err)
+	}
+
+	res, err := resp.Read(rd)
+	if err != nil {
+		t.Fatal("Unexpected error reading psync reply", err)
+	}
+	header, _ := res.(string)
+	return header, rd
+}
+
+func TestPSyncContinue(t *testing.T) {
+	leader := newReplicationServer()
+	addr := listen(t, leader)
+	execLine(t, leader, "set a 1")
+	id, offset := leader.repl.id, replicationOffset(leader)
+
+	execLine(t, leader, "set b 2")
+	execLine(t, leader, "hincrby hash f 1")
+
+	header, rd := psync(t, addr, id, offset)
+	if header != "CONTINUE "+id {
+		t.Fatal("Expected CONTINUE, got", header)
+	}
+
+	// Exactly the writes after the offset are sent, followed by new writes
+	execLine(t, leader, "set c 3")
+	expected := resp.SerializeStr("set b 2") + resp.SerializeStr("hincrby hash f 1") + resp.SerializeStr("set c 3")
+	stream := make([]byte, len(expected))
+	if _, err := io.ReadFull(rd, stream); err != nil || string(stream) != expected {
+		t.Error("Expected stream to be", strconv.Quote(expected), "got", strconv.Quote(string(stream)), err)
+	}
+}
+
+func TestPSyncFullResync(t *testing.T) {
+	leader := NewServer(&ServerOptions{ReplBacklogSize: 32, AuthEnabled: true, User: "memo", Password: "secret"})
+	addr := listen(t, leader)
+	execLine(t, leader, "set a 1")
+	id, offset := leader.repl.id, replicationOffset(leader)
+
+	header, _ := psync(t, addr, "0123456789", offset)
+	if header != "FULLRESYNC "+id+" "+strconv.FormatInt(offset, 10) {
+		t.Error("Expected FULLRESYNC for another id, got", header)
+	}
+
+	// The writes after the offset no longer fit in the backlog
+	execLine(t, leader, "set b 0123456789")
+	execLine(t, leader, "set c 0123456789")
+	end := replicationOffset(leader)
+	header, rd := psync(t, addr, id, offset)
+	if header != "FULLRESYNC "+id+" "+strconv.FormatInt(end, 10) {
+		t.Fatal("Expected FULLRESYNC for an overwritten offset, got", header)
+	}
+
+	snapshot, err := readBulkString(rd)
+	if err != nil {
+		t.Fatal("Unexpected error reading snapshot", err)
+	}
+	d, _, err := db.ReadSnapshot(strings.NewReader(snapshot))
+	if err != nil || d.Size() != 3 {
+		t.Error("Expected snapshot with 3 keys, got", d, err)
+	}
+}
+
+// A follower that loses the connection continues from its offset, so keys it has that the
+// leader doesn't are kept
+func TestFollowerReconnect(t *testing.T) {
+	leader := newReplicationServer()
+	addr := listen(t, leader)
+	execLine(t, leader, "set a 1")
+
+	follower := newReplicationServer()
+	follow(t, follower, addr)
+	waitFor(t, "full sync", func() bool { return execLine(t, follower, "get a") == "1" })
+
+	follower.dbmu.Lock()
+	follower.db.Set("local", "kept", 0)
+	follower.repl.conn.Close()
+	follower.dbmu.Unlock()
+	execLine(t, leader, "set b 2")
+
+	offset := replicationOffset(leader)
+	waitFor(t, "continued sync", func() bool { return replicationOffset(follower) == offset })
+	if res := execLine(t, follower, "get b"); res != "2" {
+		t.Error("Expected b to be 2, got", res)
+	}
+	if res := execLine(t, follower, "get local"); res != "kept" {
+		t.Error("Expected follower to continue without a full sync, got", res)
+	}
+}
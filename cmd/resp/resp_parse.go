@@ -3,6 +3,7 @@ package resp
 import (
 	"bufio"
 	"errors"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -56,6 +57,10 @@ func Read(r *bufio.Reader) (any, error) {
 	case RespStatus:
 		return line[1:], nil
 	case RespString:
+		// Null bulk string
+		if line == "$-1" {
+			return nil, nil
+		}
 		return readString(r, line)
 	case RespError:
 		return errors.New(line[1:]), nil
@@ -72,8 +77,10 @@ func readString(r *bufio.Reader, line string) (string, error) {
 		return "", err
 	}
 
+	// A single read can return less than the whole string when it is larger than the
+	// buffer or only partially received
 	b := make([]byte, n+2)
-	_, err = r.Read(b)
+	_, err = io.ReadFull(r, b)
 	if err != nil {
 		return "", err
 	}
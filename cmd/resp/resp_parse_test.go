@@ -63,6 +63,25 @@ func TestParseBulkString(t *testing.T) {
 	if err != nil || v != "hello" {
 		t.Error("Expected result to be 'hello'")
 	}
+
+	// Larger than the buffer of the reader
+	long := strings.Repeat("x", 100)
+	r = bufio.NewReaderSize(strings.NewReader("$100\r\n"+long+"\r\n$2\r\nok\r\n"), 16)
+	if v, err := Read(r); err != nil || v != long {
+		t.Error("Expected result to be the whole string, got", v)
+	}
+	if v, err := Read(r); err != nil || v != "ok" {
+		t.Error("Expected the next string to be 'ok', got", v)
+	}
+}
+
+func TestParseNullBulkString(t *testing.T) {
+	str := "$-1\r\n"
+	r := bufio.NewReader(strings.NewReader(str))
+	v, err := Read(r)
+	if err != nil || v != nil {
+		t.Error("Expected result to be nil")
+	}
 }
 
 func TestParseError(t *testing.T) {
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"skabillium/memo/cmd/resp"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Default time in milliseconds a script can run before other commands are rejected
+const DefaultScriptTimeLimit = 5000
+
+var ErrNoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+var ErrScriptBusy = errors.New("BUSY Memo is busy running a script. You can only call SCRIPT KILL.")
+var ErrScriptNotBusy = errors.New("NOTBUSY No scripts in execution right now.")
+var ErrScriptUnkillable = errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server.")
+var ErrScriptKilled = errors.New("ERR Script killed by user with SCRIPT KILL...")
+var ErrNotAllowedInScript = errors.New("ERR This command is not allowed from script")
+
+// Commands that manage or run scripts
+func isScriptCommand(kind CommandType) bool {
+	switch kind {
+	case CmdEval, CmdEvalSha, CmdScriptLoad, CmdScriptExists, CmdScriptFlush, CmdScriptKill:
+		return true
+	}
+
+	return false
+}
+
+// Commands that can be called with memo.call() and memo.pcall()
+func isAllowedInScript(kind CommandType) bool {
+	if isScriptCommand(kind) || isTransactionCommand(kind) || isPubSubCommand(kind) {
+		return false
+	}
+
+	switch kind {
+	case CmdQuit, CmdAuth, CmdHello, CmdSync, CmdPSync, CmdReplConf, CmdReplicaOf:
+		return false
+	}
+
+	return true
+}
+
+func scriptSha(body string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(body)))
+}
+
+// Error replies can't span multiple lines
+func scriptError(format string, a ...any) error {
+	return errors.New(strings.ReplaceAll(fmt.Sprintf(format, a...), "\n", " "))
+}
+
+func compileScript(body string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(body), "@user_script")
+	if err != nil {
+		return nil, scriptError("ERR Error compiling script: %s", err)
+	}
+
+	proto, err := lua.Compile(chunk, "@user_script")
+	if err != nil {
+		return nil, scriptError("ERR Error compiling script: %s", err)
+	}
+
+	return proto, nil
+}
+
+// Compile a script and add it to the cache, returns its SHA1. The database lock must be
+// held by the caller.
+func (s *Server) loadScript(body string) (string, *lua.FunctionProto, error) {
+	sha := scriptSha(body)
+	if proto, found := s.scripts[sha]; found {
+		return sha, proto, nil
+	}
+
+	proto, err := compileScript(body)
+	if err != nil {
+		return "", nil, err
+	}
+	s.scripts[sha] = proto
+
+	return sha, proto, nil
+}
+
+// Keeps track of the running script so that it can be killed from another connection. It
+// has its own lock since the database lock is held while the script runs.
+type scriptRunner struct {
+	mu      sync.Mutex
+	cancel  context.CancelFunc // Set while a script is running
+	done    chan struct{}      // Closed when the running script returns
+	started time.Time
+	wrote   bool // Whether the running script modified the database
+	killed  bool
+}
+
+func (r *scriptRunner) start(cancel context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.started = time.Now()
+	r.wrote = false
+	r.killed = false
+}
+
+func (r *scriptRunner) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cancel = nil
+	close(r.done)
+}
+
+func (r *scriptRunner) markWrite() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wrote = true
+}
+
+func (r *scriptRunner) wasKilled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.killed
+}
+
+// Wait for the running script to return, returns true if it is still running after the
+// time limit. A limit of 0 waits until the script returns.
+func (r *scriptRunner) wait(limit time.Duration) bool {
+	r.mu.Lock()
+	if r.cancel == nil {
+		r.mu.Unlock()
+		return false
+	}
+	done, remaining := r.done, limit-time.Since(r.started)
+	r.mu.Unlock()
+
+	if limit <= 0 {
+		<-done
+		return false
+	}
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Stop the running script, scripts that modified the database can't be stopped since the
+// changes can't be rolled back
+func (r *scriptRunner) kill() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel == nil {
+		return ErrScriptNotBusy
+	}
+	if r.wrote {
+		return ErrScriptUnkillable
+	}
+
+	r.killed = true
+	r.cancel()
+
+	return nil
+}
+
+// Run EVAL or EVALSHA, the database lock is held for the whole script so it runs atomically
+func (s *Server) ExecuteScript(cmd *Command) any {
+	s.dbmu.Lock()
+	res, offset := s.evalScript(cmd)
+	s.dbmu.Unlock()
+
+	// All the writes of the script are synced together
+	return s.waitSync(res, offset)
+}
+
+// Returns the result of the script and the WAL offset of its writes. The database lock must
+// be held by the caller.
+func (s *Server) evalScript(cmd *Command) (any, int64) {
+	proto, found := s.scripts[cmd.Value]
+	if cmd.Kind == CmdEval {
+		var err error
+		if _, proto, err = s.loadScript(cmd.Value); err != nil {
+			return err, -1
+		}
+	} else if !found {
+		return ErrNoScript, -1
+	}
+
+	return s.runScript(proto, cmd.Keys, cmd.Values)
+}
+
+// A single execution of a script. The commands called by the script are written to the
+// WAL and sent to the followers instead of the script, so replaying them gives the same result
+// even if the script is not deterministic.
+type scriptRun struct {
+	s *Server
+}
+
+// Run a script and write its writes to the WAL as a single record, see: endBatch(). Scripts
+// called in a transaction are part of its record.
+func (s *Server) runScript(proto *lua.FunctionProto, keys []string, args []string) (any, int64) {
+	if s.batch != nil {
+		return s.callScript(proto, keys, args), -1
+	}
+
+	s.startBatch()
+	res := s.callScript(proto, keys, args)
+	offset, err := s.endBatch()
+	if err != nil {
+		return err, -1
+	}
+
+	return res, offset
+}
+
+func (s *Server) callScript(proto *lua.FunctionProto, keys []string, args []string) any {
+	L := newScriptState()
+	defer L.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+
+	s.script.start(cancel)
+	defer s.script.stop()
+
+	run := &scriptRun{s: s}
+	memo := L.NewTable()
+	L.SetField(memo, "call", L.NewFunction(func(L *lua.LState) int { return run.call(L, true) }))
+	L.SetField(memo, "pcall", L.NewFunction(func(L *lua.LState) int { return run.call(L, false) }))
+	L.SetGlobal("memo", memo)
+	L.SetGlobal("KEYS", toLuaArray(L, keys))
+	L.SetGlobal("ARGV", toLuaArray(L, args))
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		if s.script.wasKilled() {
+			return ErrScriptKilled
+		}
+
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			// Errors raised by memo.call() are returned as they are
+			if t, ok := apiErr.Object.(*lua.LTable); ok {
+				if msg := t.RawGetString("err"); msg.Type() == lua.LTString {
+					return scriptError("%s", msg.String())
+				}
+			}
+			return scriptError("ERR Error running script: %s", apiErr.Object.String())
+		}
+		return scriptError("ERR Error running script: %s", err)
+	}
+
+	return fromLua(L.Get(-1))
+}
+
+// Create a Lua state without access to the file system or the operating system
+func newScriptState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	return L
+}
+
+// Implementation of memo.call() and memo.pcall(), errors are raised by memo.call() and
+// returned as an error table by memo.pcall()
+func (run *scriptRun) call(L *lua.LState, raise bool) int {
+	n := L.GetTop()
+	if n == 0 {
+		L.RaiseError("Please specify at least one argument for memo.call()")
+	}
+
+	args := make([]string, n)
+	for i := 1; i <= n; i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString, lua.LNumber:
+			args[i-1] = arg.String()
+		default:
+			L.RaiseError("Lua memo lib command arguments must be strings or integers")
+		}
+	}
+
+	res := run.execute(args)
+	if err, ok := res.(error); ok {
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(err.Error()))
+		if raise {
+			L.Error(t, 1)
+		}
+		L.Push(t)
+		return 1
+	}
+
+	L.Push(toLua(L, res))
+	return 1
+}
+
+func (run *scriptRun) execute(args []string) any {
+	s := run.s
+
+	exec := StringifyArgs(args)
+	cmd, err := ParseCommand(exec)
+	if err != nil {
+		return err
+	}
+	if !isAllowedInScript(cmd.Kind) {
+		return ErrNotAllowedInScript
+	}
+
+	if !cmd.IsWrite() {
+		return s.executeRead(cmd)
+	}
+	if s.repl.isFollower() {
+		return ErrReadOnly
+	}
+
+	s.script.markWrite()
+	res, _ := s.executeWrite(cmd, exec)
+	return res
+}
+
+func toLuaArray(L *lua.LState, values []string) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		t.Append(lua.LString(value))
+	}
+
+	return t
+}
+
+// Convert a command reply to a Lua value, nil replies are converted to false
+func toLua(L *lua.LState, value any) lua.LValue {
+	switch value := value.(type) {
+	case nil:
+		return lua.LFalse
+	case bool:
+		if value {
+			return lua.LNumber(1)
+		}
+		return lua.LFalse
+	case int:
+		return lua.LNumber(value)
+	case int64:
+		return lua.LNumber(value)
+	case string:
+		return lua.LString(value)
+	case resp.SimpleString:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(value))
+		return t
+	case error:
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(value.Error()))
+		return t
+	case []string:
+		t := L.CreateTable(len(value), 0)
+		for _, item := range value {
+			t.Append(lua.LString(item))
+		}
+		return t
+	case []any:
+		t := L.CreateTable(len(value), 0)
+		for i, item := range value {
+			t.RawSetInt(i+1, toLua(L, item))
+		}
+		return t
+	}
+
+	return lua.LString(fmt.Sprint(value))
+}
+
+// Convert the value returned by a script to a reply. Numbers are truncated to integers and
+// arrays end at the first nil.
+func fromLua(value lua.LValue) any {
+	switch value := value.(type) {
+	case lua.LNumber:
+		return int(value)
+	case lua.LString:
+		return string(value)
+	case lua.LBool:
+		if value {
+			return 1
+		}
+		return nil
+	case *lua.LTable:
+		if ok := value.RawGetString("ok"); ok.Type() == lua.LTString {
+			return resp.SimpleString(ok.String())
+		}
+		if err := value.RawGetString("err"); err.Type() == lua.LTString {
+			return scriptError("%s", err.String())
+		}
+
+		out := []any{}
+		for i := 1; ; i++ {
+			item := value.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			out = append(out, fromLua(item))
+		}
+		return out
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"skabillium/memo/cmd/db"
+	"skabillium/memo/cmd/resp"
+	"testing"
+)
+
+func runEval(s *Server, script string, keys []string, args ...string) any {
+	return s.ExecuteScript(&Command{Kind: CmdEval, Value: script, Keys: keys, Values: args})
+}
+
+func TestScripting(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+
+	res := runEval(s, "return memo.call('set', KEYS[1], ARGV[1])", []string{"name"}, "John \"Doe\"")
+	if res != resp.SimpleString("OK") {
+		t.Error("Expected script to return OK, got", res)
+	}
+	if value, _, _ := s.db.Get("name"); value != "John \"Doe\"" {
+		t.Error("Expected script to set 'name', got", value)
+	}
+
+	res = runEval(s, "return {1, 2.5, 'a', true, false, memo.call('get', 'missing')}", nil)
+	if !reflect.DeepEqual(res, []any{1, 2, "a", 1, nil, nil}) {
+		t.Error("Expected script to return converted array, got", res)
+	}
+
+	s.db.LPush("list", []string{"a"})
+	res = runEval(s, "return memo.call('get', 'list')", nil)
+	if err, ok := res.(error); !ok || err.Error() != db.ErrWrongType.Error() {
+		t.Error("Expected memo.call() to raise", db.ErrWrongType, "got", res)
+	}
+	res = runEval(s, "return memo.pcall('get', 'list')['err']", nil)
+	if res != db.ErrWrongType.Error() {
+		t.Error("Expected memo.pcall() to return error table, got", res)
+	}
+
+	res = runEval(s, "return memo.call('multi')", nil)
+	if err, ok := res.(error); !ok || err.Error() != ErrNotAllowedInScript.Error() {
+		t.Error("Expected MULTI to not be allowed in scripts, got", res)
+	}
+	if _, ok := runEval(s, "return (", nil).(error); !ok {
+		t.Error("Expected invalid script to return error")
+	}
+	if res = runEval(s, "return dofile", nil); res != nil {
+		t.Error("Expected dofile to not be available, got", res)
+	}
+}
+
+func TestScriptCache(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+	script := "return ARGV[1] .. KEYS[1]"
+
+	sha := s.Execute(&Command{Kind: CmdScriptLoad, Value: script})
+	if sha != scriptSha(script) {
+		t.Error("Expected SCRIPT LOAD to return the SHA1 of the script, got", sha)
+	}
+
+	res := s.ExecuteScript(&Command{Kind: CmdEvalSha, Value: sha.(string), Keys: []string{"b"}, Values: []string{"a"}})
+	if res != "ab" {
+		t.Error("Expected EVALSHA to return 'ab', got", res)
+	}
+
+	exists := s.Execute(&Command{Kind: CmdScriptExists, Keys: []string{sha.(string), "missing"}})
+	if !reflect.DeepEqual(exists, []any{1, 0}) {
+		t.Error("Expected SCRIPT EXISTS to return [1 0], got", exists)
+	}
+
+	s.Execute(&Command{Kind: CmdScriptFlush})
+	res = s.ExecuteScript(&Command{Kind: CmdEvalSha, Value: sha.(string)})
+	if res != ErrNoScript {
+		t.Error("Expected EVALSHA to return", ErrNoScript, "after SCRIPT FLUSH, got", res)
+	}
+}
+
+func TestScriptReplay(t *testing.T) {
+	s := newWalServer(t)
+	script := "memo.call('rpush', KEYS[1], 'a'); memo.call('hincrby', KEYS[2], 'f', 2); return memo.call('llen', KEYS[1])"
+	if res := runEval(s, script, []string{"list", "hash"}); res != 1 {
+		t.Fatal("Expected script to return 1, got", res)
+	}
+	res := runEval(s, "memo.call('rpush', 'list', 'b'); return memo.call('save')", nil)
+	if err, ok := res.(error); !ok || err.Error() != ErrBatchPending.Error() {
+		t.Error("Expected SAVE after a write to fail, got", res)
+	}
+
+	ctx := NewMemoContext(nil)
+	ctx.tx.active = true
+	ctx.tx.queue = []queuedCommand{
+		{cmd: &Command{Kind: CmdEval, Value: "return memo.call('rpush', 'list', 'c')"}, exec: "eval"},
+		{cmd: &Command{Kind: CmdRPush, Key: "list", Values: []string{"d"}}, exec: "rpush list d"},
+	}
+	s.execTransaction(ctx)
+
+	records, _ := readWalLines(WalName)
+	expected := []string{
+		"multi \"rpush list a\" \"hincrby hash f 2\"",
+		"rpush list b",
+		"multi \"rpush list c\" \"rpush list d\"",
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatal("Expected the writes of every script to be a single record, got", records)
+	}
+
+	s = restartWalServer(t)
+	if res := execLine(t, s, "llen list"); res != 4 {
+		t.Error("Expected list length to be 4, got", res)
+	}
+	if res := execLine(t, s, "hget hash f"); res != "2" {
+		t.Error("Expected hash field to be 2, got", res)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"skabillium/memo/cmd/db"
+	"strconv"
+)
+
+const SnapshotName = "dump.memo"
+
+var ErrSaveInProgress = errors.New("ERR Background save already in progress")
+
+// Write the snapshot to a temporary file first and then move it in place of the old one,
+// so a failed save never leaves a half written snapshot behind. The WAL position is where
+// the log ended when the snapshot was taken, so if the server crashes before the log is
+// discarded the records before it are not replayed twice.
+func writeSnapshot(d *db.Database, wal WalPosition) error {
+	tmpName := SnapshotName + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+
+	var aux map[string]string
+	if wal.Id != "" {
+		aux = map[string]string{"wal-id": wal.Id, "wal-offset": strconv.FormatInt(wal.Offset, 10)}
+	}
+	err = d.WriteSnapshot(file, aux)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, SnapshotName)
+}
+
+// Save the database to disk, blocking all other clients until it is done. The database
+// lock must be held by the caller.
+func (s *Server) save() error {
+	if s.saving {
+		return ErrSaveInProgress
+	}
+	if s.rewriting {
+		return ErrRewriteInProgress
+	}
+	if s.hasPendingWrites() {
+		return ErrBatchPending
+	}
+
+	var wal WalPosition
+	if s.wal != nil {
+		wal = s.wal.Position()
+	}
+
+	if err := writeSnapshot(s.db, wal); err != nil {
+		return err
+	}
+
+	if s.wal != nil {
+		return s.wal.Discard(wal.Offset)
+	}
+
+	return nil
+}
+
+// Save a copy of the database to disk in a separate goroutine. The database lock must be
+// held by the caller. Copying the database takes time proportional to its size and blocks
+// every other client until it is done, only writing the copy happens in the background.
+func (s *Server) bgSave() error {
+	if s.saving {
+		return ErrSaveInProgress
+	}
+	if s.rewriting {
+		return ErrRewriteInProgress
+	}
+	if s.hasPendingWrites() {
+		return ErrBatchPending
+	}
+
+	clone := s.db.Clone()
+	var wal WalPosition
+	if s.wal != nil {
+		wal = s.wal.Position()
+	}
+
+	s.saving = true
+	go func() {
+		err := writeSnapshot(clone, wal)
+		if err == nil && s.wal != nil {
+			err = s.wal.Discard(wal.Offset)
+		}
+
+		if err != nil {
+			fmt.Println("Background save failed:", err)
+		} else {
+			fmt.Println("Background save completed")
+		}
+
+		s.dbmu.Lock()
+		s.saving = false
+		s.dbmu.Unlock()
+	}()
+
+	return nil
+}
+
+// Replace the database with the contents of the snapshot file, it is meant to run only once
+// before the WAL is replayed and the server is started. The part of the WAL covered by the
+// snapshot is kept for BuildDbFromWal().
+func (s *Server) LoadSnapshot() (int, error) {
+	file, err := os.Open(SnapshotName)
+	if err != nil {
+		return -1, err
+	}
+	defer file.Close()
+
+	d, aux, err := db.ReadSnapshot(file)
+	if err != nil {
+		return -1, err
+	}
+
+	s.db = d
+	s.walLoaded = WalPosition{Id: aux["wal-id"]}
+	if s.walLoaded.Offset, err = strconv.ParseInt(aux["wal-offset"], 10, 64); err != nil {
+		s.walLoaded = WalPosition{}
+	}
+	return d.Size(), nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"skabillium/memo/cmd/resp"
+	"strings"
+)
+
+var ErrNestedMulti = errors.New("ERR MULTI calls can not be nested")
+var ErrExecWithoutMulti = errors.New("ERR EXEC without MULTI")
+var ErrDiscardWithoutMulti = errors.New("ERR DISCARD without MULTI")
+var ErrWatchInMulti = errors.New("ERR WATCH inside MULTI is not allowed")
+var ErrNotAllowedInMulti = errors.New("ERR Command not allowed inside a transaction")
+var ErrExecAbort = errors.New("EXECABORT Transaction discarded because of previous errors.")
+var ErrBatchPending = errors.New("ERR Can't save or rewrite the WAL after writes in a transaction or a script")
+
+// A command queued with MULTI, the raw command is kept for the WAL and the followers
+type queuedCommand struct {
+	cmd  *Command
+	exec string
+}
+
+// Transaction state of a connection. The watched keys and the dirty flag are guarded by the
+// database lock since they are updated by other connections.
+type transaction struct {
+	active  bool // Whether MULTI was called
+	failed  bool // Whether a command failed to be queued, EXEC will be aborted
+	queue   []queuedCommand
+	watched []string
+	dirty   bool // Whether a watched key was modified
+}
+
+// Commands that control transactions
+func isTransactionCommand(kind CommandType) bool {
+	switch kind {
+	case CmdMulti, CmdExec, CmdDiscard, CmdWatch, CmdUnwatch:
+		return true
+	}
+
+	return false
+}
+
+// Handle a transaction command, or queue any other command if the connection is in a
+// transaction
+func (s *Server) handleTransaction(ctx *MemoContext, cmd *Command, exec string) {
+	tx := &ctx.tx
+
+	switch cmd.Kind {
+	case CmdMulti:
+		if tx.active {
+			ctx.EndWith(ErrNestedMulti)
+			return
+		}
+		tx.active = true
+		ctx.EndWith(resp.SimpleString("OK"))
+	case CmdExec:
+		if !tx.active {
+			ctx.EndWith(ErrExecWithoutMulti)
+			return
+		}
+		ctx.EndWith(s.execTransaction(ctx))
+	case CmdDiscard:
+		if !tx.active {
+			ctx.EndWith(ErrDiscardWithoutMulti)
+			return
+		}
+		s.resetTransaction(ctx)
+		ctx.EndWith(resp.SimpleString("OK"))
+	case CmdWatch:
+		if tx.active {
+			ctx.EndWith(ErrWatchInMulti)
+			return
+		}
+		s.watch(ctx, cmd.Keys)
+		ctx.EndWith(resp.SimpleString("OK"))
+	case CmdUnwatch:
+		s.unwatch(ctx)
+		ctx.EndWith(resp.SimpleString("OK"))
+	default:
+		if isPubSubCommand(cmd.Kind) || cmd.Kind == CmdSync || cmd.Kind == CmdPSync || cmd.Kind == CmdReplConf || cmd.Kind == CmdScriptKill {
+			tx.failed = true
+			ctx.EndWith(ErrNotAllowedInMulti)
+			return
+		}
+		tx.queue = append(tx.queue, queuedCommand{cmd: cmd, exec: exec})
+		ctx.EndWith(resp.SimpleString("QUEUED"))
+	}
+}
+
+// Run all the queued commands while holding the database lock, so no other connection can
+// run commands in between. Returns nil if a watched key was modified.
+func (s *Server) execTransaction(ctx *MemoContext) any {
+	defer s.resetTransaction(ctx)
+
+	if ctx.tx.failed {
+		return ErrExecAbort
+	}
+
+	s.dbmu.Lock()
+	if ctx.tx.dirty {
+		s.dbmu.Unlock()
+		return nil
+	}
+
+	if s.repl.isFollower() {
+		for _, q := range ctx.tx.queue {
+			if q.cmd.IsWrite() {
+				s.dbmu.Unlock()
+				return ErrReadOnly
+			}
+		}
+	}
+
+	s.startBatch()
+	results := make([]any, len(ctx.tx.queue))
+	for i, q := range ctx.tx.queue {
+		switch {
+		case q.cmd.Kind == CmdEval || q.cmd.Kind == CmdEvalSha:
+			results[i], _ = s.evalScript(q.cmd)
+		case q.cmd.IsWrite():
+			results[i], _ = s.executeWrite(q.cmd, q.exec)
+		default:
+			results[i] = s.executeRead(q.cmd)
+		}
+	}
+	offset, err := s.endBatch()
+	s.dbmu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return s.waitSync(results, offset)
+}
+
+// Writes of a transaction or a script are written to the WAL and sent to the followers as a
+// single record once it is over, so that replaying the log after a crash or a follower losing
+// the connection never applies only part of them:
+//
+//	multi <command> <command>...
+type writeBatch struct {
+	execs  []string
+	served []blockedServe // Clients served by the writes, they are answered once they are logged
+}
+
+type blockedServe struct {
+	client *blockedClient
+	reply  any
+}
+
+// Start collecting writes instead of logging them, until endBatch() is called. The database
+// lock must be held by the caller.
+func (s *Server) startBatch() {
+	s.batch = &writeBatch{}
+}
+
+// Write the writes collected since startBatch() to the WAL and send them to the followers as
+// a single record, returns its WAL offset. The database lock must be held by the caller.
+func (s *Server) endBatch() (int64, error) {
+	batch := s.batch
+	s.batch = nil
+
+	var offset int64 = -1
+	var err error
+	switch len(batch.execs) {
+	case 0:
+	case 1:
+		offset, err = s.propagate(batch.execs[0])
+	default:
+		offset, err = s.propagate(StringifyArgs(append([]string{"multi"}, batch.execs...)))
+	}
+
+	for _, served := range batch.served {
+		served.client.ch <- blockedResult{reply: served.reply, offset: offset}
+	}
+
+	return offset, err
+}
+
+// Whether writes were collected that are not in the WAL yet, saving the database or
+// rewriting the WAL at that point would log them twice. The database lock must be held by
+// the caller.
+func (s *Server) hasPendingWrites() bool {
+	return s.batch != nil && len(s.batch.execs) > 0
+}
+
+// Write a command that was already executed to the WAL and send it to the followers, or add
+// it to the running batch. Returns its WAL offset. The database lock must be held by the
+// caller.
+func (s *Server) propagate(exec string) (int64, error) {
+	if s.batch != nil {
+		s.batch.execs = append(s.batch.execs, exec)
+		return -1, nil
+	}
+
+	var offset int64 = -1
+	if s.wal != nil {
+		var err error
+		if offset, err = s.wal.Append(exec); err != nil {
+			return -1, err
+		}
+	}
+	s.replicate(exec)
+
+	return offset, nil
+}
+
+// Parse a record of the WAL or the replication stream into its commands, records written by
+// endBatch() contain more than one
+func parseRecord(exec string) ([]*Command, []string, error) {
+	if !strings.HasPrefix(exec, "multi ") {
+		cmd, err := ParseCommand(exec)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []*Command{cmd}, []string{exec}, nil
+	}
+
+	split, err := splitTokens(exec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	execs := split[1:]
+	cmds := make([]*Command, len(execs))
+	for i, sub := range execs {
+		if cmds[i], err = ParseCommand(sub); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return cmds, execs, nil
+}
+
+// Apply a record sent by the leader. The commands of a batch are applied together and passed
+// on to the WAL and the followers of this server as the same record, so the offsets of the
+// stream stay the same. The database lock must be held by the caller.
+func (s *Server) applyRecord(exec string, cmds []*Command, execs []string) {
+	if len(cmds) == 1 {
+		s.executeWrite(cmds[0], execs[0])
+		return
+	}
+
+	s.startBatch()
+	for i, cmd := range cmds {
+		s.executeWrite(cmd, execs[i])
+	}
+	s.batch = nil
+
+	if _, err := s.propagate(exec); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Exit the transaction and stop watching keys
+func (s *Server) resetTransaction(ctx *MemoContext) {
+	s.unwatch(ctx)
+	ctx.tx = transaction{}
+}
+
+// Watch keys for modifications, if any of them is modified by the time EXEC is called
+// the transaction is aborted
+func (s *Server) watch(ctx *MemoContext, keys []string) {
+	s.dbmu.Lock()
+	defer s.dbmu.Unlock()
+
+	for _, key := range keys {
+		if s.watchers[key] == nil {
+			s.watchers[key] = map[*MemoContext]bool{}
+		}
+		if !s.watchers[key][ctx] {
+			s.watchers[key][ctx] = true
+			ctx.tx.watched = append(ctx.tx.watched, key)
+		}
+	}
+}
+
+func (s *Server) unwatch(ctx *MemoContext) {
+	s.dbmu.Lock()
+	defer s.dbmu.Unlock()
+
+	for _, key := range ctx.tx.watched {
+		delete(s.watchers[key], ctx)
+		if len(s.watchers[key]) == 0 {
+			delete(s.watchers, key)
+		}
+	}
+	ctx.tx.watched = nil
+	ctx.tx.dirty = false
+}
+
+// Mark the transactions watching the keys modified by a command as dirty. The database
+// lock must be held by the caller.
+func (s *Server) touchWatched(cmd *Command) {
+	if len(s.watchers) == 0 {
+		return
+	}
+
+	if cmd.Kind == CmdFlushAll {
+		for _, watchers := range s.watchers {
+			for ctx := range watchers {
+				ctx.tx.dirty = true
+			}
+		}
+		return
+	}
+
+	for ctx := range s.watchers[cmd.Key] {
+		ctx.tx.dirty = true
+	}
+	for _, key := range cmd.Keys {
+		for ctx := range s.watchers[key] {
+			ctx.tx.dirty = true
+		}
+	}
+}
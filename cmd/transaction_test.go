@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"skabillium/memo/cmd/resp"
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	s := NewServer(&ServerOptions{})
+	ctx := NewMemoContext(nil)
+
+	s.watch(ctx, []string{"a"})
+	s.executeWrite(&Command{Kind: CmdSet, Key: "b", Value: "1"}, "set b 1")
+	if ctx.tx.dirty {
+		t.Error("Expected transaction to not be dirty after modifying an unwatched key")
+	}
+
+	ctx.tx.active = true
+	ctx.tx.queue = []queuedCommand{
+		{cmd: &Command{Kind: CmdSet, Key: "a", Value: "1"}, exec: "set a 1"},
+		{cmd: &Command{Kind: CmdGet, Key: "a"}, exec: "get a"},
+	}
+	if res := s.execTransaction(ctx); !reflect.DeepEqual(res, []any{resp.SimpleString("OK"), "1"}) {
+		t.Error("Expected EXEC to return [OK 1], got", res)
+	}
+	if ctx.tx.active || len(s.watchers) != 0 {
+		t.Error("Expected EXEC to reset the transaction and unwatch all keys")
+	}
+
+	s.watch(ctx, []string{"a"})
+	s.executeWrite(&Command{Kind: CmdDel, Keys: []string{"a"}}, "del a")
+	if !ctx.tx.dirty {
+		t.Error("Expected transaction to be dirty after deleting a watched key")
+	}
+
+	ctx.tx.active = true
+	ctx.tx.queue = []queuedCommand{{cmd: &Command{Kind: CmdSet, Key: "a", Value: "2"}, exec: "set a 2"}}
+	if res := s.execTransaction(ctx); res != nil {
+		t.Error("Expected EXEC to be aborted, got", res)
+	}
+	if _, found, _ := s.db.Get("a"); found {
+		t.Error("Expected aborted transaction to not set 'a'")
+	}
+
+	s.watch(ctx, []string{"c"})
+	s.executeWrite(&Command{Kind: CmdFlushAll}, "flushall")
+	if !ctx.tx.dirty {
+		t.Error("Expected transaction to be dirty after FLUSHALL")
+	}
+}
+
+func TestTransactionReplay(t *testing.T) {
+	s := newWalServer(t)
+	execLine(t, s, "hincrby h f 1")
+	start := s.wal.Size()
+
+	ctx := NewMemoContext(nil)
+	ctx.tx.active = true
+	for _, line := range []string{"hincrby h f 1", "rpush list x", "hget h f", "hincrby h f 1"} {
+		cmd, _ := ParseCommand(line)
+		ctx.tx.queue = append(ctx.tx.queue, queuedCommand{cmd: cmd, exec: line})
+	}
+	s.execTransaction(ctx)
+
+	records, _ := readWalLines(WalName)
+	if len(records) != 2 || records[1] != "multi \"hincrby h f 1\" \"rpush list x\" \"hincrby h f 1\"" {
+		t.Fatal("Expected the transaction to be a single record, got", records)
+	}
+
+	s = restartWalServer(t)
+	if res := execLine(t, s, "hget h f"); res != "3" {
+		t.Error("Expected h.f to be 3, got", res)
+	}
+	if res := execLine(t, s, "llen list"); res != 1 {
+		t.Error("Expected list length to be 1, got", res)
+	}
+
+	// A transaction cut short inside its payload or its header is torn and dropped as a whole
+	log, _ := os.ReadFile(WalName)
+	for _, size := range []int64{int64(len(log)) - 3, start + 3} {
+		os.WriteFile(WalName, log[:size], 0644)
+		s = restartWalServer(t)
+		if res := execLine(t, s, "hget h f"); res != "1" || s.db.Size() != 1 {
+			t.Error("Expected only h to be replayed, got", res, s.db.Size())
+		}
+		if size := s.wal.Size(); size != start {
+			t.Error("Expected the torn transaction to be truncated at", start, "got", size)
+		}
+	}
+}
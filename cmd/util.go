@@ -3,7 +3,11 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
+	"math"
 	"os"
+	"skabillium/memo/cmd/db"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,17 +19,31 @@ type ServerOptions struct {
 	AutoCleanupEnabled bool
 	CleanupLimit       int
 	CleanupInterval    time.Duration
+	WalRewriteMultiple int
+	WalFsync           FsyncPolicy
+	WalTruncate        bool
+	ReplicaOf          string
+	ReplBacklogSize    int
 	User               string
 	Password           string
+	ScriptTimeLimit    time.Duration
+	MaxMemory          int // Bytes, 0 for no limit
+	MaxMemoryPolicy    db.EvictionPolicy
+	MaxMemorySamples   int
 }
 
 // Read command line options
-func getServerOptions() *ServerOptions {
+func getServerOptions() (*ServerOptions, error) {
 	var (
 		port            string
 		portSr          string
 		disableAuth     bool
 		enableWal       bool
+		rewriteMultiple int
+		walFsync        string
+		walTruncate     bool
+		replicaOf       string
+		backlogSize     int
 		disableCleanup  bool
 		cleanupLimit    int
 		cleanupInterval int
@@ -33,12 +51,21 @@ func getServerOptions() *ServerOptions {
 		userSr          string
 		password        string
 		passwordSr      string
+		scriptLimit     int
+		maxMemory       string
+		maxMemoryPolicy string
+		maxMemorySample int
 	)
 
 	flag.StringVar(&port, "port", "", "Port to run server")
 	flag.StringVar(&portSr, "p", "", "Shorthand for port")
 	flag.BoolVar(&disableAuth, "noauth", false, "Disable authentication")
 	flag.BoolVar(&enableWal, "wal", false, "Enable write ahead log authentication")
+	flag.IntVar(&rewriteMultiple, "wal-rewrite-multiple", 0, "Rewrite the WAL when it grows this many times its size after the last rewrite (0 to disable)")
+	flag.StringVar(&walFsync, "wal-fsync", FsyncEverySec, "When to sync the WAL to disk: always, everysec or no")
+	flag.BoolVar(&walTruncate, "wal-truncate", false, "Remove an incomplete record from the end of the WAL on startup")
+	flag.StringVar(&replicaOf, "replicaof", "", "Address (host:port) of a leader to replicate from on startup")
+	flag.IntVar(&backlogSize, "repl-backlog-size", DefaultBacklogSize, "Size in bytes of the replication backlog kept for followers that reconnect")
 	flag.BoolVar(&disableCleanup, "nocleanup", false, "Disable auto cleanup")
 	flag.IntVar(&cleanupLimit, "cleanup-limit", 0, "Cleanup limit")
 	flag.IntVar(&cleanupInterval, "cleanup-interval", 1, "Cleanup interval in seconds")
@@ -46,6 +73,10 @@ func getServerOptions() *ServerOptions {
 	flag.StringVar(&userSr, "u", "", "Shorthand for user")
 	flag.StringVar(&password, "password", "", "Password for authentication")
 	flag.StringVar(&passwordSr, "pwd", "", "Shorthand for password")
+	flag.IntVar(&scriptLimit, "script-time-limit", DefaultScriptTimeLimit, "Time in milliseconds a script can run before other commands are rejected with BUSY (0 to disable)")
+	flag.StringVar(&maxMemory, "maxmemory", "0", "Memory limit for the data, eg. 100mb or 1gb (0 for no limit)")
+	flag.StringVar(&maxMemoryPolicy, "maxmemory-policy", db.NoEviction, "How keys are evicted when the memory limit is reached: noeviction, allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru, volatile-lfu, volatile-random or volatile-ttl")
+	flag.IntVar(&maxMemorySample, "maxmemory-samples", db.DefaultEvictionSamples, "Number of keys sampled to choose the key to evict with the LRU and LFU policies")
 	flag.Parse()
 
 	if port == "" {
@@ -72,6 +103,27 @@ func getServerOptions() *ServerOptions {
 		}
 	}
 
+	fsync, err := ParseFsyncPolicy(walFsync)
+	if err != nil {
+		return nil, err
+	}
+
+	if backlogSize <= 0 {
+		return nil, errors.New("replication backlog size must be positive")
+	}
+
+	memoryLimit, err := ParseMemorySize(maxMemory)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := db.ParseEvictionPolicy(maxMemoryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if maxMemorySample <= 0 {
+		return nil, errors.New("maxmemory samples must be positive")
+	}
+
 	if cleanupLimit == 0 {
 		cleanupLimit = DefaultCleanupLimit
 	}
@@ -83,11 +135,45 @@ func getServerOptions() *ServerOptions {
 		AutoCleanupEnabled: !disableCleanup,
 		CleanupLimit:       cleanupLimit,
 		CleanupInterval:    time.Duration(cleanupInterval) * time.Second,
+		WalRewriteMultiple: rewriteMultiple,
+		WalFsync:           fsync,
+		WalTruncate:        walTruncate,
+		ReplicaOf:          replicaOf,
+		ReplBacklogSize:    backlogSize,
 		User:               user,
 		Password:           password,
+		ScriptTimeLimit:    time.Duration(scriptLimit) * time.Millisecond,
+		MaxMemory:          memoryLimit,
+		MaxMemoryPolicy:    policy,
+		MaxMemorySamples:   maxMemorySample,
+	}
+
+	return options, nil
+}
+
+// Parse a number of bytes with an optional unit like Redis, k, m and g are powers of 1000 and
+// kb, mb and gb are powers of 1024
+func ParseMemorySize(size string) (int, error) {
+	units := []struct {
+		suffix string
+		bytes  int
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1}}
+
+	digits := strings.ToLower(size)
+	multiple := 1
+	for _, unit := range units {
+		if strings.HasSuffix(digits, unit.suffix) {
+			digits, multiple = strings.TrimSuffix(digits, unit.suffix), unit.bytes
+			break
+		}
 	}
 
-	return options
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 0 || n > math.MaxInt/multiple {
+		return 0, fmt.Errorf("invalid memory size '%s'", size)
+	}
+
+	return n * multiple, nil
 }
 
 // Convert parsed request to a string
@@ -106,11 +192,7 @@ func StringifyRequest(req any) (string, error) {
 				exec += " "
 			}
 
-			if strings.Contains(s, " ") {
-				s = "\"" + s + "\""
-			}
-
-			exec += s
+			exec += quoteToken(s)
 		}
 	default:
 		return "", ErrUnsupportedType
@@ -119,6 +201,17 @@ func StringifyRequest(req any) (string, error) {
 	return exec, nil
 }
 
+// Join command arguments to a string that can be parsed by ParseCommand()
+func StringifyArgs(args []string) string {
+	req := make([]any, len(args))
+	for i, arg := range args {
+		req[i] = arg
+	}
+
+	exec, _ := StringifyRequest(req)
+	return exec
+}
+
 // Check if a given file path exists
 func FileExists(filename string) bool {
 	_, err := os.Stat(filename)
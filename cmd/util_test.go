@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestStringifyRequest(t *testing.T) {
 	req := []any{"set", "message", "hello world!"}
@@ -8,3 +11,38 @@ func TestStringifyRequest(t *testing.T) {
 		t.Error("Expected other result for StringifyRequest")
 	}
 }
+
+func TestStringifyArgsRoundTrip(t *testing.T) {
+	args := []string{"eval", "return memo.call(\"get\", KEYS[1])\n", "", "C:\\dir\\", "'quoted'", "new\nline"}
+	res, err := splitTokens(StringifyArgs(args))
+	if err != nil || !reflect.DeepEqual(res, args) {
+		t.Error("Expected splitTokens(StringifyArgs()) to return", args, "got", res)
+	}
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for _, policy := range []string{"always", "everysec", "no"} {
+		if res, err := ParseFsyncPolicy(policy); res != policy || err != nil {
+			t.Errorf("Expected ParseFsyncPolicy('%s') to return '%s'", policy, policy)
+		}
+	}
+
+	if _, err := ParseFsyncPolicy("sometimes"); err == nil {
+		t.Error("Expected ParseFsyncPolicy('sometimes') to return an error")
+	}
+}
+
+func TestParseMemorySize(t *testing.T) {
+	sizes := map[string]int{"0": 0, "100": 100, "2k": 2000, "2KB": 2048, "1m": 1000000, "1mb": 1 << 20, "1gb": 1 << 30}
+	for size, expected := range sizes {
+		if res, err := ParseMemorySize(size); res != expected || err != nil {
+			t.Errorf("Expected ParseMemorySize('%s') to return %d, got %d", size, expected, res)
+		}
+	}
+
+	for _, size := range []string{"", "mb", "-1", "1tb"} {
+		if _, err := ParseMemorySize(size); err == nil {
+			t.Errorf("Expected ParseMemorySize('%s') to return an error", size)
+		}
+	}
+}
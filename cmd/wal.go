@@ -1,26 +1,679 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
-	"skabillium/memo/cmd/resp"
+	"skabillium/memo/cmd/db"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const WalName = "wal.log"
 
-func writeToWAL(walch <-chan string) {
-	file, err := os.OpenFile(WalName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+var ErrWalDisabled = errors.New("ERR WAL is not enabled")
+var ErrRewriteInProgress = errors.New("ERR Background WAL rewriting already in progress")
+var ErrWalSync = errors.New("ERR failed to sync WAL to disk")
+
+// When the WAL is synced to disk
+type FsyncPolicy = string
+
+const (
+	FsyncAlways   FsyncPolicy = "always"   // After every write, before answering the client
+	FsyncEverySec FsyncPolicy = "everysec" // Once every second in the background
+	FsyncNo       FsyncPolicy = "no"       // Whenever the operating system decides to
+)
+
+func ParseFsyncPolicy(policy string) (FsyncPolicy, error) {
+	switch policy {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid fsync policy '%s', expected one of always, everysec or no", policy)
+}
+
+// Logs smaller than this are never rewritten automatically
+const WalRewriteMinSize = 1 << 20
+
+// Every record of the log is written as:
+//
+//	<marker byte> <payload length uint32> <crc32 of payload uint32> <payload>
+//
+// Logs written by older versions contain plain bulk strings instead, those are still
+// accepted when reading.
+//
+// The first record of a log is its id, written the same way with a different marker. A new
+// id is given to the log whenever its file is replaced, snapshots store it together with the
+// size of the log they cover so that records already in the snapshot are not replayed.
+const walRecordMarker = 0xfe
+const walIdMarker = 0xfd
+const walHeaderSize = 9
+
+// Records that don't fit in the rest of the log are treated as torn writes only up to this
+// size, longer ones are more likely a corrupted length
+const walMaxTornSize = 512 * 1024 * 1024
+
+func encodeWalRecord(line string) string {
+	return encodeWalMarked(walRecordMarker, line)
+}
+
+func encodeWalId(id string) string {
+	return encodeWalMarked(walIdMarker, id)
+}
+
+func encodeWalMarked(marker byte, payload string) string {
+	var header [walHeaderSize]byte
+	header[0] = marker
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[5:9], crc32.ChecksumIEEE([]byte(payload)))
+	return string(header[:]) + payload
+}
+
+func newWalId() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Position in a log, offsets are only meaningful for the log with the same id. Logs written
+// by older versions have an empty id.
+type WalPosition struct {
+	Id     string
+	Offset int64
+}
+
+// Error found while reading the log, Offset is the position of the first invalid record
+// and everything before it can be trusted
+type WalError struct {
+	Offset int64
+	Torn   bool // The invalid record is the last one, most likely a write interrupted by a crash
+	Reason string
+}
+
+func (e *WalError) Error() string {
+	msg := fmt.Sprintf("%s at offset %d of %s", e.Reason, e.Offset, WalName)
+	if e.Torn {
+		msg += ", run the server with --wal-truncate to remove it"
+	}
+	return msg
+}
+
+type walReader struct {
+	r      *bufio.Reader
+	offset int64
+	size   int64
+	id     string
+}
+
+// Read the next record, the error is io.EOF only if the log ended cleanly
+func (wr *walReader) next() (string, error) {
+	marker, err := wr.r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	if marker[0] == walIdMarker && wr.offset == 0 {
+		if wr.id, err = wr.nextMarked(); err != nil {
+			return "", err
+		}
+		return wr.next()
+	}
+	if marker[0] == '$' {
+		return wr.nextLegacy()
+	}
+	if marker[0] != walRecordMarker {
+		return "", &WalError{Offset: wr.offset, Reason: "invalid record marker"}
+	}
+
+	return wr.nextMarked()
+}
+
+func (wr *walReader) nextMarked() (string, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(wr.r, header[:]); err != nil {
+		return "", wr.torn(err)
+	}
+
+	// The length is checked before the payload is allocated, since it is not covered by the
+	// checksum and a corrupted one could be anything. A record longer than the rest of the log
+	// is the last one, most likely cut short by a crash.
+	length := int64(binary.BigEndian.Uint32(header[1:5]))
+	if length > wr.size-wr.offset-walHeaderSize {
+		if length > walMaxTornSize {
+			return "", &WalError{Offset: wr.offset, Reason: "invalid record length"}
+		}
+		return "", &WalError{Offset: wr.offset, Torn: true, Reason: "incomplete record"}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(wr.r, payload); err != nil {
+		return "", wr.torn(err)
+	}
+
+	end := wr.offset + walHeaderSize + int64(len(payload))
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[5:9]) {
+		return "", &WalError{Offset: wr.offset, Torn: end == wr.size, Reason: "checksum mismatch"}
+	}
+
+	wr.offset = end
+	return string(payload), nil
+}
+
+// Read a bulk string record written by older versions
+func (wr *walReader) nextLegacy() (string, error) {
+	line, err := wr.r.ReadString('\n')
+	if err != nil {
+		return "", wr.torn(err)
+	}
+
+	n, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+	if err != nil || n < 0 || n > walMaxTornSize {
+		return "", &WalError{Offset: wr.offset, Reason: "invalid bulk string length"}
+	}
+	if int64(n)+2 > wr.size-wr.offset-int64(len(line)) {
+		return "", &WalError{Offset: wr.offset, Torn: true, Reason: "incomplete record"}
+	}
+
+	payload := make([]byte, n+2)
+	if _, err := io.ReadFull(wr.r, payload); err != nil {
+		return "", wr.torn(err)
+	}
+
+	wr.offset += int64(len(line) + len(payload))
+	return string(payload[:n]), nil
+}
+
+func (wr *walReader) torn(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &WalError{Offset: wr.offset, Torn: true, Reason: "incomplete record"}
+	}
+	return err
+}
+
+// Read the records of the log after the given position and call fn for each one, returns the
+// number of records read. The position is ignored if it belongs to another log. Errors
+// returned by fn are reported with the offset of the record that caused them.
+func ReadWal(name string, after WalPosition, fn func(line string) error) (int, error) {
+	file, err := os.Open(name)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return
+		return 0, err
 	}
 	defer file.Close()
 
-	for line := range walch {
-		_, err := file.WriteString(resp.SerializeStr(line))
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	wr := &walReader{r: bufio.NewReader(file), size: info.Size()}
+	var records int
+	for {
+		offset := wr.offset
+		line, err := wr.next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		if after.Id != "" && after.Id == wr.id && offset < after.Offset {
+			continue
+		}
+
+		if err = fn(line); err != nil {
+			return records, &WalError{Offset: offset, Reason: err.Error()}
+		}
+		records++
+	}
+}
+
+func expireOptionArgs(opts db.ExpireOptions) []string {
+	args := []string{}
+	if opts.NX {
+		args = append(args, "nx")
+	}
+	if opts.XX {
+		args = append(args, "xx")
+	}
+	if opts.GT {
+		args = append(args, "gt")
+	}
+	if opts.LT {
+		args = append(args, "lt")
+	}
+
+	return args
+}
+
+// Commands with a relative expiration are converted to use an absolute deadline before they
+// are executed and logged, so that replaying the log after a restart does not extend it.
+// Returns the command to execute and the string to write to the log.
+func withAbsoluteExpiry(cmd *Command, exec string, now time.Time) (*Command, string) {
+	switch {
+	case cmd.Kind == CmdExpire:
+		at := now.UnixMilli() + cmd.ExpireIn
+		abs := &Command{Kind: CmdPExpireAt, Key: cmd.Key, ExpireAt: at, Expire: cmd.Expire}
+		args := []string{"pexpireat", cmd.Key, strconv.FormatInt(at, 10)}
+		return abs, StringifyArgs(append(args, expireOptionArgs(cmd.Expire)...))
+	case cmd.Kind == CmdSet && cmd.ExpireIn != 0:
+		at := now.UnixMilli() + cmd.ExpireIn
+		abs := &Command{Kind: CmdSet, Key: cmd.Key, Value: cmd.Value, ExpireAt: at}
+		return abs, StringifyArgs([]string{"set", cmd.Key, cmd.Value, "pxat", strconv.FormatInt(at, 10)})
+	case cmd.Kind == CmdQueueReserve && cmd.LeaseId == "":
+		// The lease id is also generated here so that replaying the command gives the same id
+		at := now.UnixMilli() + cmd.Timeout.Milliseconds()
+		abs := &Command{Kind: CmdQueueReserve, Key: cmd.Key, ExpireAt: at, LeaseId: newLeaseId()}
+		return abs, StringifyArgs([]string{"qreserve", cmd.Key, "pxat", strconv.FormatInt(at, 10), "id", abs.LeaseId})
+	case cmd.Kind == CmdQueueAdd && cmd.Timeout > 0:
+		at := now.UnixMilli() + cmd.Timeout.Milliseconds()
+		abs := &Command{Kind: CmdQueueAdd, Key: cmd.Key, Values: cmd.Values, Priority: cmd.Priority, NotBefore: at}
+		args := []string{"qadd", cmd.Key, "pr", db.FormatScore(cmd.Priority), "at", strconv.FormatInt(at, 10)}
+		return abs, StringifyArgs(append(args, cmd.Values...))
+	}
+
+	return cmd, exec
+}
+
+// Append only log of the commands that modified the database. Records are appended while
+// holding the database lock, so the order of the log is the same as the order of execution.
+type Wal struct {
+	mu     sync.Mutex
+	name   string
+	id     string
+	file   *os.File
+	size   int64
+	fsync  FsyncPolicy
+	closed chan struct{}
+
+	// Offsets used for syncing, these count every byte ever appended and unlike size are
+	// not reset when the log is truncated or rewritten
+	syncMu   sync.Mutex // Held while syncing, also prevents the file from being replaced
+	appended int64
+	synced   int64
+	syncs    int // Number of times the file was synced
+
+	baseSize   int64         // Size of the log after the last rewrite
+	rewriteBuf *bytes.Buffer // Records appended while a rewrite is in progress
+}
+
+func OpenWal(name string, fsync FsyncPolicy) (*Wal, error) {
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	size := info.Size()
+	var id string
+	if size == 0 {
+		id = newWalId()
+		n, err := file.WriteString(encodeWalId(id))
+		size = int64(n)
 		if err != nil {
-			fmt.Println(err)
-			break
+			file.Close()
+			return nil, err
 		}
+	} else if id, err = readWalId(name); err != nil {
+		file.Close()
+		return nil, err
 	}
+
+	w := &Wal{
+		name:     name,
+		id:       id,
+		file:     file,
+		size:     size,
+		baseSize: size,
+		fsync:    fsync,
+		closed:   make(chan struct{}),
+	}
+
+	// Logs written by older versions get an id before anything is appended, otherwise
+	// snapshots could not record how much of them they cover
+	if id == "" {
+		if err := w.Discard(0); err != nil {
+			w.file.Close()
+			return nil, err
+		}
+	}
+
+	if fsync == FsyncEverySec {
+		go w.runSyncJob()
+	}
+
+	return w, nil
+}
+
+// Read the id of an existing log, it is empty for logs written by older versions
+func readWalId(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	wr := &walReader{r: bufio.NewReader(file), size: info.Size()}
+	if marker, err := wr.r.Peek(1); err != nil || marker[0] != walIdMarker {
+		return "", nil
+	}
+	return wr.nextMarked()
+}
+
+// Append a record to the log and return its offset, which can be passed to WaitSync()
+func (w *Wal) Append(line string) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	record := encodeWalRecord(line)
+	n, err := w.file.WriteString(record)
+	w.size += int64(n)
+	w.appended += int64(n)
+	if err != nil {
+		return -1, err
+	}
+
+	if w.rewriteBuf != nil {
+		w.rewriteBuf.WriteString(record)
+	}
+
+	return w.appended, nil
+}
+
+// Sync the log to disk up to at least the given offset. If a sync is already running the
+// caller waits for it and only syncs again if it did not cover its offset, this way writes
+// from many connections are flushed with a single fsync.
+func (w *Wal) Sync(offset int64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	if w.synced >= offset {
+		return nil
+	}
+
+	w.mu.Lock()
+	file := w.file
+	appended := w.appended
+	w.mu.Unlock()
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	w.synced = appended
+	w.syncs++
+	return nil
+}
+
+// Wait for the record at the given offset to reach the disk, this only syncs when the
+// policy is "always", otherwise it returns immediately
+func (w *Wal) WaitSync(offset int64) error {
+	if w.fsync != FsyncAlways {
+		return nil
+	}
+
+	return w.Sync(offset)
+}
+
+// Sync everything appended so far every second, used by the "everysec" policy
+func (w *Wal) runSyncJob() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.closed:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			appended := w.appended
+			w.mu.Unlock()
+
+			if err := w.Sync(appended); err != nil {
+				fmt.Println("Failed to sync WAL:", err)
+			}
+		}
+	}
+}
+
+// Current size of the log in bytes
+func (w *Wal) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Current end of the log, it is stored in snapshots so that replaying the log after loading
+// them skips what they already contain
+func (w *Wal) Position() WalPosition {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WalPosition{Id: w.id, Offset: w.size}
+}
+
+// Remove the first n bytes of the log, this is used after a snapshot has been written since
+// all the commands before that point are already part of the snapshot. The log gets a new id,
+// so a snapshot of the old one never skips records of the new one.
+func (w *Wal) Discard(n int64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	src, err := os.Open(w.name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err = src.Seek(n, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmpName := w.name + ".tmp"
+	tmp, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+
+	id := newWalId()
+	header, err := tmp.WriteString(encodeWalId(id))
+	var written int64
+	if err == nil {
+		written, err = io.Copy(tmp, src)
+		written += int64(header)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err = os.Rename(tmpName, w.name); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.name, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.file.Close()
+	w.file = file
+	w.id = id
+	w.size = written
+	w.baseSize = written
+	w.synced = w.appended
+	return nil
+}
+
+// Check if the log has grown more than multiple times its size after the last rewrite
+func (w *Wal) NeedsRewrite(multiple int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if multiple <= 0 || w.rewriteBuf != nil || w.size < WalRewriteMinSize {
+		return false
+	}
+
+	return w.size > w.baseSize*int64(multiple)
+}
+
+// Start keeping a copy of every appended record in memory, so they can be added to the
+// end of the rewritten log once it is ready
+func (w *Wal) StartRewrite() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rewriteBuf = &bytes.Buffer{}
+}
+
+func (w *Wal) AbortRewrite() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rewriteBuf = nil
+}
+
+// Append the records captured since StartRewrite() to the rewritten log and atomically
+// replace the current log with it, id is the one the rewritten log was written with
+func (w *Wal) FinishRewrite(tmpName string, id string) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf := w.rewriteBuf
+	w.rewriteBuf = nil
+
+	tmp, err := os.OpenFile(tmpName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = os.Rename(tmpName, w.name); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	w.file.Close()
+	w.file = tmp
+	w.id = id
+	w.size = info.Size()
+	w.baseSize = info.Size()
+	w.synced = w.appended
+	return nil
+}
+
+// Write the given commands as a new log with the given id, the log always starts with a
+// FLUSHALL so that it can be replayed on top of an older snapshot
+func writeWalRewrite(name string, id string, cmds [][]string) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bw := bufio.NewWriter(file)
+	bw.WriteString(encodeWalId(id))
+	bw.WriteString(encodeWalRecord("flushall"))
+	for _, cmd := range cmds {
+		bw.WriteString(encodeWalRecord(StringifyArgs(cmd)))
+	}
+
+	return bw.Flush()
+}
+
+func (w *Wal) Close() error {
+	close(w.closed)
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Rewrite the WAL from a copy of the database in a separate goroutine. Commands executed
+// while the rewrite is running are appended to the new log before it replaces the old one.
+// The database lock must be held by the caller.
+func (s *Server) bgRewriteWal() error {
+	if s.wal == nil {
+		return ErrWalDisabled
+	}
+	if s.rewriting {
+		return ErrRewriteInProgress
+	}
+	if s.saving {
+		return ErrSaveInProgress
+	}
+	if s.hasPendingWrites() {
+		return ErrBatchPending
+	}
+
+	cmds := s.db.RewriteCommands()
+	s.wal.StartRewrite()
+	s.rewriting = true
+
+	go func() {
+		tmpName := WalName + ".rewrite"
+		id := newWalId()
+		err := writeWalRewrite(tmpName, id, cmds)
+		if err == nil {
+			err = s.wal.FinishRewrite(tmpName, id)
+		}
+
+		if err != nil {
+			s.wal.AbortRewrite()
+			os.Remove(tmpName)
+			fmt.Println("Background WAL rewrite failed:", err)
+		} else {
+			fmt.Println("Background WAL rewrite completed")
+		}
+
+		s.dbmu.Lock()
+		s.rewriting = false
+		s.dbmu.Unlock()
+	}()
+
+	return nil
 }
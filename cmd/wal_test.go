@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"skabillium/memo/cmd/db"
+	"skabillium/memo/cmd/resp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func readWalLines(name string) ([]string, error) {
+	lines := []string{}
+	_, err := ReadWal(name, WalPosition{}, func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	return lines, err
+}
+
+func TestReadWal(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "wal.log")
+	data := encodeWalRecord("set a 1") + "$7\r\nset b 2\r\n" + encodeWalRecord("del a")
+	os.WriteFile(name, []byte(data), 0644)
+
+	lines, err := readWalLines(name)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	expected := []string{"set a 1", "set b 2", "del a"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Error("Expected lines to be", expected, "got", lines)
+	}
+}
+
+func TestReadWalTornTail(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "wal.log")
+	first := encodeWalRecord("set a 1")
+	second := encodeWalRecord("set b 2")
+
+	// Cut inside the payload and inside the header
+	for _, tail := range []string{second[:len(second)-3], second[:walHeaderSize-2]} {
+		os.WriteFile(name, []byte(first+tail), 0644)
+
+		lines, err := readWalLines(name)
+		var walErr *WalError
+		if !errors.As(err, &walErr) || !walErr.Torn || walErr.Offset != int64(len(first)) {
+			t.Fatal("Expected torn record error at offset", len(first), "got", err)
+		}
+		if !reflect.DeepEqual(lines, []string{"set a 1"}) {
+			t.Error("Expected only the first record to be read, got", lines)
+		}
+	}
+}
+
+func TestReadWalCorrupted(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "wal.log")
+	first := []byte(encodeWalRecord("set a 1"))
+	first[len(first)-1] = '2'
+	second := encodeWalRecord("set b 2")
+	os.WriteFile(name, append(first, second...), 0644)
+
+	_, err := readWalLines(name)
+	var walErr *WalError
+	if !errors.As(err, &walErr) || walErr.Torn || walErr.Offset != 0 {
+		t.Error("Expected checksum error at offset 0, got", err)
+	}
+
+	// A bad checksum on the last record is treated as a torn write
+	os.WriteFile(name, []byte(second+string(first)), 0644)
+	_, err = readWalLines(name)
+	if !errors.As(err, &walErr) || !walErr.Torn || walErr.Offset != int64(len(second)) {
+		t.Error("Expected torn record error at offset", len(second), "got", err)
+	}
+}
+
+func TestReadWalCorruptedLength(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "wal.log")
+	first := []byte(encodeWalRecord("set a 1"))
+	first[1] = 0xff
+	second := encodeWalRecord("set b 2")
+	os.WriteFile(name, append(first, second...), 0644)
+
+	_, err := readWalLines(name)
+	var walErr *WalError
+	if !errors.As(err, &walErr) || walErr.Torn || walErr.Offset != 0 || walErr.Reason != "invalid record length" {
+		t.Error("Expected invalid length error at offset 0, got", err)
+	}
+
+	legacy := "$7\r\nset a 1\r\n$4000000000\r\nset b 2\r\n" + second
+	os.WriteFile(name, []byte(legacy), 0644)
+	_, err = readWalLines(name)
+	if !errors.As(err, &walErr) || walErr.Torn || walErr.Offset != 13 || walErr.Reason != "invalid bulk string length" {
+		t.Error("Expected invalid length error at offset 13, got", err)
+	}
+}
+
+func TestWalTruncateTornPayload(t *testing.T) {
+	s := newWalServer(t)
+	execLine(t, s, "set a 1")
+	start := s.wal.Size()
+	execLine(t, s, "set b 2")
+
+	// The header of the last record was written but its payload was cut short
+	os.Truncate(WalName, s.wal.Size()-3)
+	s = restartWalServer(t)
+	if res := execLine(t, s, "get a"); res != "1" {
+		t.Error("Expected a to be 1, got", res)
+	}
+	if res := execLine(t, s, "get b"); res != nil {
+		t.Error("Expected b to be removed with the torn record, got", res)
+	}
+	if size := s.wal.Size(); size != start {
+		t.Error("Expected the WAL to be truncated at", start, "got", size)
+	}
+}
+
+func TestRewriteQueueOptionValues(t *testing.T) {
+	s := newWalServer(t)
+	values := []string{"at", "5", "pr", "delay", "1"}
+	for _, value := range values {
+		execLine(t, s, "qadd queue "+value)
+	}
+
+	s.dbmu.Lock()
+	err := s.bgRewriteWal()
+	s.dbmu.Unlock()
+	if err != nil {
+		t.Fatal("Unexpected error rewriting WAL", err)
+	}
+	waitFor(t, "rewrite", func() bool {
+		s.dbmu.RLock()
+		defer s.dbmu.RUnlock()
+		return !s.rewriting
+	})
+
+	s = restartWalServer(t)
+	if res := execLine(t, s, "qpop queue 10"); !reflect.DeepEqual(res, values) {
+		t.Error("Expected values to be popped as they were added, got", res)
+	}
+}
+
+func TestWalGroupCommit(t *testing.T) {
+	s := newWalServer(t)
+	s.wal.fsync = FsyncAlways
+
+	// Writes that arrive while a sync is running wait for it and share the next one
+	const n = 10
+	s.wal.syncMu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			s.wal.syncMu.Unlock()
+		}
+	}()
+	syncs := s.wal.syncs
+	acked := make(chan any, n)
+	for i := 0; i < n; i++ {
+		go func(i int) { acked <- execLine(t, s, "set key:"+strconv.Itoa(i)+" value") }(i)
+	}
+	waitFor(t, "writes", func() bool {
+		s.dbmu.RLock()
+		defer s.dbmu.RUnlock()
+		return s.db.Size() == n
+	})
+
+	select {
+	case res := <-acked:
+		t.Fatal("Expected no write to be acknowledged before it is synced, got", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	locked = false
+	s.wal.syncMu.Unlock()
+	for i := 0; i < n; i++ {
+		if res := <-acked; res != resp.SimpleString("OK") {
+			t.Error("Expected write to succeed, got", res)
+		}
+	}
+
+	s.wal.syncMu.Lock()
+	s.wal.mu.Lock()
+	if s.wal.syncs != syncs+1 {
+		t.Error("Expected the writes to share a single sync, got", s.wal.syncs-syncs)
+	}
+	if s.wal.synced != s.wal.appended {
+		t.Error("Expected every write to be synced, got", s.wal.synced, "of", s.wal.appended)
+	}
+	s.wal.mu.Unlock()
+	s.wal.syncMu.Unlock()
+}
+
+func TestWithAbsoluteExpiry(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+
+	cmd, _ := ParseCommand("expire name 10")
+	abs, exec := withAbsoluteExpiry(cmd, "expire name 10", now)
+	expected := &Command{Kind: CmdPExpireAt, Key: "name", ExpireAt: 1700000010000}
+	if !reflect.DeepEqual(abs, expected) || exec != "pexpireat name 1700000010000" {
+		t.Error("Expected other result for expire, got", abs, exec)
+	}
+
+	cmd, _ = ParseCommand("pexpire name 1500 gt")
+	abs, exec = withAbsoluteExpiry(cmd, "pexpire name 1500 gt", now)
+	expected = &Command{Kind: CmdPExpireAt, Key: "name", ExpireAt: 1700000001500, Expire: db.ExpireOptions{GT: true}}
+	if !reflect.DeepEqual(abs, expected) || exec != "pexpireat name 1700000001500 gt" {
+		t.Error("Expected other result for pexpire, got", abs, exec)
+	}
+
+	cmd, _ = ParseCommand("set name \"bill murray\" ex 5")
+	abs, exec = withAbsoluteExpiry(cmd, "", now)
+	expected = &Command{Kind: CmdSet, Key: "name", Value: "bill murray", ExpireAt: 1700000005000}
+	if !reflect.DeepEqual(abs, expected) || exec != "set name \"bill murray\" pxat 1700000005000" {
+		t.Error("Expected other result for set, got", abs, exec)
+	}
+
+	cmd, _ = ParseCommand("set name bill")
+	if abs, exec = withAbsoluteExpiry(cmd, "set name bill", now); abs != cmd || exec != "set name bill" {
+		t.Error("Expected set without expiration to be left as is")
+	}
+
+	cmd, _ = ParseCommand("qreserve jobs 1.5")
+	abs, exec = withAbsoluteExpiry(cmd, "qreserve jobs 1.5", now)
+	if abs.ExpireAt != 1700000001500 || abs.LeaseId == "" || exec != "qreserve jobs pxat 1700000001500 id "+abs.LeaseId {
+		t.Error("Expected other result for qreserve, got", abs, exec)
+	}
+	if replayed, _ := ParseCommand(exec); !reflect.DeepEqual(replayed, abs) {
+		t.Error("Expected replayed qreserve to be", abs, "got", replayed)
+	}
+
+	cmd, _ = ParseCommand("qadd jobs delay 2 pr 3 a b")
+	abs, exec = withAbsoluteExpiry(cmd, "qadd jobs delay 2 pr 3 a b", now)
+	expected = &Command{Kind: CmdQueueAdd, Key: "jobs", Values: []string{"a", "b"}, Priority: 3, NotBefore: 1700000002000}
+	if !reflect.DeepEqual(abs, expected) || exec != "qadd jobs pr 3 at 1700000002000 a b" {
+		t.Error("Expected other result for qadd, got", abs, exec)
+	}
+	if replayed, _ := ParseCommand(exec); !reflect.DeepEqual(replayed, abs) {
+		t.Error("Expected replayed qadd to be", abs, "got", replayed)
+	}
+}
+
+// Start a server with the WAL enabled in a temporary working directory, where the WAL and
+// the snapshot are written
+func newWalServer(t *testing.T) *Server {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	return restartWalServer(t)
+}
+
+// Start a new server from the snapshot and the WAL in the working directory, as if the old
+// one had crashed. Records torn by the crash are truncated.
+func restartWalServer(t *testing.T) *Server {
+	s := NewServer(&ServerOptions{WalEnabled: true, WalTruncate: true})
+	if FileExists(SnapshotName) {
+		if _, err := s.LoadSnapshot(); err != nil {
+			t.Fatal("Unexpected error loading snapshot", err)
+		}
+	}
+	if FileExists(WalName) {
+		if _, err := s.BuildDbFromWal(); err != nil {
+			t.Fatal("Unexpected error replaying WAL", err)
+		}
+	}
+
+	wal, err := OpenWal(WalName, FsyncNo)
+	if err != nil {
+		t.Fatal("Unexpected error opening WAL", err)
+	}
+	s.wal = wal
+	t.Cleanup(func() { wal.Close() })
+
+	return s
+}
+
+func execLine(t *testing.T, s *Server, line string) any {
+	cmd, err := ParseCommand(line)
+	if err != nil {
+		t.Fatal("Unexpected error parsing", line, err)
+	}
+	return s.ExecuteAndLog(cmd, line)
+}
+
+func TestSaveCrashBeforeDiscard(t *testing.T) {
+	s := newWalServer(t)
+	execLine(t, s, "rpush list a")
+	execLine(t, s, "hincrby hash field 1")
+
+	// The snapshot is in place but the server crashes before the WAL is discarded
+	if err := writeSnapshot(s.db, s.wal.Position()); err != nil {
+		t.Fatal("Unexpected error writing snapshot", err)
+	}
+	execLine(t, s, "rpush list b")
+
+	s = restartWalServer(t)
+	if res := execLine(t, s, "llen list"); res != 2 {
+		t.Error("Expected list length to be 2, got", res)
+	}
+	if res := execLine(t, s, "hget hash field"); res != "1" {
+		t.Error("Expected field to be 1, got", res)
+	}
+
+	// After a completed save the snapshot and the rest of the WAL are loaded as they are
+	if err := s.save(); err != nil {
+		t.Fatal("Unexpected error saving", err)
+	}
+	execLine(t, s, "rpush list c")
+
+	s = restartWalServer(t)
+	if res := execLine(t, s, "llen list"); res != 3 {
+		t.Error("Expected list length to be 3, got", res)
+	}
+}
+
+func TestSaveLegacyWal(t *testing.T) {
+	newWalServer(t)
+	os.WriteFile(WalName, []byte("$12\r\nrpush list a\r\n"), 0644)
+
+	// The log gets an id when it is opened, so a snapshot can record how much of it it covers
+	s := restartWalServer(t)
+	if id := s.wal.Position().Id; id == "" {
+		t.Fatal("Expected the legacy log to get an id")
+	}
+	if records, err := readWalLines(WalName); err != nil || !reflect.DeepEqual(records, []string{"rpush list a"}) {
+		t.Fatal("Expected the records of the legacy log to be kept, got", records, err)
+	}
+
+	if err := writeSnapshot(s.db, s.wal.Position()); err != nil {
+		t.Fatal("Unexpected error writing snapshot", err)
+	}
+	s = restartWalServer(t)
+	if res := execLine(t, s, "llen list"); res != 1 {
+		t.Error("Expected list length to be 1, got", res)
+	}
+}
+
+func TestReplayKeepsExpiration(t *testing.T) {
+	s := newWalServer(t)
+	execLine(t, s, "set name bill ex 100")
+	execLine(t, s, "set other bill")
+	execLine(t, s, "expire other 200")
+
+	// Replaying later must not extend the expiration
+	time.Sleep(20 * time.Millisecond)
+	s = restartWalServer(t)
+	if ttl, ok := execLine(t, s, "pttl name").(int); !ok || ttl > 100000-20 || ttl < 90000 {
+		t.Error("Expected name to expire in less than 100s, got", ttl)
+	}
+	if ttl, ok := execLine(t, s, "pttl other").(int); !ok || ttl > 200000-20 || ttl < 190000 {
+		t.Error("Expected other to expire in less than 200s, got", ttl)
+	}
+}
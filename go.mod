@@ -2,8 +2,12 @@ module skabillium/memo
 
 go 1.21.7
 
+require (
+	github.com/redis/go-redis/v9 v9.5.1
+	github.com/yuin/gopher-lua v1.1.1
+)
+
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/redis/go-redis/v9 v9.5.1 // indirect
 )